@@ -2,41 +2,164 @@ package editorview
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"math"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
 var (
-	whitespacePattern = regexp.MustCompile("\\s+")
-	selectFromToken   = "<select-from>"
-	selectFromPattern = regexp.MustCompile(selectFromToken)
-	selectToToken     = "<select-to>"
-	selectToPattern   = regexp.MustCompile(selectToToken)
-	selectionPattern  = regexp.MustCompile(fmt.Sprintf("(?s)(%s|%s)(.*)(%s|%s)", selectToPattern, selectFromPattern, selectToPattern, selectFromPattern))
-	colorTagPattern   = regexp.MustCompile("<color:([A-Fa-f0-9]{6,6}):([A-Fa-f0-9]{6,6})>")
+	whitespacePattern    = regexp.MustCompile("\\s+")
+	selectFromToken      = "<select-from>"
+	selectFromPattern    = regexp.MustCompile(selectFromToken)
+	selectToToken        = "<select-to>"
+	selectToPattern      = regexp.MustCompile(selectToToken)
+	selectionPattern     = regexp.MustCompile(fmt.Sprintf("(?s)(%s|%s)(.*)(%s|%s)", selectToPattern, selectFromPattern, selectToPattern, selectFromPattern))
+	selectTokenPattern   = regexp.MustCompile(fmt.Sprintf("%s|%s", selectFromPattern, selectToPattern))
+	leadingMarkupPattern = regexp.MustCompile(fmt.Sprintf("^(%s|%s)+", selectTokenPattern, colorTagPattern))
+	colorTagPattern      = regexp.MustCompile("<color:([A-Fa-f0-9]{6,6}):([A-Fa-f0-9]{6,6})>")
+	// Markup after the whitespace keeps it from matching, so trimming never touches tags or the selection.
+	trailingWhitespacePattern = regexp.MustCompile("(?m)[ \t]+$")
+	markupPattern             = regexp.MustCompile(fmt.Sprintf("%s|%s", selectTokenPattern, colorTagPattern))
+	leadingIndentPattern      = regexp.MustCompile(fmt.Sprintf("^(%s|%s|[ \t])*", selectTokenPattern, colorTagPattern))
 )
 
 const (
-	DefaultHelpMessage = `Ctrl-a: Toggle this help view
-Ctrl-w: Close editor
-🡐 🡒 🡑 🡓, Ctrl-🡐 🡒 🡑 🡓, PgUp, PgDown, Home, End: Cursor movement
-Delete, Backspace: Remove single character
-Shift-[cursor movement]: Select
+	// The cursor can't move further in the requested direction.
+	BellBoundary = "boundary"
+	// The user tried to edit while the editor is ReadOnly.
+	BellReadOnly = "read-only"
+	// The Formatter returned an error, or invalid markup.
+	BellFormat = "format"
+	// Find found no match.
+	BellNotFound = "not-found"
+	// The pattern typed for Ctrl-r is not a valid regular expression.
+	BellInvalidPattern = "invalid-pattern"
+	// The line typed for Ctrl-g is not a number.
+	BellInvalidLine = "invalid-line"
+)
+
+// editingKeys are the keys that change the content, other than by selecting.
+var editingKeys = map[tcell.Key]bool{
+	tcell.KeyEnter:      true,
+	tcell.KeyBackspace:  true,
+	tcell.KeyBackspace2: true,
+	tcell.KeyDelete:     true,
+	tcell.KeyTab:        true,
+	tcell.KeyBacktab:    true,
+	tcell.KeyRune:       true,
+	tcell.KeyCtrlZ:      true,
+	tcell.KeyCtrlY:      true,
+	tcell.KeyCtrlX:      true,
+	tcell.KeyCtrlV:      true,
+	tcell.KeyCtrlD:      true,
+	tcell.KeyCtrlJ:      true,
+	tcell.KeyCtrlR:      true,
+	// Terminals send Ctrl-/ as Ctrl-_.
+	tcell.KeyCtrlUnderscore: true,
+}
+
+const (
+	DefaultHelpMessage = `F1: Toggle this help view
+Ctrl-w, Ctrl-q: Close editor, Abort editing
+Ctrl-s: Save
+Insert: Toggle overwriting
+🡐 🡒 🡑 🡓, Ctrl-🡐 🡒 🡑 🡓, Alt-🡐 🡒, PgUp, PgDown, Home, End, Ctrl-Home, Ctrl-End: Cursor movement
+Delete, Backspace, Ctrl-Backspace, Ctrl-Delete: Remove single character, Remove word
+Shift-[cursor movement], Ctrl-a: Select, Select all
+Ctrl-b, Alt-drag: Select block
 Esc, Ctrl-c, Ctrl-x, Ctrl-v: Unselect, Copy, Cut, Paste
-Tab: Insert spaces to next 4-wide tab
-Ctrl-z, Ctrl-y: Undo, Redo`
+Tab: Insert spaces to next 4-wide tab, or indent selected lines
+Shift-Tab: Dedent line or selected lines
+Ctrl-z, Ctrl-y: Undo, Redo
+Ctrl-f, F3, Shift-F3: Find, Find next, Find previous
+Ctrl-r: Replace, answering y, n, a or q for each match
+Ctrl-g, Ctrl-l: Go to line, Center cursor line
+Ctrl-d: Duplicate line or selected lines
+Ctrl-j: Join line with the next, or the selected lines
+Alt-🡑 🡓: Move line or selected lines
+Ctrl-/: Toggle comment of line or selected lines
+Alt-u, Alt-l: Uppercase, Lowercase selection
+Alt-Shift-f: Format`
+)
+
+var (
+	// ErrAborted is returned by Edit when the abort key closed the editor.
+	ErrAborted = errors.New("edit aborted")
+)
+
+var (
+	// DefaultSelectionPairs are the SelectionPairs of editors without any. Changing it affects every editor
+	// using it.
+	DefaultSelectionPairs = map[rune]rune{
+		'(':  ')',
+		'[':  ']',
+		'{':  '}',
+		'"':  '"',
+		'\'': '\'',
+	}
+)
+
+// Entity is an escape sequence for a rune that can't be written as itself in the markup.
+type Entity struct {
+	Name string
+	Rune rune
+}
+
+var (
+	// DefaultEntities are the escape sequences of editors without Entities, and of Escape, Unescape and
+	// PlainText. Changing it affects every editor using it. Entities for '&', '<' and '>' must always be present.
+	DefaultEntities = []Entity{
+		{Name: "&amp;", Rune: '&'},
+		{Name: "&lt;", Rune: '<'},
+		{Name: "&gt;", Rune: '>'},
+	}
 )
 
+// Escape replaces the runes of DefaultEntities in s with their entities.
 func Escape(s string) string {
-	return strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(s, "&", "&amp;"), "<", "&lt;"), ">", "&gt;")
+	return escapeEntities(DefaultEntities, s)
+}
+
+func escapeEntities(entities []Entity, s string) string {
+	res := &bytes.Buffer{}
+	for _, r := range s {
+		escaped := false
+		for _, entity := range entities {
+			if entity.Rune == r {
+				res.WriteString(entity.Name)
+				escaped = true
+				break
+			}
+		}
+		if !escaped {
+			res.WriteRune(r)
+		}
+	}
+	return res.String()
+}
+
+// Unescape replaces the DefaultEntities in s with their runes, reversing Escape.
+func Unescape(s string) string {
+	oldnew := make([]string, 0, len(DefaultEntities)*2)
+	for _, entity := range DefaultEntities {
+		oldnew = append(oldnew, entity.Name, string(entity.Rune))
+	}
+	// Replacing left to right in a single pass keeps "&amp;lt;" from becoming "<".
+	return strings.NewReplacer(oldnew...).Replace(s)
 }
 
 type point struct {
@@ -50,6 +173,14 @@ func (p point) dist(o point) int {
 	return int(math.Round(math.Sqrt(dx*dx + dy*dy)))
 }
 
+func (p point) before(o point) bool {
+	return p.y < o.y || (p.y == o.y && p.x < o.x)
+}
+
+func (p point) position() Position {
+	return Position{Line: p.y, Col: p.x}
+}
+
 func (p point) clone() *point {
 	cpy := p
 	return &cpy
@@ -61,6 +192,26 @@ func (s segment) len() int {
 	return s[0].dist(s[1])
 }
 
+func (s segment) span() Span {
+	return Span{From: s[0].position(), To: s[1].position()}
+}
+
+// Position is a raw position, where Col counts the runes of the line including markup.
+type Position struct {
+	Line int
+	Col  int
+}
+
+func (p Position) before(o Position) bool {
+	return p.Line < o.Line || (p.Line == o.Line && p.Col < o.Col)
+}
+
+// Span is the range of raw positions from From up to, but not including, To.
+type Span struct {
+	From Position
+	To   Position
+}
+
 type points []point
 
 func (p points) Len() int {
@@ -81,6 +232,7 @@ func (p points) Swap(i, j int) {
 }
 
 type patch struct {
+	// Raw position, which unlike the screen position is still valid when the patch has reshaped the buffer.
 	cursor  point
 	patches []diffmatchpatch.Patch
 }
@@ -89,7 +241,130 @@ type popup struct {
 	message string
 }
 
-func (p *popup) draw(s tcell.Screen) {
+// canvas is what the editor draws on, either a view of the screen or the cells returned by Cells.
+type canvas interface {
+	Size() (int, int)
+	SetContent(x, y int, primary rune, combining []rune, style tcell.Style)
+}
+
+// shiftedCanvas is the top of a canvas from x, width wide and height high, like the text between the line
+// numbers and the status bar.
+type shiftedCanvas struct {
+	canvas
+	x, width, height int
+}
+
+func (s shiftedCanvas) Size() (int, int) {
+	return s.width, s.height
+}
+
+func (s shiftedCanvas) SetContent(x, y int, primary rune, combining []rune, style tcell.Style) {
+	if x < 0 || x >= s.width || y < 0 || y >= s.height {
+		return
+	}
+	s.canvas.SetContent(s.x+x, y, primary, combining, style)
+}
+
+// Cell is a cell of what the editor draws. The cell after a wide rune is part of it, and has Rune 0.
+type Cell struct {
+	Rune      rune
+	Style     tcell.Style
+	Combining []rune
+}
+
+type cells [][]Cell
+
+func (c cells) Size() (int, int) {
+	if len(c) == 0 {
+		return 0, 0
+	}
+	return len(c[0]), len(c)
+}
+
+func (c cells) SetContent(x, y int, primary rune, combining []rune, style tcell.Style) {
+	if y < 0 || y >= len(c) || x < 0 || x >= len(c[y]) {
+		return
+	}
+	c[y][x] = Cell{Rune: primary, Style: style, Combining: combining}
+}
+
+// view is the region of the screen the editor draws into, translating its coordinates to screen coordinates.
+type view struct {
+	screen              tcell.Screen
+	x, y, width, height int
+}
+
+func (v view) Size() (int, int) {
+	return v.width, v.height
+}
+
+func (v view) SetContent(x, y int, primary rune, combining []rune, style tcell.Style) {
+	if x < 0 || y < 0 || x >= v.width || y >= v.height {
+		return
+	}
+	v.screen.SetContent(v.x+x, v.y+y, primary, combining, style)
+}
+
+func (v view) GetContent(x, y int) (rune, []rune, tcell.Style, int) {
+	return v.screen.GetContent(v.x+x, v.y+y)
+}
+
+// inside returns the point in the view at screen coordinates x, y, and whether the view contains it.
+func (v view) inside(x, y int) (point, bool) {
+	p := point{x: x - v.x, y: y - v.y}
+	return p, p.x >= 0 && p.y >= 0 && p.x < v.width && p.y < v.height
+}
+
+func (v view) ShowCursor(x, y int) {
+	v.screen.ShowCursor(v.x+x, v.y+y)
+}
+
+// prompt reads a line of input on the bottom line of the screen, instead of the editor reading keys.
+type prompt struct {
+	label string
+	input []rune
+	// Called with the input when Enter is pressed.
+	done func(input string)
+	// Makes runes call choose instead of editing the input, for prompts answered with a single key.
+	choose func(r rune)
+	// Called when Esc closes the prompt.
+	cancel func()
+}
+
+// replacement is an interactive replace walking through the matches of pattern, which Ctrl-r starts.
+type replacement struct {
+	pattern *regexp.Regexp
+	repl    string
+	// Raw segments of the matches in the content when the replace started.
+	matches []segment
+	// Whether each match so far was accepted.
+	accepted []bool
+}
+
+func (p *prompt) draw(s canvas) {
+	width, height := s.Size()
+	style := tcell.StyleDefault.Reverse(true)
+	line := []rune(p.label + string(p.input))
+	for x := 0; x < width; x++ {
+		r := ' '
+		if x < len(line) {
+			r = line[x]
+		}
+		s.SetContent(x, height-1, r, nil, style)
+	}
+}
+
+// cursor returns the screen position of the end of the input.
+func (p *prompt) cursor(s canvas) (int, int) {
+	width, height := s.Size()
+	x := len([]rune(p.label)) + len(p.input)
+	if x > width-1 {
+		x = width - 1
+	}
+	return x, height - 1
+}
+
+func (p *popup) draw(s canvas) {
 	width, height := s.Size()
 	lines := strings.Split(p.message, "\n")
 	lineWidth := 0
@@ -138,6 +413,12 @@ func (p *popup) draw(s tcell.Screen) {
 	}
 }
 
+func (e *Editor) bell(reason string) {
+	if e.OnBell != nil {
+		e.OnBell(reason)
+	}
+}
+
 func (e *Editor) toggleHelp() {
 	defer e.redraw()
 	e.hideHelp = !e.hideHelp
@@ -147,6 +428,114 @@ type Editor struct {
 	Screen      tcell.Screen
 	EventFilter func(tcell.Event) []tcell.Event
 	HelpMessage string
+	// The key that closes the editor, defaults to Ctrl-w.
+	QuitKey tcell.Key
+	// Returns whether a key closes the editor, instead of it being QuitKey.
+	ShouldQuit func(ev *tcell.EventKey) bool
+	// The key that closes the editor discarding the edits, defaults to Ctrl-q.
+	AbortKey tcell.Key
+	// Makes closing the editor leave the screen to the host, instead of finalizing it.
+	ManageScreen bool
+	// Width of a tab stop, defaults to 4.
+	TabWidth int
+	// Makes Tab insert a tab rune, instead of spaces to the next tab stop.
+	UseHardTabs bool
+	// Makes Enter indent the new line like the line it was split from.
+	AutoIndent bool
+	// Returns the number of levels, of one TabWidth each, AutoIndent should indent the new line more, or less
+	// when negative, than the line it was split from, given the text of that line before the cursor.
+	// OpenerIndentRule is one such rule.
+	IndentRule func(prevLine string) (delta int)
+	// Closers that dedent their line by one TabWidth when typed after only whitespace.
+	DedentOnCloser map[rune]bool
+	// Makes Backspace inside leading spaces remove back to the previous tab stop.
+	SoftTabBackspace bool
+	// Shows the number of each line to the left of it.
+	ShowLineNumbers bool
+	// Shows the position of the cursor, and whether the content is modified, on the bottom line.
+	ShowStatusBar bool
+	// Style of the status bar, defaults to reversed.
+	StatusBarStyle tcell.Style
+	// Wraps long lines after the last whitespace that fits on the screen line, instead of after the last rune
+	// that fits. Words longer than the screen is wide are still wrapped after the last rune that fits.
+	WrapAtWords bool
+	// Reserves the rightmost column for arrows showing if there is content above or below the screen.
+	ScrollIndicators bool
+	// Lets the last line scroll all the way to the top of the screen, instead of stopping at the bottom.
+	// ScrollToBottom and Ctrl-End still put the last line at the bottom of the screen.
+	ScrollPastEnd bool
+	// Openers that wrap the selection in themselves and their closers when typed, defaults to DefaultSelectionPairs.
+	SelectionPairs map[rune]rune
+	// The escape sequences of the content, defaults to DefaultEntities. Entities for '&', '<' and '>' must always
+	// be present. Set it before giving the editor content, since lines already laid out keep their runes.
+	Entities []Entity
+	// Prefix of commented lines, like "// ", that Ctrl-/ adds to or removes from lines. Empty disables Ctrl-/.
+	CommentPrefix string
+	// Matches the runes word-wise movement and deletion stop at changes to and from, defaults to whitespace.
+	WordBoundary *regexp.Regexp
+	// Makes Ctrl-j join lines without a space between them.
+	JoinWithoutSpace bool
+	// Openers that insert their closers after the cursor when typed, or wrap the selection like SelectionPairs.
+	// Typing one of the closers right before the same closer moves past it instead.
+	AutoClosePairs map[rune]rune
+	// Returns the style of each visible rune of a raw line, given the visible runes, without markup. Missing and
+	// tcell.StyleDefault styles keep the style of the markup, and selection and search highlights win over it.
+	// Lines are only highlighted again when they change, so it must depend on nothing but its arguments.
+	Highlighter func(line []rune, lineIdx int) []tcell.Style
+	// Highlights the runes of every line past this many columns with LineLengthStyle, 0 disables it.
+	LineLengthLimit int
+	// Style of the runes past LineLengthLimit, defaults to white on red.
+	LineLengthStyle tcell.Style
+	// Style of the matches of the last Find, until Esc, defaults to black on yellow.
+	SearchHighlightStyle tcell.Style
+	// Style of text without color markup, defaults to black on white. When set it also fills the rest of the
+	// screen, which otherwise has the default style of the terminal.
+	DefaultStyle tcell.Style
+	// Style of the selection, defaults to white on black.
+	SelectionStyle tcell.Style
+	// Gives the screen lines of the line of the cursor the background of CurrentLineStyle, except where
+	// selected or highlighted, while the editor is focused.
+	HighlightCurrentLine bool
+	// Style of the empty cells of the line of the cursor, whose background the runes get too, defaults to
+	// black on light gray.
+	CurrentLineStyle tcell.Style
+	// Returns the symbols, like functions or headings, of the content for GoToSymbol.
+	SymbolProvider func(content string) []Symbol
+	// Returns the content formatted, for Format and Alt-Shift-f. It gets the content as markup, and must return
+	// valid markup, or Format rejects it.
+	Formatter func(content string) (string, error)
+	// Makes changes store no undo patches, for hosts filling in content programmatically. Wrapping the
+	// fill in Batch instead makes it a single undo patch.
+	SuppressUndo bool
+	// Makes runes typed within this long of the previous one, right after it, a single undo patch with it.
+	// 0 makes every typed rune its own undo patch.
+	UndoCoalesceInterval time.Duration
+	// The number of undo patches to keep, dropping the oldest ones, 0 keeps all of them.
+	MaxUndoSteps int
+	// Makes the editing keys ring BellReadOnly instead, while moving, selecting and copying still work.
+	ReadOnly bool
+	// Told what each event, or each change made through the methods of the editor, did.
+	Observer Observer
+	// Used by Ctrl-c, Ctrl-x and Ctrl-v instead of a paste buffer of the editor, which they still use when the
+	// Clipboard fails.
+	Clipboard Clipboard
+	// Called with a patch turning the previous content into the new one, and the cursor after it, after each
+	// event or change made through the methods of the editor that changes the content, for sending to
+	// ApplyRemotePatch of other editors. SetContent and ApplyRemotePatch don't call it.
+	OnPatch func(p []diffmatchpatch.Patch, cursor Position)
+	// Called with the plain text of the content after each event, change made through the methods of the
+	// editor, or ApplyRemotePatch, that changes it. Selecting doesn't change the plain text.
+	OnChange func(content string)
+	// The line ending of Content, "\n", "\r\n", or "auto" or empty for the one used by most lines of the
+	// content given to Edit or SetContent.
+	LineEnding string
+	// Called with the Content when the user presses Ctrl-s. Returning nil makes the content unmodified, and
+	// an error is shown in the status bar.
+	OnSave func(content string) error
+	// Called with one of the Bell* reasons when the editor rejects a key, like moving past the edge of the
+	// content, editing while ReadOnly, or a Find without matches. Nothing limits the length of the content, so
+	// typing and pasting never ring it.
+	OnBell func(reason string)
 
 	// Edited text: [line][rune]
 	rawBuffer [][]rune
@@ -156,10 +545,14 @@ type Editor struct {
 	// Every line has a single point{x: -1, y: lineIdx} appended at the end to mark both cursor
 	// positions at the 'newline position' and lineIdx for empty lines.
 	screenBufferIndex [][]point
+	// Style of each rune in screenBuffer: [line][rune]
+	styleIndex [][]tcell.Style
 	// number of screenBuffer lines hidden above screen
 	lineOffset int
 
-	selecting   bool
+	selecting bool
+	// Where the ongoing mouse drag started, in screenBuffer coordinates to survive scrolling.
+	dragFrom    *point
 	pasteBuffer [][]rune
 	undoPatches []patch
 	redoPatches []patch
@@ -167,6 +560,207 @@ type Editor struct {
 	differ      *diffmatchpatch.DiffMatchPatch
 	hideHelp    bool
 	popups      []*popup
+	prompt      *prompt
+	// Whether the last event typed a rune, and the content before the typing the last undo patch restores,
+	// and the content, raw cursor and time after the last typed rune, to coalesce more typing into it.
+	typing        bool
+	typingFrom    string
+	typingContent string
+	typingCursor  point
+	typingAt      time.Time
+	// Returns the current time, defaults to time.Now.
+	clock func() time.Time
+	// The column moving up and down goes back to, the one the cursor had before a run of such moves.
+	desiredColumn *int
+	// The last query of Find or Ctrl-f, which FindNext, FindPrev and the Ctrl-f prompt use.
+	lastFind                string
+	lastFindCaseInsensitive bool
+	// Whether layout highlights the matches of lastFind.
+	highlightFind bool
+	// The ongoing interactive replace, if any, and the match it asks about.
+	replacing *replacement
+	candidate *segment
+	unfocused bool
+	// Depth of nested changes, which store a single undo patch and paint the screen once when done.
+	batching int
+	// Events received while the screen had no size.
+	unindexedEvents []tcell.Event
+	// The raw cursor left by changes made while the screen had no size, for the first layout on it.
+	unsizedCursor *point
+	// The rawBuffer and params of the last layout, and its state at the start of each raw line, to only lay
+	// out lines that changed.
+	laidOut       [][]rune
+	laidOutParams layoutParams
+	lineLayouts   []lineLayout
+	// Cached ContentHash, invalidated by layout, and the line ending it was hashed with.
+	contentHash       uint64
+	contentHashed     bool
+	contentHashEnding string
+	// Cached hash of the content without the selection, compared to the hash of the content given to Edit or
+	// SetContent, or last saved, by modified.
+	unselectedHash   uint64
+	unselectedHashed bool
+	loadedHash       uint64
+	// Region set by SetViewport, the whole screen when not set.
+	viewport    view
+	hasViewport bool
+	// The line ending used by most lines of the content given to Edit or SetContent.
+	detectedLineEnding string
+	// Whether typing replaces the rune under the cursor, toggled by Insert.
+	overwrite bool
+	// Shown in the status bar until the next key press.
+	statusMessage string
+	// Whether the editor was last closed by the abort key.
+	aborted bool
+	// Whether pasteBuffer is a copied block selection.
+	pasteBlock bool
+	// The corner the block selection spans from to the cursor, in screen columns of raw lines, if there is one.
+	block *point
+}
+
+// view returns the region of the screen the editor draws into.
+func (e *Editor) view() view {
+	if e.hasViewport {
+		return e.viewport
+	}
+	width, height := e.Screen.Size()
+	return view{screen: e.Screen, width: width, height: height}
+}
+
+// textView returns the region of the screen the text is drawn in, to the right of any line numbers.
+func (e *Editor) textView() view {
+	v := e.view()
+	gutter := e.gutterWidth()
+	v.x += gutter
+	v.width -= gutter
+	v.height -= e.statusBarHeight()
+	return v
+}
+
+// statusBarHeight returns the height of the status bar, if it is shown.
+func (e *Editor) statusBarHeight() int {
+	_, height := e.view().Size()
+	// The text needs at least one line.
+	if !e.ShowStatusBar || height < 2 {
+		return 0
+	}
+	return 1
+}
+
+func (e *Editor) statusBarStyle() tcell.Style {
+	if e.StatusBarStyle == tcell.StyleDefault {
+		return tcell.StyleDefault.Reverse(true)
+	}
+	return e.StatusBarStyle
+}
+
+// drawStatusBar draws the status bar, if it is shown, on the bottom line of c.
+func (e *Editor) drawStatusBar(c canvas) {
+	if e.statusBarHeight() == 0 || !e.indexed() {
+		return
+	}
+	width, height := c.Size()
+	line, col := e.lineRuneColumn(e.cursor)
+	status := []rune(fmt.Sprintf("Ln %v, Col %v", line+1, col+1))
+	if e.modified() {
+		status = append(status, []rune(" *")...)
+	}
+	if e.overwrite {
+		status = append(status, []rune(" OVR")...)
+	}
+	if e.statusMessage != "" {
+		status = append(status, []rune("  "+e.statusMessage)...)
+	}
+	for x := 0; x < width; x++ {
+		r := ' '
+		if x < len(status) {
+			r = status[x]
+		}
+		c.SetContent(x, height-1, r, nil, e.statusBarStyle())
+	}
+}
+
+// modified returns whether the content, apart from the selection, differs from the content given to Edit or
+// SetContent, or last saved.
+func (e *Editor) modified() bool {
+	if !e.unselectedHashed {
+		e.unselectedHash = hashString(selectTokenPattern.ReplaceAllString(runesToString(e.rawBuffer), ""))
+		e.unselectedHashed = true
+	}
+	return e.unselectedHash != e.loadedHash
+}
+
+// IsModified returns whether the content, apart from the selection, differs from the content given to Edit or
+// SetContent, or last saved or reset by ResetModified.
+func (e *Editor) IsModified() bool {
+	return e.modified()
+}
+
+// ResetModified makes the current content unmodified, for hosts saving it themselves.
+func (e *Editor) ResetModified() {
+	e.loadedHash = hashString(selectTokenPattern.ReplaceAllString(runesToString(e.rawBuffer), ""))
+}
+
+// gutterWidth returns the width of the line numbers, and the space after them, if they are shown.
+func (e *Editor) gutterWidth() int {
+	if !e.ShowLineNumbers {
+		return 0
+	}
+	width, _ := e.view().Size()
+	res := len(strconv.Itoa(len(e.rawBuffer))) + 1
+	// The text needs at least one column.
+	if res >= width {
+		return 0
+	}
+	return res
+}
+
+// SetViewport makes the editor draw into the width by height region of the screen at x, y, instead of the whole screen.
+// Wrapping, scrolling and the cursor all use the size of the region.
+func (e *Editor) SetViewport(x, y, width, height int) {
+	e.viewport = view{screen: e.Screen, x: x, y: y, width: width, height: height}
+	e.hasViewport = true
+	prevCursor := e.rawCursor()
+	e.redraw()
+	if e.indexed() {
+		e.restoreCursor(prevCursor)
+	} else {
+		e.setCursor()
+	}
+	e.showCursor()
+	e.Screen.Show()
+}
+
+// indexed returns whether the screenBuffer is built, which requires a screen with a size.
+func (e *Editor) indexed() bool {
+	return len(e.screenBufferIndex) > 0
+}
+
+func (e *Editor) showCursor() {
+	if e.unfocused {
+		e.Screen.HideCursor()
+	} else if e.prompt != nil {
+		e.view().ShowCursor(e.prompt.cursor(e.view()))
+	} else {
+		e.textView().ShowCursor(e.cursor.x, e.cursor.y)
+	}
+}
+
+// SetFocused shows or hides the cursor, for hosts that move focus between the editor and other views. It is a
+// method rather than a field since the screen has to be repainted for the change to show.
+func (e *Editor) SetFocused(focused bool) {
+	e.unfocused = !focused
+	if e.indexed() {
+		// The current line is only highlighted while focused.
+		e.paint()
+	}
+	e.showCursor()
+	e.Screen.Show()
+}
+
+// Focused returns whether the editor is focused, which it is until SetFocused(false).
+func (e *Editor) Focused() bool {
+	return !e.unfocused
 }
 
 func (e *Editor) runeAt(screenPoint point) rune {
@@ -180,18 +774,56 @@ func (e *Editor) runeAt(screenPoint point) rune {
 	return 0
 }
 
+// wordBoundaryAt returns whether the rune at the screen point matches WordBoundary.
+func (e *Editor) wordBoundaryAt(screenPoint point) bool {
+	pattern := e.WordBoundary
+	if pattern == nil {
+		pattern = whitespacePattern
+	}
+	return pattern.MatchString(string([]rune{e.runeAt(screenPoint)}))
+}
+
 func (e *Editor) differentWhitespaceness(screenPoint point) func(screenPoint point) bool {
-	currWhitespaceness := whitespacePattern.MatchString(string([]rune{e.runeAt(screenPoint)}))
+	currWhitespaceness := e.wordBoundaryAt(screenPoint)
 	return func(screenPoint point) bool {
-		return currWhitespaceness != whitespacePattern.MatchString(string([]rune{e.runeAt(screenPoint)}))
+		return currWhitespaceness != e.wordBoundaryAt(screenPoint)
+	}
+}
+
+// subwordBoundary returns true if the screen point starts a camelCase hump, a part of a snake_case word,
+// or a run of differently whitespaced runes.
+func (e *Editor) subwordBoundary(screenPoint point) bool {
+	if screenPoint.x == 0 {
+		return true
+	}
+	r := e.runeAt(screenPoint)
+	prev := e.runeAt(point{x: screenPoint.x - 1, y: screenPoint.y})
+	if whitespacePattern.MatchString(string([]rune{r})) != whitespacePattern.MatchString(string([]rune{prev})) {
+		return true
+	}
+	if unicode.IsLower(prev) && unicode.IsUpper(r) {
+		return true
 	}
+	return prev == '_' && r != '_'
 }
 
 func (e *Editor) indentation(screenY int) int {
-	p := e.screenBufferIndex[screenY+e.lineOffset][0]
-	for x, r := range e.rawBuffer[p.y] {
-		if whitespacePattern.MatchString(string([]rune{r})) {
-			return x
+	return e.IndentLevel(e.screenBufferIndex[screenY+e.lineOffset][0].y)
+}
+
+// IndentLevel returns the width of the leading whitespace of a raw line, with tabs expanded to TabWidth.
+// Blank lines have the indentation of the closest non-blank line above them, or 0 if there is none.
+func (e *Editor) IndentLevel(rawLine int) int {
+	for ; rawLine >= 0 && rawLine < len(e.rawBuffer); rawLine-- {
+		width := 0
+		for _, r := range plain(e.entities(), [][]rune{e.rawBuffer[rawLine]})[0] {
+			if r == '\t' {
+				width += e.tabWidth() - width%e.tabWidth()
+			} else if unicode.IsSpace(r) {
+				width++
+			} else {
+				return width
+			}
 		}
 	}
 	return 0
@@ -204,92 +836,635 @@ func (e *Editor) differentIndentness(screenPoint point) func(screenPoint point)
 	}
 }
 
-func (e *Editor) moveCursorUntil(dir direction, cont func(screenPoint point) bool) {
-	if cont != nil {
-		for e.moveCursor(dir) {
-			if cont(e.cursor) {
-				break
+func (e *Editor) lineLengthStyle() tcell.Style {
+	if e.LineLengthStyle == tcell.StyleDefault {
+		return tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorRed)
+	}
+	return e.LineLengthStyle
+}
+
+func (e *Editor) defaultStyle() tcell.Style {
+	if e.DefaultStyle == tcell.StyleDefault {
+		return tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorWhite)
+	}
+	return e.DefaultStyle
+}
+
+func (e *Editor) currentLineStyle() tcell.Style {
+	if e.CurrentLineStyle == tcell.StyleDefault {
+		return tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorLightGray)
+	}
+	return e.CurrentLineStyle
+}
+
+func (e *Editor) selectionStyle() tcell.Style {
+	if e.SelectionStyle == tcell.StyleDefault {
+		return tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
+	}
+	return e.SelectionStyle
+}
+
+func (e *Editor) searchHighlightStyle() tcell.Style {
+	if e.SearchHighlightStyle == tcell.StyleDefault {
+		return tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorYellow)
+	}
+	return e.SearchHighlightStyle
+}
+
+func (e *Editor) tabWidth() int {
+	if e.TabWidth < 1 {
+		return 4
+	}
+	return e.TabWidth
+}
+
+// lineColumn returns the raw line of the screen point, and the visible column within that line.
+func (e *Editor) lineColumn(screenPoint point) (int, int) {
+	row := screenPoint.y + e.lineOffset
+	line := e.screenBufferIndex[row][len(e.screenBufferIndex[row])-1].y
+	col := screenPoint.x
+	for prev := row - 1; prev >= 0 && e.screenBufferIndex[prev][len(e.screenBufferIndex[prev])-1].y == line; prev-- {
+		col += len(e.screenBuffer[prev])
+	}
+	return line, col
+}
+
+// continuation returns whether the screenBuffer position is a cell of a tab other than its first one.
+func (e *Editor) continuation(screenBufferPoint point) bool {
+	row := e.screenBufferIndex[screenBufferPoint.y]
+	return screenBufferPoint.x > 0 && screenBufferPoint.x < len(row) && row[screenBufferPoint.x] == row[screenBufferPoint.x-1]
+}
+
+// lineRunePoints returns the raw positions of the visible runes of a raw line.
+func (e *Editor) lineRunePoints(rawLine int) []point {
+	res := []point{}
+	for y, row := range e.screenBufferIndex {
+		for x, p := range row {
+			if p.y == rawLine && p.x >= 0 && !e.continuation(point{x: x, y: y}) {
+				res = append(res, p)
 			}
 		}
-	} else {
-		e.moveCursor(dir)
 	}
+	return res
 }
 
-func (e *Editor) addLineAt(screenPoint point) {
-	defer e.redraw()
-	p := e.screenBufferIndex[screenPoint.y+e.lineOffset][screenPoint.x]
-	if p.x < 0 {
-		e.rawBuffer = concatRuneLines(
-			e.rawBuffer[:p.y+1],
-			[][]rune{nil},
-			e.rawBuffer[p.y+1:],
-		)
-		return
+// lineRuneColumn returns the raw line of the screen point, and the number of visible runes before it
+// within that line.
+func (e *Editor) lineRuneColumn(screenPoint point) (int, int) {
+	raw := e.rawPoint(point{x: screenPoint.x, y: screenPoint.y + e.lineOffset})
+	col := 0
+	for _, p := range e.lineRunePoints(raw.y) {
+		if p.x < raw.x {
+			col++
+		}
 	}
-	e.rawBuffer = concatRuneLines(
-		e.rawBuffer[:p.y],
-		[][]rune{e.rawBuffer[p.y][:p.x]},
-		[][]rune{e.rawBuffer[p.y][p.x:]},
-		e.rawBuffer[p.y+1:],
-	)
+	return raw.y, col
 }
 
-func (e *Editor) deleteAt(screenPoint point) {
-	defer e.redraw()
-	p := e.screenBufferIndex[screenPoint.y+e.lineOffset][screenPoint.x]
-	if p.x < 0 {
-		if p.y+1 < len(e.rawBuffer) {
-			e.rawBuffer = concatRuneLines(
-				e.rawBuffer[:p.y],
-				[][]rune{concatRunes(e.rawBuffer[p.y], e.rawBuffer[p.y+1])},
-				e.rawBuffer[p.y+2:],
-			)
+// newLineIndentation returns the whitespace a line split at the cursor should start with.
+func (e *Editor) newLineIndentation() []rune {
+	if !e.AutoIndent {
+		return nil
+	}
+	line, col := e.lineRuneColumn(e.cursor)
+	res := []rune{}
+	plainLine := plain(e.entities(), [][]rune{e.rawBuffer[line]})[0]
+	for _, r := range plainLine {
+		if len(res) >= col || !unicode.IsSpace(r) {
+			break
 		}
-		return
+		res = append(res, r)
 	}
-	if e.rawBuffer[p.y][p.x] == '&' {
-		if len(e.rawBuffer[p.y])-p.x > 5 && string(e.rawBuffer[p.y][p.x:p.x+5]) == "&amp;" {
-			e.rawBuffer[p.y] = concatRunes(e.rawBuffer[p.y][:p.x], e.rawBuffer[p.y][p.x+5:])
-			return
-		} else if len(e.rawBuffer[p.y])-p.x > 4 && string(e.rawBuffer[p.y][p.x:p.x+4]) == "&gt;" {
-			e.rawBuffer[p.y] = concatRunes(e.rawBuffer[p.y][:p.x], e.rawBuffer[p.y][p.x+4:])
-			return
-		} else if len(e.rawBuffer[p.y])-p.x > 4 && string(e.rawBuffer[p.y][p.x:p.x+4]) == "&lt;" {
-			e.rawBuffer[p.y] = concatRunes(e.rawBuffer[p.y][:p.x], e.rawBuffer[p.y][p.x+4:])
-			return
+	if e.IndentRule == nil {
+		return res
+	}
+	delta := e.IndentRule(string(plainLine[:e.minInt(col, len(plainLine))]))
+	for ; delta > 0; delta-- {
+		if e.UseHardTabs {
+			res = append(res, '\t')
+		} else {
+			res = append(res, []rune(strings.Repeat(" ", e.tabWidth()))...)
+		}
+	}
+	for ; delta < 0 && len(res) > 0; delta++ {
+		// Removes a tab, or up to TabWidth spaces.
+		if res[len(res)-1] == '\t' {
+			res = res[:len(res)-1]
+			continue
+		}
+		for removed := 0; len(res) > 0 && res[len(res)-1] != '\t' && removed < e.tabWidth(); removed++ {
+			res = res[:len(res)-1]
 		}
 	}
-	e.rawBuffer[p.y] = concatRunes(e.rawBuffer[p.y][:p.x], e.rawBuffer[p.y][p.x+1:])
+	return res
 }
 
-func PlainText(s string) string {
-	return runesToString(plain(stringToRunes(s)))
+// OpenerIndentRule is an IndentRule indenting lines after lines ending with '{', '(' or ':' one level more.
+func OpenerIndentRule(prevLine string) int {
+	trimmed := strings.TrimRightFunc(prevLine, unicode.IsSpace)
+	if strings.HasSuffix(trimmed, "{") || strings.HasSuffix(trimmed, "(") || strings.HasSuffix(trimmed, ":") {
+		return 1
+	}
+	return 0
 }
 
-func plain(r [][]rune) [][]rune {
-	res := [][]rune{}
-	parseTokens(r, func(t *token) {
-		if t.start {
-			res = append(res, nil)
-		} else if t.rune != nil {
-			res[len(res)-1] = append(res[len(res)-1], *t.rune)
-		} else if t.newLine {
-			res = append(res, nil)
+// dedentLine removes up to one TabWidth of leading whitespace from a raw line, and returns the number of
+// removed runes.
+func (e *Editor) dedentLine(rawLine int) (removed []int) {
+	line := e.rawBuffer[rawLine]
+	kept := []rune{}
+	idx, width := 0, 0
+	for idx < len(line) && width < e.tabWidth() {
+		if markup := leadingMarkupPattern.FindString(string(line[idx:])); markup != "" {
+			kept = append(kept, []rune(markup)...)
+			idx += len([]rune(markup))
+			continue
 		}
-	})
-	return res
+		if line[idx] == '\t' {
+			if width > 0 {
+				break
+			}
+			width = e.tabWidth()
+		} else if line[idx] == ' ' {
+			width++
+		} else {
+			break
+		}
+		removed = append(removed, idx)
+		idx++
+	}
+	e.rawBuffer[rawLine] = concatRunes(kept, line[idx:])
+	return removed
 }
 
-type flatIndex struct {
-	raw     point
-	screen  point
-	flatRaw int
+// selectedLines returns the first and last raw lines of the selection, if there is one.
+func (e *Editor) selectedLines() (first, last int, found bool) {
+	rawSeg, found := e.selectionSegment()
+	if !found {
+		return 0, 0, false
+	}
+	first, last = rawSeg[0].y, rawSeg[1].y
+	// A selection ending before any visible rune of its last line doesn't touch it.
+	if last > first && leadingMarkupPattern.ReplaceAllString(string(e.rawBuffer[last][:rawSeg[1].x]), "") == "" {
+		last--
+	}
+	return first, last, true
 }
 
-func flattenWithIndex(rs [][]rune) (flatRaw, flatScreen []rune, rawIndex, screenIndex []flatIndex) {
-	screenPos := point{}
-	parseTokens(rs, func(t *token) {
+// duplicateLines inserts a copy of the line of the cursor, or of the lines the selection touches, above
+// them, which leaves the cursor and the selection on the lower copy.
+func (e *Editor) duplicateLines() {
+	cursor := e.rawCursor()
+	first, last, found := e.selectedLines()
+	if !found {
+		first, last = cursor.y, cursor.y
+	}
+	copies := [][]rune{}
+	for _, line := range e.rawBuffer[first : last+1] {
+		copies = append(copies, []rune(selectTokenPattern.ReplaceAllString(string(line), "")))
+	}
+	e.rawBuffer = concatRuneLines(e.rawBuffer[:first], copies, e.rawBuffer[first:])
+	e.redraw()
+	e.restoreCursor(point{x: cursor.x, y: cursor.y + len(copies)})
+}
+
+// selectionEnds returns the raw points of the selection tokens as they will be when the selection is cleared.
+func (e *Editor) selectionEnds(rawSeg segment) (from, to point) {
+	firstToken, lastToken := selectFromToken, selectToToken
+	if strings.HasPrefix(string(e.rawBuffer[rawSeg[0].y][rawSeg[0].x:]), selectToToken) {
+		firstToken, lastToken = selectToToken, selectFromToken
+	}
+	start, end := rawSeg[0], rawSeg[1]
+	end.x -= len(lastToken)
+	if end.y == start.y {
+		end.x -= len(firstToken)
+	}
+	if firstToken == selectToToken {
+		return end, start
+	}
+	return start, end
+}
+
+// moveLines moves the line of the cursor, or the lines the selection touches, past the line above or below
+// them, keeping the cursor and the selection on the moved text. It returns false if there is no such line.
+func (e *Editor) moveLines(d direction) bool {
+	cursor := e.rawCursor()
+	rawSeg, selected := e.selectionSegment()
+	first, last, _ := e.selectedLines()
+	if !selected {
+		first, last = cursor.y, cursor.y
+	}
+	if (d == up && first == 0) || (d == down && last+1 >= len(e.rawBuffer)) {
+		return false
+	}
+	delta := 1
+	if d == up {
+		delta = -1
+	}
+	movePoint := func(p point) point {
+		if p.y >= first && p.y <= last {
+			p.y += delta
+		} else if p.y == last+1 {
+			// A selection ending before the runes of the line after the moved lines keeps doing so.
+			p = point{x: 0, y: last + 1 + delta}
+			if p.y == len(e.rawBuffer) {
+				p = point{x: len(e.rawBuffer[last]), y: last + 1}
+			}
+		}
+		return p
+	}
+	var from, to point
+	if selected {
+		// The selection may end on a line that doesn't move, so its tokens are put back after moving.
+		from, to = e.selectionEnds(rawSeg)
+		e.clearSelection()
+		from, to = movePoint(from), movePoint(to)
+	}
+	cursor = movePoint(cursor)
+	lines := e.rawBuffer
+	if d == up {
+		e.rawBuffer = concatRuneLines(lines[:first-1], lines[first:last+1], lines[first-1:first], lines[last+1:])
+	} else {
+		e.rawBuffer = concatRuneLines(lines[:first], lines[last+1:last+2], lines[first:last+1], lines[last+2:])
+	}
+	e.redraw()
+	if selected {
+		e.selectRaw(from, to)
+		e.redraw()
+	} else {
+		e.restoreCursor(cursor)
+	}
+	return true
+}
+
+// toggleComment removes CommentPrefix from the text of the line of the cursor, or the lines the selection
+// touches, if all of them start with it, and otherwise adds it before the text of each of them. Blank lines
+// are left alone.
+func (e *Editor) toggleComment() {
+	if e.CommentPrefix == "" {
+		return
+	}
+	cursor := e.rawCursor()
+	first, last, found := e.selectedLines()
+	if !found {
+		first, last = cursor.y, cursor.y
+	}
+	prefix := e.escape(e.CommentPrefix)
+	// Lines commented without the trailing space of the prefix, like an empty "//", are commented too.
+	trimmedPrefix := e.escape(strings.TrimRightFunc(e.CommentPrefix, unicode.IsSpace))
+	// The raw column of the text, after leading markup and whitespace, of each non-blank line.
+	starts := map[int]int{}
+	commented := true
+	for y := first; y <= last; y++ {
+		line := e.rawBuffer[y]
+		start := len([]rune(leadingIndentPattern.FindString(string(line))))
+		if start == len(line) {
+			continue
+		}
+		starts[y] = start
+		commented = commented && strings.HasPrefix(string(line[start:]), trimmedPrefix)
+	}
+	if len(starts) == 0 {
+		return
+	}
+	for y, start := range starts {
+		line := e.rawBuffer[y]
+		delta := len([]rune(prefix))
+		if !commented {
+			e.rawBuffer[y] = concatRunes(line[:start], []rune(prefix), line[start:])
+		} else {
+			if !strings.HasPrefix(string(line[start:]), prefix) {
+				delta = len([]rune(trimmedPrefix))
+			}
+			e.rawBuffer[y] = concatRunes(line[:start], line[start+delta:])
+			delta = -delta
+		}
+		if y == cursor.y && cursor.x >= start {
+			cursor.x = e.maxInt(start, cursor.x+delta)
+		}
+	}
+	e.redraw()
+	e.restoreCursor(cursor)
+}
+
+// joinLines joins the line of the cursor with the next one, or the lines the selection touches, replacing the
+// leading whitespace of each joined line with a space. Without a selection the cursor goes where they were joined.
+func (e *Editor) joinLines() {
+	cursor := e.rawCursor()
+	first, last, found := e.selectedLines()
+	if !found || first == last {
+		first, last = cursor.y, cursor.y+1
+	}
+	if last >= len(e.rawBuffer) {
+		return
+	}
+	joined := e.rawBuffer[first]
+	for y := first + 1; y <= last; y++ {
+		line := e.rawBuffer[y]
+		// The leading markup is kept, and the leading whitespace dropped.
+		indent := []rune(leadingIndentPattern.FindString(string(line)))
+		markup := []rune(strings.Join(markupPattern.FindAllString(string(indent), -1), ""))
+		if !found && y == last {
+			cursor = point{x: len(joined), y: first}
+		}
+		visible := plain(e.entities(), [][]rune{joined})[0]
+		if !e.JoinWithoutSpace && len(line) > len(indent) && len(visible) > 0 && !unicode.IsSpace(visible[len(visible)-1]) {
+			joined = concatRunes(joined, []rune{' '})
+		}
+		if found && y == cursor.y {
+			cursor = point{x: len(joined) + len(markup) + e.maxInt(0, cursor.x-len(indent)), y: first}
+		}
+		joined = concatRunes(joined, markup, line[len(indent):])
+	}
+	if cursor.y > last {
+		cursor.y -= last - first
+	}
+	e.rawBuffer = concatRuneLines(e.rawBuffer[:first], [][]rune{joined}, e.rawBuffer[last+1:])
+	e.redraw()
+	e.restoreCursor(cursor)
+}
+
+// deleteWordForward removes the runes from the cursor up to the next change to or from WordBoundary or the end
+// of the line.
+func (e *Editor) deleteWordForward() {
+	atLineEnd := func() bool {
+		return e.screenBufferIndex[e.cursor.y+e.lineOffset][e.cursor.x].x < 0
+	}
+	if atLineEnd() {
+		e.bell(BellBoundary)
+		return
+	}
+	whitespaceness := e.wordBoundaryAt(e.cursor)
+	for !atLineEnd() && whitespaceness == e.wordBoundaryAt(e.cursor) {
+		e.deleteAt(e.cursor)
+	}
+}
+
+// moveLinesKey moves lines for Alt-Up and Alt-Down, which edit without being editingKeys.
+func (e *Editor) moveLinesKey(d direction) {
+	if e.ReadOnly {
+		e.bell(BellReadOnly)
+	} else if !e.moveLines(d) {
+		e.bell(BellBoundary)
+	}
+}
+
+// indentSelection indents the lines of a selection spanning several lines by one TabWidth, and returns
+// false if there is no such selection.
+func (e *Editor) indentSelection() bool {
+	first, last, found := e.selectedLines()
+	if !found || first == last {
+		return false
+	}
+	indent := []rune(strings.Repeat(" ", e.tabWidth()))
+	if e.UseHardTabs {
+		indent = []rune{'\t'}
+	}
+	cursor := e.rawCursor()
+	for line := first; line <= last; line++ {
+		e.insertRaw(point{x: 0, y: line}, indent)
+		if line == cursor.y {
+			cursor.x += len(indent)
+		}
+	}
+	e.redraw()
+	e.setRawCursor(cursor)
+	return true
+}
+
+// dedent dedents the lines of the selection, or the line of the cursor, by up to one TabWidth.
+func (e *Editor) dedent() {
+	cursor := e.rawCursor()
+	first, last, found := e.selectedLines()
+	if !found {
+		first, last = cursor.y, cursor.y
+	}
+	for line := first; line <= last; line++ {
+		removed := e.dedentLine(line)
+		if line == cursor.y {
+			for idx := len(removed) - 1; idx >= 0; idx-- {
+				if removed[idx] < cursor.x {
+					cursor.x--
+				}
+			}
+		}
+	}
+	e.redraw()
+	e.setRawCursor(cursor)
+}
+
+func (e *Editor) dedentBeforeCloser() {
+	line, col := e.lineRuneColumn(e.cursor)
+	if col == 0 {
+		return
+	}
+	for _, r := range plain(e.entities(), [][]rune{e.rawBuffer[line]})[0][:col] {
+		if !unicode.IsSpace(r) {
+			return
+		}
+	}
+	cursor := e.rawCursor()
+	if removed := e.dedentLine(line); len(removed) > 0 {
+		e.redraw()
+		e.setRawCursor(point{x: e.maxInt(0, cursor.x-len(removed)), y: cursor.y})
+	}
+}
+
+// backspaceWidth returns the number of runes Backspace should remove when nothing is selected.
+func (e *Editor) backspaceWidth() int {
+	if !e.SoftTabBackspace {
+		return 1
+	}
+	line, col := e.lineRuneColumn(e.cursor)
+	plainLine := plain(e.entities(), [][]rune{e.rawBuffer[line]})[0]
+	if col == 0 || col > len(plainLine) {
+		return 1
+	}
+	for _, r := range plainLine[:col] {
+		if r != ' ' {
+			return 1
+		}
+	}
+	if rem := col % e.tabWidth(); rem != 0 {
+		return rem
+	}
+	return e.tabWidth()
+}
+
+// screenBufferPoint returns the screenBuffer position of the first visible rune at or after the raw point,
+// or of the newline position of the raw line if there are no visible runes after it.
+func (e *Editor) screenBufferPoint(raw point) point {
+	for y, line := range e.screenBufferIndex {
+		for x, p := range line {
+			if p.y != raw.y {
+				continue
+			}
+			if p.x >= raw.x {
+				return point{x: x, y: y}
+			}
+			if p.x < 0 && (y+1 == len(e.screenBufferIndex) || e.screenBufferIndex[y+1][0].y != raw.y) {
+				return point{x: x, y: y}
+			}
+		}
+	}
+	return point{}
+}
+
+// setScrolledCursor moves the cursor to a screenBuffer position, scrolling to make it visible.
+func (e *Editor) setScrolledCursor(p point) {
+	_, height := e.textView().Size()
+	if p.y < e.lineOffset {
+		e.lineOffset = p.y
+	} else if p.y >= e.lineOffset+height {
+		e.lineOffset = p.y - height + 1
+	}
+	e.redraw()
+	e.cursor = point{x: p.x, y: p.y - e.lineOffset}
+	e.setCursor()
+}
+
+// rawCursor returns the raw position of the cursor, with the newline position as the length of the line,
+// or the start of the buffer before the screen has a size.
+func (e *Editor) rawCursor() point {
+	if !e.indexed() {
+		if e.unsizedCursor != nil {
+			return *e.unsizedCursor
+		}
+		return point{}
+	}
+	return e.rawPoint(*e.scrolledCursor())
+}
+
+// CursorPosition returns the raw line and column of the cursor, which are stable regardless of wrapping.
+func (e *Editor) CursorPosition() (line, col int) {
+	p := e.rawCursor()
+	return p.y, p.x
+}
+
+// SetCursorPosition moves the cursor to a raw line and column, clamped to the content and moved out of any
+// markup, and scrolls to make it visible.
+func (e *Editor) SetCursorPosition(line, col int) {
+	e.change(func() {
+		e.setRawCursor(e.contentPoint(Position{Line: line, Col: col}))
+	})
+}
+
+// rawPoint returns the raw position of a screenBuffer position, with the newline position as the length of the line.
+func (e *Editor) rawPoint(screenBufferPoint point) point {
+	p := e.screenBufferIndex[screenBufferPoint.y][screenBufferPoint.x]
+	if p.x < 0 {
+		p.x = len(e.rawBuffer[p.y])
+	}
+	return p
+}
+
+// setRawCursor moves the cursor to the raw position, scrolling to make it visible.
+func (e *Editor) setRawCursor(raw point) {
+	e.setScrolledCursor(e.screenBufferPoint(raw))
+}
+
+// restoreCursor moves the cursor to a raw position stored before the buffer changed, clamped to the buffer
+// and scrolled into view.
+func (e *Editor) restoreCursor(raw point) {
+	e.limitInt(&raw.y, 0, len(e.rawBuffer))
+	e.limitInt(&raw.x, 0, len(e.rawBuffer[raw.y])+1)
+	e.setRawCursor(raw)
+}
+
+// scrolledCursor returns the cursor position in screenBuffer coordinates.
+func (e *Editor) scrolledCursor() *point {
+	return &point{x: e.cursor.x, y: e.cursor.y + e.lineOffset}
+}
+
+func (e *Editor) moveCursorUntil(dir direction, cont func(screenPoint point) bool) bool {
+	if cont != nil {
+		moved := false
+		for e.moveCursor(dir) {
+			moved = true
+			if cont(e.cursor) {
+				break
+			}
+		}
+		return moved
+	}
+	return e.moveCursor(dir)
+}
+
+func (e *Editor) addLineAt(screenPoint point) {
+	defer e.redraw()
+	p := e.screenBufferIndex[screenPoint.y+e.lineOffset][screenPoint.x]
+	if p.x < 0 {
+		e.rawBuffer = concatRuneLines(
+			e.rawBuffer[:p.y+1],
+			[][]rune{nil},
+			e.rawBuffer[p.y+1:],
+		)
+		return
+	}
+	e.rawBuffer = concatRuneLines(
+		e.rawBuffer[:p.y],
+		[][]rune{e.rawBuffer[p.y][:p.x]},
+		[][]rune{e.rawBuffer[p.y][p.x:]},
+		e.rawBuffer[p.y+1:],
+	)
+}
+
+func (e *Editor) deleteAt(screenPoint point) {
+	defer e.redraw()
+	p := e.screenBufferIndex[screenPoint.y+e.lineOffset][screenPoint.x]
+	if p.x < 0 {
+		if p.y+1 < len(e.rawBuffer) {
+			e.rawBuffer = concatRuneLines(
+				e.rawBuffer[:p.y],
+				[][]rune{concatRunes(e.rawBuffer[p.y], e.rawBuffer[p.y+1])},
+				e.rawBuffer[p.y+2:],
+			)
+		}
+		return
+	}
+	width := 1
+	if e.rawBuffer[p.y][p.x] == '&' {
+		for end := p.x + 1; end < len(e.rawBuffer[p.y]) && isEntityRune(e.rawBuffer[p.y][end]); end++ {
+			if e.rawBuffer[p.y][end] == ';' {
+				if _, ok := decodeEntity(e.entities(), string(e.rawBuffer[p.y][p.x:end+1])); ok {
+					width = end + 1 - p.x
+				}
+				break
+			}
+		}
+	}
+	e.rawBuffer[p.y] = concatRunes(e.rawBuffer[p.y][:p.x], e.rawBuffer[p.y][p.x+width:])
+}
+
+func PlainText(s string) string {
+	return runesToString(plain(DefaultEntities, stringToRunes(s)))
+}
+
+func plain(entities []Entity, r [][]rune) [][]rune {
+	res := [][]rune{}
+	parseTokens(entities, r, func(t *token) {
+		if t.start {
+			res = append(res, nil)
+		} else if t.rune != nil {
+			res[len(res)-1] = append(res[len(res)-1], *t.rune)
+		} else if t.newLine {
+			res = append(res, nil)
+		}
+	})
+	return res
+}
+
+type flatIndex struct {
+	raw     point
+	screen  point
+	flatRaw int
+	// Whether the rune is part of markup, rather than of the token of a visible rune.
+	markup bool
+}
+
+func flattenWithIndex(entities []Entity, rs [][]rune) (flatRaw, flatScreen []rune, rawIndex, screenIndex []flatIndex) {
+	screenPos := point{}
+	parseTokens(entities, rs, func(t *token) {
 		if t.rune != nil {
 			rawPos := t.pos
 			offset := 0
@@ -320,7 +1495,7 @@ func flattenWithIndex(rs [][]rune) (flatRaw, flatScreen []rune, rawIndex, screen
 			pos := t.pos
 			offset := 0
 			for _ = range t.buffer {
-				rawIndex = append(rawIndex, flatIndex{raw: pos, screen: screenPos, flatRaw: len(flatRaw) + offset})
+				rawIndex = append(rawIndex, flatIndex{raw: pos, screen: screenPos, flatRaw: len(flatRaw) + offset, markup: true})
 				pos.x++
 				offset++
 			}
@@ -333,7 +1508,7 @@ func flattenWithIndex(rs [][]rune) (flatRaw, flatScreen []rune, rawIndex, screen
 
 func (e *Editor) replace(raw bool, p *regexp.Regexp, repl string, query func(match string, rawSeg, screenSeg segment) bool) {
 	changedAnything := false
-	e.rawBuffer = replace(e.rawBuffer, raw, p, repl, func(match string, rawSeg, screenSeg segment) bool {
+	e.rawBuffer = replace(e.entities(), e.rawBuffer, raw, p, repl, func(match string, rawSeg, screenSeg segment) bool {
 		res := query(match, rawSeg, screenSeg)
 		if res {
 			changedAnything = true
@@ -345,11 +1520,62 @@ func (e *Editor) replace(raw bool, p *regexp.Regexp, repl string, query func(mat
 	}
 }
 
-func replace(rs [][]rune, raw bool, p *regexp.Regexp, repl string, query func(match string, rawSeg, screenSeg segment) bool) [][]rune {
-	flatRaw, flatScreen, rawIndex, screenIndex := flattenWithIndex(rs)
+// StripMarkup removes all color tags, keeping the text and any selection, as a single undoable operation.
+// It returns the raw spans of the removed tags, in the content as it was before.
+func (e *Editor) StripMarkup() (removed []Span) {
+	e.change(func() {
+		e.replace(true, colorTagPattern, "", func(_ string, rawSeg, _ segment) bool {
+			removed = append(removed, rawSeg.span())
+			return true
+		})
+	})
+	return removed
+}
+
+// ReplaceAll replaces the matches of p in the visible text with repl, expanded as by regexp.Regexp.Expand,
+// as a single undoable operation. Markup is kept, so matches never mangle colors or the selection.
+// repl is markup, so plain text in it must be escaped, while the submatches it expands are escaped for it.
+// It returns the number of replaced matches.
+func (e *Editor) ReplaceAll(p *regexp.Regexp, repl string) int {
+	replaced := 0
+	e.change(func() {
+		e.block = nil
+		e.replaceMovingCursor(false, p, repl, func(string, segment, segment) bool {
+			replaced++
+			return true
+		})
+	})
+	return replaced
+}
+
+// TrimTrailingWhitespace removes the spaces and tabs ending each line, as a single undoable operation, keeping
+// the cursor on the same text. Lines ending with markup are left alone.
+func (e *Editor) TrimTrailingWhitespace() {
+	if !trailingWhitespacePattern.MatchString(runesToString(e.rawBuffer)) {
+		return
+	}
+	e.change(func() {
+		e.replaceMovingCursor(true, trailingWhitespacePattern, "", func(string, segment, segment) bool {
+			return true
+		})
+	})
+}
+
+// replaceMovingCursor replaces like replace does, and moves the cursor along with the text around it.
+func (e *Editor) replaceMovingCursor(raw bool, p *regexp.Regexp, repl string, query func(match string, rawSeg, screenSeg segment) bool) {
+	prevContent := runesToString(e.rawBuffer)
+	cursor := e.rawCursor().position()
+	e.replace(raw, p, repl, query)
+	if content := runesToString(e.rawBuffer); content != prevContent {
+		cursor = MapPosition(prevContent, content, cursor)
+		e.restoreCursor(point{x: cursor.Col, y: cursor.Line})
+	}
+}
 
-	resRunes := make([]rune, len(flatRaw))
-	copy(resRunes, flatRaw)
+// replace replaces the matches of p in either the raw or the visible text of rs, for which query returns true.
+// Replacing visible text keeps any markup inside the matches, after the replacement.
+func replace(entities []Entity, rs [][]rune, raw bool, p *regexp.Regexp, repl string, query func(match string, rawSeg, screenSeg segment) bool) [][]rune {
+	flatRaw, flatScreen, rawIndex, screenIndex := flattenWithIndex(entities, rs)
 
 	haystack := flatScreen
 	haystackIndex := screenIndex
@@ -357,30 +1583,63 @@ func replace(rs [][]rune, raw bool, p *regexp.Regexp, repl string, query func(ma
 		haystack = flatRaw
 		haystackIndex = rawIndex
 	}
+	searchString := string(haystack)
+	// Index in haystack of the rune at each byte offset of searchString.
+	runeIndex := make([]int, len(searchString)+1)
+	runeIndex[len(searchString)] = len(haystack)
+	runeCount := 0
+	for byteIdx := range searchString {
+		runeIndex[byteIdx] = runeCount
+		runeCount++
+	}
 
-	haystackOffset := 0
-	for {
-		remainingHaystack := haystack[haystackOffset:]
-		remainingHaystackIndex := haystackIndex[haystackOffset:]
-
-		searchString := string(remainingHaystack)
-		matchIndex := p.FindStringIndex(searchString)
-		if matchIndex == nil {
-			return stringToRunes(string(resRunes))
+	resRunes := []rune{}
+	copied := 0
+	for _, matchIndex := range p.FindAllStringSubmatchIndex(searchString, -1) {
+		startIndex := haystackIndex[runeIndex[matchIndex[0]]]
+		endIndex := haystackIndex[runeIndex[matchIndex[1]]]
+		if !query(searchString[matchIndex[0]:matchIndex[1]], segment{startIndex.raw, endIndex.raw}, segment{startIndex.screen, endIndex.screen}) {
+			continue
 		}
-
-		startIndex := remainingHaystackIndex[len([]rune(searchString[:matchIndex[0]]))]
-		endIndex := remainingHaystackIndex[len([]rune(searchString[:matchIndex[1]]))]
-
-		if query(searchString[matchIndex[0]:matchIndex[1]], segment{startIndex.raw, endIndex.raw}, segment{startIndex.screen, endIndex.screen}) {
-			replacement := p.ReplaceAllString(searchString[matchIndex[0]:matchIndex[1]], repl)
-			resRunes = concatRunes(resRunes[:startIndex.flatRaw], []rune(replacement), []rune(searchString[matchIndex[1]:]))
+		endFlatRaw := endIndex.flatRaw
+		if !raw {
+			// Markup between the last matched rune and the next one isn't part of the match.
+			for endFlatRaw > startIndex.flatRaw && rawIndex[endFlatRaw-1].markup {
+				endFlatRaw--
+			}
+		}
+		expanded := string(p.ExpandString(nil, repl, searchString, matchIndex))
+		if !raw {
+			expanded = expandEscaped(entities, p, repl, searchString, matchIndex)
+		}
+		resRunes = concatRunes(resRunes, flatRaw[copied:startIndex.flatRaw], []rune(expanded))
+		if !raw {
+			for idx := startIndex.flatRaw; idx < endFlatRaw; idx++ {
+				if rawIndex[idx].markup {
+					resRunes = append(resRunes, flatRaw[idx])
+				}
+			}
 		}
-		haystackOffset += len([]rune(searchString[:matchIndex[1]]))
-		if haystackOffset > len(haystack)-1 {
-			return stringToRunes(string(resRunes))
+		copied = endFlatRaw
+	}
+	return stringToRunes(string(concatRunes(resRunes, flatRaw[copied:])))
+}
+
+// expandEscaped expands repl like regexp.Regexp.ExpandString, but with the submatches of the visible text
+// escaped, since repl is markup.
+func expandEscaped(entities []Entity, p *regexp.Regexp, repl string, src string, match []int) string {
+	escaped := &bytes.Buffer{}
+	escapedMatch := make([]int, len(match))
+	for idx := 0; idx+1 < len(match); idx += 2 {
+		if match[idx] < 0 {
+			escapedMatch[idx], escapedMatch[idx+1] = -1, -1
+			continue
 		}
+		escapedMatch[idx] = escaped.Len()
+		escaped.WriteString(escapeEntities(entities, src[match[idx]:match[idx+1]]))
+		escapedMatch[idx+1] = escaped.Len()
 	}
+	return string(p.ExpandString(nil, repl, escaped.String(), escapedMatch))
 }
 
 func concatRuneLines(rs ...[][]rune) [][]rune {
@@ -413,44 +1672,1134 @@ func (e *Editor) writeAt(runes []rune, screenPoint point) {
 	)
 }
 
-func (e *Editor) debuglog() {
-	for _, l := range e.rawBuffer {
-		log.Printf("%q", string(l))
+func (e *Editor) insertRaw(p point, runes []rune) {
+	e.rawBuffer[p.y] = concatRunes(e.rawBuffer[p.y][:p.x], runes, e.rawBuffer[p.y][p.x:])
+}
+
+// contentPoint returns the raw position, clamped to the content and moved out of any markup.
+func (e *Editor) contentPoint(raw Position) point {
+	if raw.Line < 0 {
+		return point{}
+	} else if raw.Line >= len(e.rawBuffer) {
+		raw = Position{Line: len(e.rawBuffer) - 1, Col: len(e.rawBuffer[len(e.rawBuffer)-1])}
 	}
+	e.limitInt(&raw.Col, 0, len(e.rawBuffer[raw.Line])+1)
+	return e.rawPoint(e.screenBufferPoint(point{x: raw.Col, y: raw.Line}))
 }
 
-func (e *Editor) copySelection() {
-	e.replace(true, selectionPattern, "", func(s string, rawSeg, screenSeg segment) bool {
-		if match := selectionPattern.FindStringSubmatch(s); match != nil {
-			e.pasteBuffer = plain(stringToRunes(match[2]))
-		}
-		return false
-	})
+// spliceRaw replaces the raw runes from up to to with lines, and returns the raw position after them.
+func (e *Editor) spliceRaw(from, to point, lines [][]rune) point {
+	last := len(lines) - 1
+	end := point{x: len(lines[last]), y: from.y + last}
+	if last == 0 {
+		end.x += from.x
+	}
+	spliced := make([][]rune, len(lines))
+	copy(spliced, lines)
+	spliced[0] = concatRunes(e.rawBuffer[from.y][:from.x], spliced[0])
+	spliced[last] = concatRunes(spliced[last], e.rawBuffer[to.y][to.x:])
+	e.rawBuffer = concatRuneLines(e.rawBuffer[:from.y], spliced, e.rawBuffer[to.y+1:])
+	return end
 }
 
-func runesToString(rs [][]rune) string {
-	res := &bytes.Buffer{}
-	for idx, line := range rs {
-		fmt.Fprintf(res, "%v", string(line))
-		if idx+1 < len(rs) {
-			fmt.Fprintln(res)
+// InsertAt inserts text at a raw position, clamped to the content and moved out of any markup, as a single
+// undoable operation. The cursor stays on the same rune, so it only moves if the text is inserted at or
+// before it.
+func (e *Editor) InsertAt(rawLine, rawCol int, text string) {
+	e.change(func() {
+		p := e.contentPoint(Position{Line: rawLine, Col: rawCol})
+		cursor := e.rawCursor()
+		end := e.spliceRaw(p, p, stringToRunes(e.escape(text)))
+		e.redraw()
+		if cursor.y == p.y && cursor.x >= p.x {
+			cursor = point{x: end.x + cursor.x - p.x, y: end.y}
+		} else if cursor.y > p.y {
+			cursor.y += end.y - p.y
 		}
-	}
-	return res.String()
+		e.restoreCursor(cursor)
+	})
 }
 
-func (e *Editor) removeSelection(cpy bool) (removedScreenSeg segment, removedRunes []rune) {
-	e.replace(true, selectionPattern, "", func(s string, rawSeg, screenSeg segment) bool {
-		if cpy {
-			if match := selectionPattern.FindStringSubmatch(s); match != nil {
-				e.pasteBuffer = plain(stringToRunes(match[2]))
-			}
+// ReplaceRange replaces the content between two raw positions, clamped to the content and moved out of
+// any markup, with text as a single undoable operation, and puts the cursor after the text.
+// Selection tokens in the range are kept, after the text.
+func (e *Editor) ReplaceRange(from, to Position, text string) {
+	e.change(func() {
+		start, end := e.contentPoint(from), e.contentPoint(to)
+		if end.y < start.y || (end.y == start.y && end.x < start.x) {
+			start, end = end, start
 		}
-		removedScreenSeg = screenSeg
-		removedRunes = []rune(runesToString(plain(stringToRunes(s))))
-		return true
+		selectionTokens := []rune{}
+		for _, match := range selectTokenPattern.FindAllString(runesToString(e.rangeRunes(start, end)), -1) {
+			selectionTokens = append(selectionTokens, []rune(match)...)
+		}
+		lines := stringToRunes(e.escape(text))
+		lines[len(lines)-1] = concatRunes(lines[len(lines)-1], selectionTokens)
+		cursor := e.spliceRaw(start, end, lines)
+		cursor.x -= len(selectionTokens)
+		e.redraw()
+		e.restoreCursor(cursor)
 	})
-	return
+}
+
+// ApplyEdits applies edits to non-overlapping spans of the content as a single undoable operation, and
+// puts the cursor after the text of the first one. If any spans overlap, it changes nothing and returns
+// an error.
+func (e *Editor) ApplyEdits(edits []Edit) error {
+	sorted := make([]Edit, len(edits))
+	for idx, edit := range edits {
+		if edit.Span.To.before(edit.Span.From) {
+			edit.Span.From, edit.Span.To = edit.Span.To, edit.Span.From
+		}
+		sorted[idx] = edit
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Span.From.before(sorted[j].Span.From)
+	})
+	for idx := 1; idx < len(sorted); idx++ {
+		if sorted[idx].Span.From.before(sorted[idx-1].Span.To) {
+			return fmt.Errorf("edit of %+v overlaps edit of %+v", sorted[idx].Span, sorted[idx-1].Span)
+		}
+	}
+	// Editing from the bottom up keeps the spans above valid.
+	e.change(func() {
+		for idx := len(sorted) - 1; idx >= 0; idx-- {
+			e.ReplaceRange(sorted[idx].Span.From, sorted[idx].Span.To, sorted[idx].Text)
+		}
+	})
+	return nil
+}
+
+// Format replaces the content, without the selection, with what the Formatter returns for it as a single
+// undoable operation, and keeps the cursor near the same text. Formatted content that isn't valid markup is
+// returned as an error instead.
+func (e *Editor) Format() (err error) {
+	e.change(func() {
+		err = e.format()
+	})
+	return err
+}
+
+func (e *Editor) format() error {
+	if e.Formatter == nil {
+		return nil
+	}
+	content := selectTokenPattern.ReplaceAllString(runesToString(e.rawBuffer), "")
+	formatted, err := e.Formatter(content)
+	if err != nil {
+		return err
+	}
+	if formatted == content {
+		return nil
+	}
+	var invalid error
+	parseTokens(e.entities(), stringToRunes(formatted), func(t *token) {
+		if invalid == nil && t.err != nil {
+			invalid = fmt.Errorf("formatter returned invalid markup: %v", t.err)
+		}
+	})
+	if invalid != nil {
+		return invalid
+	}
+	e.clearSelection()
+	e.block = nil
+	cursor := MapPosition(content, formatted, e.rawCursor().position())
+	e.rawBuffer = stringToRunes(formatted)
+	e.redraw()
+	e.restoreCursor(point{x: cursor.Col, y: cursor.Line})
+	return nil
+}
+
+// MapPosition returns the position in newContent of the text at a position in oldContent, by diffing them.
+// Positions in removed text map to where it was removed.
+func MapPosition(oldContent, newContent string, p Position) Position {
+	lines := strings.Split(oldContent, "\n")
+	if p.Line < 0 {
+		p = Position{}
+	} else if p.Line >= len(lines) {
+		p = Position{Line: len(lines) - 1, Col: len([]rune(lines[len(lines)-1]))}
+	}
+	offset := 0
+	for _, line := range lines[:p.Line] {
+		offset += len(line) + 1
+	}
+	line := []rune(lines[p.Line])
+	if p.Col < 0 {
+		p.Col = 0
+	} else if p.Col > len(line) {
+		p.Col = len(line)
+	}
+	offset += len(string(line[:p.Col]))
+
+	differ := diffmatchpatch.New()
+	offset = differ.DiffXIndex(differ.DiffMain(oldContent, newContent, false), offset)
+	if offset > len(newContent) {
+		offset = len(newContent)
+	}
+	before := newContent[:offset]
+	return Position{
+		Line: strings.Count(before, "\n"),
+		Col:  len([]rune(before[strings.LastIndex(before, "\n")+1:])),
+	}
+}
+
+// rangeRunes returns the raw runes from up to to.
+func (e *Editor) rangeRunes(from, to point) [][]rune {
+	if from.y == to.y {
+		return [][]rune{e.rawBuffer[from.y][from.x:to.x]}
+	}
+	return concatRuneLines([][]rune{e.rawBuffer[from.y][from.x:]}, e.rawBuffer[from.y+1:to.y], [][]rune{e.rawBuffer[to.y][:to.x]})
+}
+
+func (e *Editor) debuglog() {
+	for _, l := range e.rawBuffer {
+		log.Printf("%q", string(l))
+	}
+}
+
+func (e *Editor) clearSelection() {
+	e.selecting = false
+	e.replace(true, selectToPattern, "", func(string, segment, segment) bool {
+		return true
+	})
+	e.replace(true, selectFromPattern, "", func(string, segment, segment) bool {
+		return true
+	})
+}
+
+// selectFrom selects from a screenBuffer position to the cursor, replacing any selection.
+func (e *Editor) selectFrom(from point) {
+	e.selecting = true
+	e.replace(true, selectToPattern, "", func(string, segment, segment) bool {
+		return true
+	})
+	e.replace(true, selectFromPattern, "", func(string, segment, segment) bool {
+		return true
+	})
+	ps := points{point{x: from.x, y: from.y - e.lineOffset}, e.cursor}
+	sort.Sort(ps)
+	for _, idx := range []int{1, 0} {
+		p := ps[idx]
+		if p == e.cursor {
+			e.writeAt([]rune(selectToToken), p)
+		} else {
+			e.writeAt([]rune(selectFromToken), p)
+		}
+	}
+}
+
+// selectionSegment returns the raw segment covering the selection tokens and everything between them.
+func (e *Editor) selectionSegment() (rawSeg segment, found bool) {
+	e.replace(true, selectionPattern, "", func(s string, seg, screenSeg segment) bool {
+		rawSeg = seg
+		found = true
+		return false
+	})
+	return
+}
+
+// collapseSelection removes the selection and puts the cursor at the start of it, for up and left,
+// or at the end of it, for down and right.
+func (e *Editor) collapseSelection(d direction) bool {
+	rawSeg, found := e.selectionSegment()
+	if !found {
+		return false
+	}
+	start, end := e.screenBufferPoint(rawSeg[0]), e.screenBufferPoint(rawSeg[1])
+	e.clearSelection()
+	if d == up || d == left {
+		e.setScrolledCursor(start)
+	} else {
+		e.setScrolledCursor(end)
+	}
+	return true
+}
+
+func (e *Editor) selectionPairs() map[rune]rune {
+	if e.SelectionPairs == nil {
+		return DefaultSelectionPairs
+	}
+	return e.SelectionPairs
+}
+
+func (e *Editor) entities() []Entity {
+	if e.Entities == nil {
+		return DefaultEntities
+	}
+	return e.Entities
+}
+
+// escape replaces the runes of the Entities in s with their entities.
+func (e *Editor) escape(s string) string {
+	return escapeEntities(e.entities(), s)
+}
+
+// deleteSelection removes the selection and the selected text, and puts the cursor where the selection started.
+func (e *Editor) deleteSelection() bool {
+	rawSeg, found := e.selectionSegment()
+	if !found {
+		return false
+	}
+	start := e.screenBufferPoint(rawSeg[0])
+	e.removeSelection(false)
+	e.selecting = false
+	e.setScrolledCursor(start)
+	return true
+}
+
+// wrapSelection puts opener before and closer after the selection, keeping the selection and the cursor
+// on the same text.
+func (e *Editor) wrapSelection(opener, closer rune) bool {
+	rawSeg, found := e.selectionSegment()
+	if !found {
+		return false
+	}
+	e.insertRaw(rawSeg[1], []rune(e.escape(string([]rune{closer}))))
+	e.insertRaw(rawSeg[0], []rune(e.escape(string([]rune{opener}))))
+	e.redraw()
+	e.replace(true, selectToPattern, "", func(s string, rawSeg, screenSeg segment) bool {
+		e.setScrolledCursor(e.screenBufferPoint(rawSeg[0]))
+		return false
+	})
+	return true
+}
+
+// typeOverCloser moves the cursor past the rune after it, if there is no selection and both are the same closer
+// of AutoClosePairs, and returns whether it did.
+func (e *Editor) typeOverCloser(r rune) bool {
+	if _, found := e.selectionSegment(); found {
+		return false
+	}
+	if row := e.screenBuffer[e.cursor.y+e.lineOffset]; e.cursor.x >= len(row) || row[e.cursor.x] != r {
+		return false
+	}
+	for _, closer := range e.AutoClosePairs {
+		if closer == r {
+			return e.moveCursor(right)
+		}
+	}
+	return false
+}
+
+// ToUpperSelection makes the letters of the selection uppercase, keeping it selected.
+func (e *Editor) ToUpperSelection() {
+	e.change(func() {
+		e.mapSelection(strings.ToUpper)
+	})
+}
+
+// ToLowerSelection makes the letters of the selection lowercase, keeping it selected.
+func (e *Editor) ToLowerSelection() {
+	e.change(func() {
+		e.mapSelection(strings.ToLower)
+	})
+}
+
+// SortSelectedLines sorts the lines the selection covers completely by their visible text, as a single
+// undoable operation, keeping them selected.
+func (e *Editor) SortSelectedLines(descending bool) {
+	e.change(func() {
+		e.sortSelectedLines(descending)
+	})
+}
+
+func (e *Editor) sortSelectedLines(descending bool) {
+	rawSeg, found := e.selectionSegment()
+	if !found {
+		return
+	}
+	from, to := e.selectionEnds(rawSeg)
+	start, end := from, to
+	if to.before(from) {
+		start, end = to, from
+	}
+	e.clearSelection()
+	onlyMarkup := func(rs []rune) bool {
+		return markupPattern.ReplaceAllString(string(rs), "") == ""
+	}
+	first, last := start.y, end.y
+	if !onlyMarkup(e.rawBuffer[first][:start.x]) {
+		first++
+	}
+	if !onlyMarkup(e.rawBuffer[last][end.x:]) {
+		last--
+	}
+	if first < last {
+		type sortedLine struct {
+			raw     []rune
+			visible string
+		}
+		lines := []sortedLine{}
+		for _, line := range e.rawBuffer[first : last+1] {
+			lines = append(lines, sortedLine{raw: line, visible: string(plain(e.entities(), [][]rune{line})[0])})
+		}
+		sort.SliceStable(lines, func(i, j int) bool {
+			if descending {
+				return lines[i].visible > lines[j].visible
+			}
+			return lines[i].visible < lines[j].visible
+		})
+		for idx, line := range lines {
+			e.rawBuffer[first+idx] = line.raw
+		}
+		// The selection covers the sorted lines from their very start to their very end.
+		if start.y == first {
+			start = point{x: 0, y: first}
+		}
+		if end.y == last {
+			end = point{x: len(e.rawBuffer[last]), y: last}
+		}
+	}
+	e.redraw()
+	if to.before(from) {
+		e.selectRaw(end, start)
+	} else {
+		e.selectRaw(start, end)
+	}
+	e.redraw()
+}
+
+// mapSelection replaces the visible text of the selection by f of it, keeping any markup.
+func (e *Editor) mapSelection(f func(string) string) {
+	rawSeg, found := e.selectionSegment()
+	if !found {
+		return
+	}
+	for y := rawSeg[0].y; y <= rawSeg[1].y; y++ {
+		line := e.rawBuffer[y]
+		from, to := 0, len(line)
+		if y == rawSeg[0].y {
+			from = rawSeg[0].x
+		}
+		if y == rawSeg[1].y {
+			to = rawSeg[1].x
+		}
+		mapped := []rune{}
+		text := string(line[from:to])
+		copied := 0
+		for _, loc := range append(markupPattern.FindAllStringIndex(text, -1), []int{len(text), len(text)}) {
+			visible := plain(e.entities(), [][]rune{[]rune(text[copied:loc[0]])})[0]
+			mapped = append(mapped, []rune(e.escape(f(string(visible))))...)
+			mapped = append(mapped, []rune(text[loc[0]:loc[1]])...)
+			copied = loc[1]
+		}
+		e.rawBuffer[y] = concatRunes(line[:from], mapped, line[to:])
+	}
+	e.redraw()
+	e.replace(true, selectToPattern, "", func(s string, rawSeg, screenSeg segment) bool {
+		e.setScrolledCursor(e.screenBufferPoint(rawSeg[0]))
+		return false
+	})
+}
+
+// selectRaw selects between the raw points, and puts the cursor at to, which may be before from.
+// Any previous selection must be cleared before computing the points.
+func (e *Editor) selectRaw(from, to point) {
+	cursor := e.screenBufferPoint(to)
+	// Inserting the later token first keeps the earlier point valid.
+	if to.before(from) {
+		e.insertRaw(from, []rune(selectFromToken))
+		e.insertRaw(to, []rune(selectToToken))
+	} else {
+		e.insertRaw(to, []rune(selectToToken))
+		e.insertRaw(from, []rune(selectFromToken))
+	}
+	e.selecting = true
+	e.setScrolledCursor(cursor)
+}
+
+// GoToColumn moves the cursor to a display column of its current line, or to the end of the line if the
+// line is shorter.
+func (e *Editor) GoToColumn(col int) {
+	e.change(func() {
+		line, _ := e.lineColumn(e.cursor)
+		e.setScrolledCursor(e.lineColumnPoint(line, e.maxInt(0, col)))
+	})
+}
+
+// GoToLine moves the cursor to the start of a raw line, counted from 1, and scrolls to make it visible.
+// Lines out of range go to the first or last line.
+func (e *Editor) GoToLine(n int) {
+	e.change(func() {
+		e.goToLine(n)
+	})
+}
+
+func (e *Editor) goToLine(n int) {
+	e.limitInt(&n, 1, len(e.rawBuffer)+1)
+	e.setScrolledCursor(e.lineColumnPoint(n-1, 0))
+}
+
+// lineColumnPoint returns the screenBuffer position of a display column of a raw line, or of the end
+// of the line if the line is shorter.
+func (e *Editor) lineColumnPoint(rawLine, col int) point {
+	res := point{}
+	for y, line := range e.screenBufferIndex {
+		if line[len(line)-1].y != rawLine {
+			continue
+		}
+		res = point{x: e.minInt(col, len(e.screenBuffer[y])), y: y}
+		if col < len(e.screenBuffer[y]) {
+			return res
+		}
+		col -= len(e.screenBuffer[y])
+	}
+	return res
+}
+
+// Symbols returns the symbols the SymbolProvider finds in the content.
+func (e *Editor) Symbols() []Symbol {
+	if e.SymbolProvider == nil {
+		return nil
+	}
+	return e.SymbolProvider(runesToString(e.rawBuffer))
+}
+
+// GoToSymbol moves the cursor to the first symbol with the name, scrolling to make it visible.
+// It returns false if there is no such symbol.
+func (e *Editor) GoToSymbol(name string) bool {
+	for _, symbol := range e.Symbols() {
+		if symbol.Name == name {
+			e.change(func() {
+				e.restoreCursor(point{x: symbol.Position.Col, y: symbol.Position.Line})
+			})
+			return true
+		}
+	}
+	return false
+}
+
+// promptKey edits the input of the prompt, submits it on Enter, or cancels it on Esc.
+func (e *Editor) promptKey(ev *tcell.EventKey) {
+	p := e.prompt
+	switch ev.Key() {
+	case tcell.KeyEnter:
+		if p.choose != nil {
+			break
+		}
+		e.prompt = nil
+		e.redraw()
+		p.done(string(p.input))
+	case tcell.KeyEsc:
+		e.prompt = nil
+		e.redraw()
+		if p.cancel != nil {
+			p.cancel()
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(p.input) > 0 {
+			p.input = p.input[:len(p.input)-1]
+		}
+		e.redraw()
+	case tcell.KeyRune:
+		if p.choose != nil {
+			p.choose(ev.Rune())
+			break
+		}
+		p.input = append(p.input, ev.Rune())
+		e.redraw()
+	}
+}
+
+// promptReplace asks for a pattern and a replacement, and then about each match of the pattern in the
+// visible text.
+func (e *Editor) promptReplace() {
+	e.prompt = &prompt{label: "Replace: ", done: func(pattern string) {
+		p, err := regexp.Compile(pattern)
+		if err != nil || pattern == "" {
+			e.bell(BellInvalidPattern)
+			return
+		}
+		e.prompt = &prompt{label: "With: ", done: func(repl string) {
+			// The replacement is typed as plain text, so anything but its submatches needs escaping.
+			r := &replacement{pattern: p, repl: e.escape(repl)}
+			e.replace(false, p, "", func(_ string, rawSeg, _ segment) bool {
+				r.matches = append(r.matches, rawSeg)
+				return false
+			})
+			if len(r.matches) == 0 {
+				e.bell(BellNotFound)
+				return
+			}
+			e.replacing = r
+			e.askReplace()
+		}}
+		e.redraw()
+	}}
+	e.redraw()
+}
+
+// askReplace highlights the next match of the ongoing replace and asks whether to replace it, or
+// replaces the accepted matches when there are no more.
+func (e *Editor) askReplace() {
+	r := e.replacing
+	if len(r.accepted) == len(r.matches) {
+		e.finishReplace(false)
+		return
+	}
+	match := r.matches[len(r.accepted)]
+	e.candidate = &match
+	e.redraw()
+	e.setRawCursor(match[0])
+	e.prompt = &prompt{label: "Replace? (y/n/a/q) ", choose: func(answer rune) {
+		switch answer {
+		case 'y', 'n':
+			r.accepted = append(r.accepted, answer == 'y')
+			e.askReplace()
+		case 'a':
+			e.finishReplace(true)
+		case 'q':
+			e.finishReplace(false)
+		}
+	}, cancel: func() {
+		e.finishReplace(false)
+	}}
+	e.redraw()
+}
+
+// finishReplace ends the ongoing replace, replacing the accepted matches, and all undecided matches if all is set.
+func (e *Editor) finishReplace(all bool) {
+	r := e.replacing
+	e.replacing, e.candidate, e.prompt = nil, nil, nil
+	idx := 0
+	e.replaceMovingCursor(false, r.pattern, r.repl, func(string, segment, segment) bool {
+		accept := all
+		if idx < len(r.accepted) {
+			accept = r.accepted[idx]
+		}
+		idx++
+		return accept
+	})
+	// Without replacements nothing removes the highlight.
+	e.redraw()
+}
+
+// Find selects the first match of query in the visible text after the cursor, or the first match before
+// it if there is none after it, and scrolls to make it visible. It returns false if there are no matches.
+func (e *Editor) Find(query string, caseInsensitive bool) (found bool) {
+	e.change(func() {
+		found = e.find(query, caseInsensitive, false, false)
+	})
+	return found
+}
+
+// FindNext selects the next match of the last query of Find or Ctrl-f, like Find does.
+func (e *Editor) FindNext() (found bool) {
+	e.change(func() {
+		found = e.find(e.lastFind, e.lastFindCaseInsensitive, false, true)
+	})
+	return found
+}
+
+// FindPrev selects the closest match of the last query of Find or Ctrl-f before the cursor, or the last
+// match if there is none before it.
+func (e *Editor) FindPrev() (found bool) {
+	e.change(func() {
+		found = e.find(e.lastFind, e.lastFindCaseInsensitive, true, true)
+	})
+	return found
+}
+
+// find selects the match of query closest to the cursor in the direction, other than the selected one or,
+// when finding again, the one starting at the cursor, and remembers the query for FindNext and FindPrev.
+func (e *Editor) find(query string, caseInsensitive, backwards, again bool) bool {
+	e.lastFind, e.lastFindCaseInsensitive = query, caseInsensitive
+	if query == "" {
+		return false
+	}
+	e.highlightFind = true
+	p := findPattern(query, caseInsensitive)
+	// Matches are ordered and compared by their visible positions, which clearing the selection doesn't change.
+	rawMatches := func() []segment {
+		res := []segment{}
+		e.replace(false, p, "", func(_ string, rawSeg, _ segment) bool {
+			res = append(res, rawSeg)
+			return false
+		})
+		return res
+	}
+	screenMatches := []segment{}
+	e.replace(false, p, "", func(_ string, _, screenSeg segment) bool {
+		screenMatches = append(screenMatches, screenSeg)
+		return false
+	})
+	if len(screenMatches) == 0 {
+		return false
+	}
+	var selected *segment
+	e.replace(true, selectionPattern, "", func(_ string, _, screenSeg segment) bool {
+		selected = &screenSeg
+		return false
+	})
+	line, col := e.lineRuneColumn(e.cursor)
+	cursor := point{x: col, y: line}
+	if selected == nil && again {
+		for idx := range screenMatches {
+			if screenMatches[idx][0] == cursor {
+				selected = &screenMatches[idx]
+			}
+		}
+	}
+
+	next := -1
+	for idx := range screenMatches {
+		if backwards {
+			idx = len(screenMatches) - 1 - idx
+		}
+		match := screenMatches[idx]
+		if selected != nil && match == *selected {
+			continue
+		}
+		if next == -1 {
+			// Wrapping around.
+			next = idx
+		}
+		if backwards == match[0].before(cursor) {
+			next = idx
+			break
+		}
+	}
+	if next == -1 {
+		// The selection is the only match.
+		return true
+	}
+	e.clearSelection()
+	match := rawMatches()[next]
+	e.selectRaw(match[0], match[1])
+	return true
+}
+
+func findPattern(query string, caseInsensitive bool) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(query)
+	if caseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.MustCompile(pattern)
+}
+
+// SelectIndentBlock selects the lines around the cursor that are indented at least as much as the line
+// of the cursor.
+func (e *Editor) SelectIndentBlock() {
+	e.change(func() {
+		line, _ := e.lineColumn(e.cursor)
+		level := e.IndentLevel(line)
+		first, last := line, line
+		for first > 0 && e.IndentLevel(first-1) >= level {
+			first--
+		}
+		for last+1 < len(e.rawBuffer) && e.IndentLevel(last+1) >= level {
+			last++
+		}
+		e.clearSelection()
+		e.selectRaw(point{x: 0, y: first}, point{x: len(e.rawBuffer[last]), y: last})
+	})
+}
+
+func (e *Editor) copySelection() {
+	if selected := e.selectedRunes(); selected != nil {
+		e.setPasteBuffer(selected)
+	}
+}
+
+// insertLines writes lines of plain text at the cursor, and moves the cursor after them.
+func (e *Editor) insertLines(lines [][]rune) {
+	for idx, line := range lines {
+		e.writeAt([]rune(e.escape(string(line))), e.cursor)
+		for _ = range line {
+			e.moveCursor(right)
+		}
+		if idx+1 < len(lines) {
+			e.addLineAt(e.cursor)
+			e.moveCursor(right)
+		}
+	}
+}
+
+// Copy copies the selected text or block, like Ctrl-c.
+func (e *Editor) Copy() {
+	if !e.indexed() {
+		return
+	}
+	if e.block != nil {
+		e.copyBlock()
+		return
+	}
+	e.copySelection()
+}
+
+// Cut copies and removes the selected text or block, like Ctrl-x, as a single undoable operation.
+func (e *Editor) Cut() {
+	e.change(func() {
+		if e.block != nil {
+			e.copyBlock()
+			e.deleteBlock()
+			return
+		}
+		e.removeSelection(true)
+		e.selecting = false
+		e.setCursor()
+	})
+}
+
+// Paste inserts the copied text or block at the cursor, like Ctrl-v, as a single undoable operation.
+func (e *Editor) Paste() {
+	e.change(e.paste)
+}
+
+// paste inserts the copied text at the cursor, or the copied block at the cursor column of the lines from
+// the cursor line.
+func (e *Editor) paste() {
+	if lines, block := e.pasted(); block {
+		e.insertBlock(lines)
+	} else {
+		e.insertLines(lines)
+	}
+}
+
+// InsertText inserts plain text at the cursor and moves the cursor after it, as a single undoable operation.
+func (e *Editor) InsertText(s string) {
+	e.change(func() {
+		e.insertLines(stringToRunes(strings.ReplaceAll(s, "\r\n", "\n")))
+	})
+}
+
+// Clipboard is a clipboard shared with other applications, like the one of the system.
+type Clipboard interface {
+	Get() (string, error)
+	Set(string) error
+}
+
+// setPasteBuffer stores copied or cut runes, in the Clipboard too if there is one.
+func (e *Editor) setPasteBuffer(rs [][]rune) {
+	e.pasteBuffer = rs
+	e.pasteBlock = false
+	if e.Clipboard != nil {
+		// The paste buffer still has the runes if the clipboard fails.
+		e.Clipboard.Set(runesToString(rs))
+	}
+}
+
+// pasted returns the runes to paste, from the Clipboard if there is one that works, and whether they are
+// a copied block.
+func (e *Editor) pasted() (lines [][]rune, block bool) {
+	if e.Clipboard != nil {
+		if s, err := e.Clipboard.Get(); err == nil {
+			s = strings.ReplaceAll(s, "\r\n", "\n")
+			// Blocks survive the clipboard as long as nothing else was copied to it.
+			return stringToRunes(s), e.pasteBlock && s == runesToString(e.pasteBuffer)
+		}
+	}
+	return e.pasteBuffer, e.pasteBlock
+}
+
+// plainSpan is a visible rune of a raw line, the raw columns of its markup, and the screen columns it
+// covers counted from the start of the line.
+type plainSpan struct {
+	rune  rune
+	start int
+	end   int
+	col   int
+	width int
+}
+
+// plainSpans returns the visible runes of a raw line.
+func plainSpans(entities []Entity, line []rune) []plainSpan {
+	res := []plainSpan{}
+	parseTokens(entities, [][]rune{line}, func(t *token) {
+		if t.rune != nil {
+			res = append(res, plainSpan{rune: *t.rune, start: t.pos.x, end: t.pos.x + len(t.buffer)})
+		}
+	})
+	return res
+}
+
+// lineSpans returns the visible runes of a raw line with the screen columns the layout gives them, so that
+// tabs and wide runes cover several columns.
+func (e *Editor) lineSpans(y int) (spans []plainSpan, width int) {
+	spans = plainSpans(e.entities(), e.rawBuffer[y])
+	byStart := map[int]int{}
+	for idx, span := range spans {
+		byStart[span.start] = idx
+	}
+	for _, row := range e.screenBufferIndex {
+		if row[len(row)-1].y != y {
+			continue
+		}
+		for _, p := range row[:len(row)-1] {
+			if idx, found := byStart[p.x]; found {
+				if spans[idx].width == 0 {
+					spans[idx].col = width
+				}
+				spans[idx].width++
+			}
+			width++
+		}
+	}
+	return spans, width
+}
+
+// cursorIndexed returns whether the cursor is on the current layout, which it isn't while content replaced
+// from outside is laid out before the cursor is restored.
+func (e *Editor) cursorIndexed() bool {
+	row := e.cursor.y + e.lineOffset
+	return e.indexed() && row >= 0 && row < len(e.screenBufferIndex) && e.cursor.x >= 0 && e.cursor.x < len(e.screenBufferIndex[row])
+}
+
+// columnCursor returns the cursor in screen columns of raw lines.
+func (e *Editor) columnCursor() point {
+	raw := e.rawCursor()
+	spans, width := e.lineSpans(raw.y)
+	for _, span := range spans {
+		if span.start >= raw.x {
+			return point{x: span.col, y: raw.y}
+		}
+	}
+	return point{x: width, y: raw.y}
+}
+
+// blockBounds returns the top left corner of the block selection, and the bottom line and the column after
+// its right edge.
+func (e *Editor) blockBounds() (from, to point) {
+	corner, cursor := *e.block, e.columnCursor()
+	from = point{x: e.minInt(corner.x, cursor.x), y: e.minInt(corner.y, cursor.y)}
+	to = point{x: e.maxInt(corner.x, cursor.x), y: e.maxInt(corner.y, cursor.y)}
+	e.limitInt(&from.y, 0, len(e.rawBuffer))
+	e.limitInt(&to.y, 0, len(e.rawBuffer))
+	return from, to
+}
+
+// blockSpans returns the visible runes starting in the columns of the block selection, for each line of it.
+func (e *Editor) blockSpans() [][]plainSpan {
+	from, to := e.blockBounds()
+	res := [][]plainSpan{}
+	for y := from.y; y <= to.y; y++ {
+		spans, _ := e.lineSpans(y)
+		selected := []plainSpan{}
+		for _, span := range spans {
+			if span.col >= from.x && span.col < to.x {
+				selected = append(selected, span)
+			}
+		}
+		res = append(res, selected)
+	}
+	return res
+}
+
+// copyBlock copies the columns of the block selection, one line per line of it.
+func (e *Editor) copyBlock() {
+	lines := [][]rune{}
+	for _, spans := range e.blockSpans() {
+		line := []rune{}
+		for _, span := range spans {
+			line = append(line, span.rune)
+		}
+		lines = append(lines, line)
+	}
+	e.setPasteBuffer(lines)
+	e.pasteBlock = true
+}
+
+// deleteBlock removes the columns of the block selection, and puts the cursor at its top left corner.
+func (e *Editor) deleteBlock() {
+	from, _ := e.blockBounds()
+	for idx, spans := range e.blockSpans() {
+		if len(spans) > 0 {
+			y := from.y + idx
+			e.rawBuffer[y] = concatRunes(e.rawBuffer[y][:spans[0].start], e.rawBuffer[y][spans[len(spans)-1].end:])
+		}
+	}
+	e.block = nil
+	e.redraw()
+	x, _ := e.columnStart(from)
+	e.restoreCursor(point{x: x, y: from.y})
+}
+
+// columnStart returns the raw column of the first visible rune of a raw line at or after a screen column, or
+// where the line's visible runes end and how many columns short of the screen column they are.
+func (e *Editor) columnStart(p point) (x int, short int) {
+	spans, width := e.lineSpans(p.y)
+	for _, span := range spans {
+		if span.col >= p.x {
+			return span.start, 0
+		}
+	}
+	if len(spans) > 0 {
+		x = spans[len(spans)-1].end
+	}
+	return x, e.maxInt(0, p.x-width)
+}
+
+// insertBlock writes lines of plain text at the cursor column of the lines from the cursor line, padding
+// shorter lines with spaces and adding lines at the end of the content, and puts the cursor after the last one.
+func (e *Editor) insertBlock(lines [][]rune) {
+	at := e.columnCursor()
+	end := point{}
+	for idx, line := range lines {
+		y := at.y + idx
+		if y == len(e.rawBuffer) {
+			e.rawBuffer = append(e.rawBuffer, nil)
+		}
+		// Only the lines already written to differ from the layout, and they aren't looked at again.
+		x, short := e.columnStart(point{x: at.x, y: y})
+		text := []rune(strings.Repeat(" ", short) + e.escape(string(line)))
+		e.rawBuffer[y] = concatRunes(e.rawBuffer[y][:x], text, e.rawBuffer[y][x:])
+		end = point{x: x + len(text), y: y}
+	}
+	e.redraw()
+	e.restoreCursor(end)
+}
+
+// blockKey handles keys while there is a block selection, and returns whether the key was handled. Moving
+// the cursor without Shift changes the block, and any other key ends it.
+func (e *Editor) blockKey(ev *tcell.EventKey) bool {
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		e.copyBlock()
+		return true
+	case tcell.KeyCtrlX:
+		e.copyBlock()
+		e.deleteBlock()
+		return true
+	case tcell.KeyDelete, tcell.KeyBackspace, tcell.KeyBackspace2:
+		e.deleteBlock()
+		return true
+	case tcell.KeyCtrlB:
+		e.block = nil
+		return true
+	case tcell.KeyUp, tcell.KeyDown, tcell.KeyLeft, tcell.KeyRight, tcell.KeyHome, tcell.KeyEnd, tcell.KeyPgUp, tcell.KeyPgDn:
+		if ev.Modifiers()&(tcell.ModShift|tcell.ModAlt) == 0 {
+			return false
+		}
+	}
+	e.block = nil
+	return false
+}
+
+// selectedRunes returns the visible runes of the selection, or nil if there is none.
+func (e *Editor) selectedRunes() (res [][]rune) {
+	e.replace(true, selectionPattern, "", func(s string, rawSeg, screenSeg segment) bool {
+		if match := selectionPattern.FindStringSubmatch(s); match != nil {
+			res = plain(e.entities(), stringToRunes(match[2]))
+		}
+		return false
+	})
+	return res
+}
+
+// Selection returns the selected text, and the raw span of it between the selection markers, or ok false
+// if nothing is selected.
+func (e *Editor) Selection() (text string, startLine, startCol, endLine, endCol int, ok bool) {
+	e.replace(true, selectionPattern, "", func(s string, rawSeg, screenSeg segment) bool {
+		if match := selectionPattern.FindStringSubmatch(s); match != nil {
+			text = runesToString(plain(e.entities(), stringToRunes(match[2])))
+			startLine, startCol = rawSeg[0].y, rawSeg[0].x+len([]rune(match[1]))
+			endLine, endCol = rawSeg[1].y, rawSeg[1].x-len([]rune(match[3]))
+			ok = true
+		}
+		return false
+	})
+	return
+}
+
+// wordClass groups runes into words of letters, digits and underscores, runs of whitespace, and
+// single other runes.
+func wordClass(r rune) int {
+	if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+		return 1
+	} else if unicode.IsSpace(r) {
+		return 2
+	}
+	return 3
+}
+
+// WordAt returns the raw span of the word, or run of whitespace, at a raw position.
+func (e *Editor) WordAt(p Position) Span {
+	if !e.indexed() || p.Line < 0 || p.Line >= len(e.rawBuffer) {
+		return Span{From: p, To: p}
+	}
+	screenBufferPoint := e.screenBufferPoint(point{x: p.Col, y: p.Line})
+	line, col := e.lineRuneColumn(point{x: screenBufferPoint.x, y: screenBufferPoint.y - e.lineOffset})
+	runes := plain(e.entities(), [][]rune{e.rawBuffer[line]})[0]
+	points := append(e.lineRunePoints(line), point{x: len(e.rawBuffer[line]), y: line})
+	if len(runes) == 0 {
+		return Span{From: p, To: p}
+	}
+	// Positions just after a word, like the end of the line, belong to the word.
+	if col >= len(runes) || (col > 0 && wordClass(runes[col]) != 1 && wordClass(runes[col-1]) == 1) {
+		col--
+	}
+	from, to := col, col+1
+	if class := wordClass(runes[col]); class != 3 {
+		for from > 0 && wordClass(runes[from-1]) == class {
+			from--
+		}
+		for to < len(runes) && wordClass(runes[to]) == class {
+			to++
+		}
+	}
+	return Span{
+		From: points[from].position(),
+		To:   points[to].position(),
+	}
+}
+
+// SelectWord selects the word, or run of whitespace, under the cursor.
+func (e *Editor) SelectWord() {
+	e.change(func() {
+		e.clearSelection()
+		word := e.WordAt(e.rawCursor().position())
+		e.selectRaw(point{x: word.From.Col, y: word.From.Line}, point{x: word.To.Col, y: word.To.Line})
+	})
+}
+
+// SelectLine selects the raw line of the cursor, and the newline ending it if withNewline is true and
+// it isn't the last line.
+func (e *Editor) SelectLine(withNewline bool) {
+	e.change(func() {
+		e.clearSelection()
+		line, _ := e.lineColumn(e.cursor)
+		to := point{x: len(e.rawBuffer[line]), y: line}
+		if withNewline && line+1 < len(e.rawBuffer) {
+			to = point{x: 0, y: line + 1}
+		}
+		e.selectRaw(point{x: 0, y: line}, to)
+	})
+}
+
+// SelectAll selects the whole content.
+func (e *Editor) SelectAll() {
+	e.change(e.selectAll)
+}
+
+func (e *Editor) selectAll() {
+	e.clearSelection()
+	last := len(e.rawBuffer) - 1
+	e.selectRaw(point{}, point{x: len(e.rawBuffer[last]), y: last})
+}
+
+func runesToString(rs [][]rune) string {
+	res := &bytes.Buffer{}
+	for idx, line := range rs {
+		fmt.Fprintf(res, "%v", string(line))
+		if idx+1 < len(rs) {
+			fmt.Fprintln(res)
+		}
+	}
+	return res.String()
+}
+
+func (e *Editor) removeSelection(cpy bool) (removedScreenSeg segment, removedRunes []rune) {
+	e.replace(true, selectionPattern, "", func(s string, rawSeg, screenSeg segment) bool {
+		if cpy {
+			if match := selectionPattern.FindStringSubmatch(s); match != nil {
+				e.setPasteBuffer(plain(e.entities(), stringToRunes(match[2])))
+			}
+		}
+		removedScreenSeg = screenSeg
+		removedRunes = []rune(runesToString(plain(e.entities(), stringToRunes(s))))
+		return true
+	})
+	return
 }
 
 func (e *Editor) backCursor(removedSeg segment, removedRunes []rune) {
@@ -471,283 +2820,931 @@ func (e *Editor) backCursor(removedSeg segment, removedRunes []rune) {
 	e.setCursor()
 }
 
-func (e *Editor) pollKeys() {
-	var selectFrom *point
+// pollKeys handles events until the editor is closed, returning ErrAborted if the abort key closed it,
+// or the error of ctx if it was cancelled.
+func (e *Editor) pollKeys(ctx context.Context) error {
+	e.aborted = false
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Wakes up PollEvent, since it can't be cancelled.
+			e.Screen.PostEvent(tcell.NewEventInterrupt(ctx))
+		case <-done:
+		}
+	}()
 	for {
-		evs := []tcell.Event{e.Screen.PollEvent()}
+		ev := e.Screen.PollEvent()
+		if interrupt, ok := ev.(*tcell.EventInterrupt); ok {
+			if interrupt.Data() == ctx {
+				if !e.ManageScreen {
+					e.Screen.Fini()
+				}
+				return ctx.Err()
+			}
+			if update, ok := interrupt.Data().(contentUpdate); ok {
+				e.SetContent(string(update))
+				continue
+			}
+		}
+		evs := []tcell.Event{ev}
 		if e.EventFilter != nil {
 			evs = e.EventFilter(evs[0])
 		}
-		for _, untypedEv := range evs {
-			prevContent := runesToString(e.rawBuffer)
-			prevCursor := e.cursor
-			storeUndo := true
-			clearRedo := true
-			selectFrom = nil
+		for _, ev := range evs {
+			if e.handleEvent(ev) {
+				if e.aborted {
+					return ErrAborted
+				}
+				return nil
+			}
+		}
+	}
+}
 
-			switch ev := untypedEv.(type) {
-			case *tcell.EventResize:
-				e.redraw()
+// quits returns whether the key closes the editor.
+func (e *Editor) quits(ev *tcell.EventKey) bool {
+	if e.ShouldQuit != nil {
+		return e.ShouldQuit(ev)
+	}
+	if e.QuitKey == 0 {
+		return ev.Key() == tcell.KeyCtrlW
+	}
+	return ev.Key() == e.QuitKey
+}
+
+// aborts returns whether the key closes the editor discarding the edits.
+func (e *Editor) aborts(ev *tcell.EventKey) bool {
+	if e.AbortKey == 0 {
+		return ev.Key() == tcell.KeyCtrlQ
+	}
+	return ev.Key() == e.AbortKey
+}
+
+// Aborted returns whether the editor was last closed by the abort key.
+func (e *Editor) Aborted() bool {
+	return e.aborted
+}
+
+// HandleEvent processes an event like the edit loop does, for hosts and scripts driving the editor
+// themselves. It returns true if the event closed the editor.
+func (e *Editor) HandleEvent(ev tcell.Event) (quit bool) {
+	return e.handleEvent(ev)
+}
+
+func (e *Editor) handleEvent(untypedEv tcell.Event) (quit bool) {
+	if _, isResize := untypedEv.(*tcell.EventResize); !isResize && !e.indexed() {
+		// Input before the screen has a size can't be mapped to the content, so it waits for a resize.
+		e.unindexedEvents = append(e.unindexedEvents, untypedEv)
+		return false
+	}
+	// Where a new selection starts, in screenBuffer rather than screen coordinates to survive scrolling.
+	var selectFrom *point
+	// Scrolling neither extends nor ends an ongoing selection.
+	keepSelecting := false
+	prevContent := runesToString(e.rawBuffer)
+	prevCursor := e.rawCursor()
+	hadBlock := e.block != nil
+	// Resizes replaying events received before the screen had a size have them notify the Observer.
+	observing := e.Observer != nil && e.batching == 0 && e.indexed()
+	var prevObservation observation
+	if observing {
+		prevObservation = e.observe()
+	}
+	storeUndo := true
+	clearRedo := true
+	// Whether the event typed a rune, which may be coalesced into the undo patch of the previous one.
+	typed := false
+
+	// Moving up and down keeps the desired column, which any other event forgets.
+	verticalMove := false
+	if ev, ok := untypedEv.(*tcell.EventKey); ok && e.prompt == nil && ev.Modifiers()&tcell.ModAlt == 0 {
+		switch ev.Key() {
+		case tcell.KeyUp, tcell.KeyDown, tcell.KeyPgUp, tcell.KeyPgDn:
+			verticalMove = true
+		}
+	}
+
+	switch ev := untypedEv.(type) {
+	case *tcell.EventResize:
+		e.redraw()
+		e.setCursor()
+		if e.indexed() {
+			if e.unsizedCursor != nil {
+				e.restoreCursor(*e.unsizedCursor)
+				e.unsizedCursor = nil
+			}
+			pending := e.unindexedEvents
+			e.unindexedEvents = nil
+			for _, ev := range pending {
+				if e.handleEvent(ev) {
+					return true
+				}
+			}
+		}
+	case *tcell.EventMouse:
+		viewPoint, inside := e.view().inside(ev.Position())
+		// Clicks on the line numbers go to the start of the line.
+		viewPoint.x -= e.gutterWidth()
+		switch {
+		case ev.Buttons() == tcell.ButtonNone:
+			// Releasing the button ends any drag wherever it happens, keeping what it selected.
+			keepSelecting = true
+			e.dragFrom = nil
+		case !inside:
+			// Events outside the view belong to whatever the host draws there.
+			keepSelecting = true
+		case ev.Buttons()&tcell.Button1 != 0 && e.dragFrom == nil:
+			e.clearSelection()
+			e.block = nil
+			e.cursor = viewPoint
+			e.setCursor()
+			e.dragFrom = e.scrolledCursor()
+			// Alt-dragging selects a block.
+			if ev.Modifiers()&tcell.ModAlt != 0 {
+				block := e.columnCursor()
+				e.block = &block
+			}
+		case ev.Buttons()&tcell.Button1 != 0:
+			keepSelecting = true
+			e.cursor = viewPoint
+			e.setCursor()
+			if e.block == nil {
+				e.selectFrom(*e.dragFrom)
+			}
+		case ev.Buttons()&tcell.WheelUp != 0:
+			keepSelecting = true
+			if e.canScroll(up) {
+				e.scroll(up)
+				e.cursor.y++
 				e.setCursor()
-			case *tcell.EventKey:
-				switch ev.Key() {
-				case tcell.KeyEnter:
-					e.addLineAt(e.cursor)
-					e.moveCursor(right)
-				case tcell.KeyBackspace:
-					e.moveCursor(left)
-					whitespaceness := whitespacePattern.MatchString(string([]rune{e.runeAt(e.cursor)}))
-					e.deleteAt(e.cursor)
-					for e.moveCursor(left) {
-						if whitespaceness != whitespacePattern.MatchString(string([]rune{e.runeAt(e.cursor)})) {
-							e.moveCursor(right)
-							break
-						}
-						e.deleteAt(e.cursor)
-					}
-				case tcell.KeyBackspace2:
-					removedSeg, removedRunes := e.removeSelection(false)
-					if len(removedRunes) == 0 {
-						if e.moveCursor(left) {
-							e.deleteAt(e.cursor)
-						}
-					} else {
-						e.backCursor(removedSeg, removedRunes)
-					}
-				case tcell.KeyDelete:
-					removedSeg, removedRunes := e.removeSelection(false)
-					if len(removedRunes) == 0 {
-						e.deleteAt(e.cursor)
-					} else {
-						e.backCursor(removedSeg, removedRunes)
-					}
-				case tcell.KeyTab:
-					e.writeAt([]rune{' '}, e.cursor)
+			}
+		case ev.Buttons()&tcell.WheelDown != 0:
+			keepSelecting = true
+			if e.canScroll(down) {
+				e.scroll(down)
+				e.cursor.y--
+				e.setCursor()
+			}
+		}
+	case *tcell.EventKey:
+		e.statusMessage = ""
+		if e.prompt != nil {
+			e.promptKey(ev)
+			break
+		}
+		if quits, aborts := e.quits(ev), e.aborts(ev); quits || aborts {
+			e.aborted = !quits
+			if !e.ManageScreen {
+				e.Screen.Fini()
+			}
+			return true
+		}
+		if e.ReadOnly && editingKeys[ev.Key()] {
+			keepSelecting = true
+			e.bell(BellReadOnly)
+			break
+		}
+		if e.block != nil && e.blockKey(ev) {
+			break
+		}
+		switch ev.Key() {
+		case tcell.KeyEnter:
+			e.deleteSelection()
+			indent := e.newLineIndentation()
+			e.addLineAt(e.cursor)
+			e.moveCursor(right)
+			if len(indent) > 0 {
+				e.writeAt(indent, e.cursor)
+				for _ = range indent {
 					e.moveCursor(right)
-					for e.cursor.x%4 != 0 {
-						e.writeAt([]rune{' '}, e.cursor)
-						e.moveCursor(right)
-					}
-				case tcell.KeyRune:
-					e.writeAt([]rune(Escape(string([]rune{ev.Rune()}))), e.cursor)
+				}
+			}
+		case tcell.KeyCtrlR:
+			e.promptReplace()
+		case tcell.KeyBackspace:
+			e.moveCursor(left)
+			whitespaceness := e.wordBoundaryAt(e.cursor)
+			e.deleteAt(e.cursor)
+			for e.moveCursor(left) {
+				if whitespaceness != e.wordBoundaryAt(e.cursor) {
 					e.moveCursor(right)
-				case tcell.KeyPgUp:
-					if ev.Modifiers()&tcell.ModShift != 0 {
-						selectFrom = e.cursor.clone()
-					}
-					_, height := e.Screen.Size()
-					for i := 0; i < height; i++ {
-						if !e.moveCursor(up) {
-							break
-						}
-					}
-				case tcell.KeyPgDn:
-					if ev.Modifiers()&tcell.ModShift != 0 {
-						selectFrom = e.cursor.clone()
-					}
-					_, height := e.Screen.Size()
-					for i := 0; i < height; i++ {
-						if !e.moveCursor(down) {
-							break
-						}
-					}
-				case tcell.KeyHome:
-					if ev.Modifiers()&tcell.ModShift != 0 {
-						selectFrom = e.cursor.clone()
-					}
-					e.cursor.x = 0
-					e.cursor.y = 0
-					e.lineOffset = 0
-					e.redraw()
-					e.setCursor()
-				case tcell.KeyEnd:
-					if ev.Modifiers()&tcell.ModShift != 0 {
-						selectFrom = e.cursor.clone()
-					}
-					_, height := e.Screen.Size()
-					e.lineOffset = e.maxInt(0, len(e.screenBuffer)-height/2)
-					e.cursor.y = len(e.screenBuffer) - e.lineOffset - 1
-					e.cursor.x = len(e.screenBuffer[e.cursor.y])
-					e.redraw()
-					e.setCursor()
-				case tcell.KeyCtrlA:
-					e.toggleHelp()
-				case tcell.KeyCtrlZ:
-					storeUndo = false
-					clearRedo = false
-					if len(e.undoPatches) > 0 {
-						toApply := e.undoPatches[len(e.undoPatches)-1]
-						e.undoPatches = e.undoPatches[:len(e.undoPatches)-1]
-						newContent, applied := e.differ.PatchApply(toApply.patches, prevContent)
-						if applied[0] {
-							e.redoPatches = append(e.redoPatches, patch{patches: e.differ.PatchMake(newContent, prevContent), cursor: toApply.cursor})
-
-							e.rawBuffer = stringToRunes(newContent)
-							e.cursor = toApply.cursor
-
-							e.redraw()
-						}
-					}
-				case tcell.KeyCtrlY:
-					clearRedo = false
-					if len(e.redoPatches) > 0 {
-						toApply := e.redoPatches[len(e.redoPatches)-1]
-						e.redoPatches = e.redoPatches[:len(e.redoPatches)-1]
-						newContent, applied := e.differ.PatchApply(toApply.patches, prevContent)
-						if applied[0] {
-							e.rawBuffer = stringToRunes(newContent)
-							e.cursor = toApply.cursor
-							e.redraw()
-						}
-					}
-				case tcell.KeyCtrlC:
-					e.copySelection()
-				case tcell.KeyCtrlX:
-					e.removeSelection(true)
-					e.setCursor()
-				case tcell.KeyCtrlV:
-					if len(e.pasteBuffer) > 0 {
-						for idx, line := range e.pasteBuffer {
-							e.writeAt([]rune(Escape(string(line))), e.cursor)
-							for _ = range line {
-								e.moveCursor(right)
-							}
-							if idx+1 < len(e.pasteBuffer) {
-								e.addLineAt(e.cursor)
-								e.moveCursor(right)
-							}
-						}
-					}
-				case tcell.KeyCtrlW:
-					e.Screen.Fini()
-					return
-				case tcell.KeyUp:
-					if ev.Modifiers()&tcell.ModShift != 0 {
-						selectFrom = e.cursor.clone()
-					}
-					if ev.Modifiers()&tcell.ModCtrl != 0 {
-						e.moveCursorUntil(up, e.differentIndentness(e.cursor))
-					} else {
-						e.moveCursor(up)
-					}
-				case tcell.KeyDown:
-					if ev.Modifiers()&tcell.ModShift != 0 {
-						selectFrom = e.cursor.clone()
-					}
-					if ev.Modifiers()&tcell.ModCtrl != 0 {
-						e.moveCursorUntil(down, e.differentIndentness(e.cursor))
-					} else {
-						e.moveCursor(down)
-					}
-				case tcell.KeyLeft:
-					if ev.Modifiers()&tcell.ModShift != 0 {
-						selectFrom = e.cursor.clone()
-					}
-					if ev.Modifiers()&tcell.ModCtrl != 0 {
-						e.moveCursorUntil(left, e.differentWhitespaceness(e.cursor))
-					} else {
-						e.moveCursor(left)
-					}
-				case tcell.KeyRight:
-					if ev.Modifiers()&tcell.ModShift != 0 {
-						selectFrom = e.cursor.clone()
-					}
-					if ev.Modifiers()&tcell.ModCtrl != 0 {
-						e.moveCursorUntil(right, e.differentWhitespaceness(e.cursor))
-					} else {
-						e.moveCursor(right)
+					break
+				}
+				e.deleteAt(e.cursor)
+			}
+		case tcell.KeyBackspace2:
+			removedSeg, removedRunes := e.removeSelection(false)
+			if len(removedRunes) == 0 {
+				for i := e.backspaceWidth(); i > 0; i-- {
+					if !e.moveCursor(left) {
+						e.bell(BellBoundary)
+						break
 					}
-				case tcell.KeyEsc:
-					e.selecting = false
-					selectFrom = nil
-					e.replace(true, selectToPattern, "", func(string, segment, segment) bool {
-						return true
-					})
-					e.replace(true, selectFromPattern, "", func(string, segment, segment) bool {
-						return true
-					})
+					e.deleteAt(e.cursor)
+				}
+			} else {
+				e.backCursor(removedSeg, removedRunes)
+			}
+		case tcell.KeyDelete:
+			removedSeg, removedRunes := e.removeSelection(false)
+			if len(removedRunes) > 0 {
+				e.backCursor(removedSeg, removedRunes)
+			} else if ev.Modifiers()&tcell.ModCtrl != 0 {
+				e.deleteWordForward()
+			} else {
+				e.deleteAt(e.cursor)
+			}
+		case tcell.KeyBacktab:
+			e.dedent()
+		case tcell.KeyTab:
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				e.dedent()
+				break
+			}
+			if e.indentSelection() {
+				break
+			}
+			if e.UseHardTabs {
+				e.writeAt([]rune{'\t'}, e.cursor)
+				e.moveCursor(right)
+				break
+			}
+			e.writeAt([]rune{' '}, e.cursor)
+			e.moveCursor(right)
+			for e.cursor.x%e.tabWidth() != 0 {
+				e.writeAt([]rune{' '}, e.cursor)
+				e.moveCursor(right)
+			}
+		case tcell.KeyRune:
+			if ev.Modifiers()&tcell.ModAlt != 0 && ev.Rune() == 'F' {
+				if err := e.format(); err != nil {
+					e.bell(BellFormat)
 				}
+				break
 			}
-			if e.selecting {
-				if selectFrom == nil {
-					e.selecting = false
+			if ev.Modifiers()&tcell.ModAlt != 0 && (ev.Rune() == 'u' || ev.Rune() == 'l') {
+				keepSelecting = true
+				if ev.Rune() == 'u' {
+					e.mapSelection(strings.ToUpper)
 				} else {
-					e.replace(true, selectToPattern, "", func(string, segment, segment) bool {
-						return true
-					})
-					e.writeAt([]rune(selectToToken), e.cursor)
+					e.mapSelection(strings.ToLower)
 				}
+				break
+			}
+			if ev.Modifiers()&tcell.ModCtrl != 0 && ev.Rune() == '/' {
+				keepSelecting = true
+				e.toggleComment()
+				break
+			}
+			if closer, found := e.selectionPairs()[ev.Rune()]; found && e.wrapSelection(ev.Rune(), closer) {
+				break
+			}
+			if closer, found := e.AutoClosePairs[ev.Rune()]; found && e.wrapSelection(ev.Rune(), closer) {
+				break
+			}
+			if e.typeOverCloser(ev.Rune()) {
+				break
+			}
+			typed = true
+			if !e.deleteSelection() && e.overwrite && e.screenBufferIndex[e.cursor.y+e.lineOffset][e.cursor.x].x >= 0 {
+				// Overwriting at the end of a line appends to it.
+				e.deleteAt(e.cursor)
+			}
+			if e.DedentOnCloser[ev.Rune()] {
+				e.dedentBeforeCloser()
+			}
+			e.writeAt([]rune(e.escape(string([]rune{ev.Rune()}))), e.cursor)
+			e.moveCursor(right)
+			if closer, found := e.AutoClosePairs[ev.Rune()]; found {
+				e.writeAt([]rune(e.escape(string([]rune{closer}))), e.cursor)
+			}
+		case tcell.KeyPgUp:
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				selectFrom = e.scrolledCursor()
 			} else {
-				if selectFrom != nil {
-					e.selecting = true
-					e.replace(true, selectToPattern, "", func(string, segment, segment) bool {
-						return true
-					})
-					e.replace(true, selectFromPattern, "", func(string, segment, segment) bool {
-						return true
-					})
-					ps := points{*selectFrom, e.cursor}
-					sort.Sort(ps)
-					for _, idx := range []int{1, 0} {
-						p := ps[idx]
-						if p == e.cursor {
-							e.writeAt([]rune(selectToToken), p)
-						} else {
-							e.writeAt([]rune(selectFromToken), p)
-						}
+				keepSelecting = true
+			}
+			_, height := e.textView().Size()
+			for i := 0; i < height; i++ {
+				if !e.moveCursor(up) {
+					if i == 0 {
+						e.bell(BellBoundary)
+					}
+					break
+				}
+			}
+		case tcell.KeyPgDn:
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				selectFrom = e.scrolledCursor()
+			} else {
+				keepSelecting = true
+			}
+			_, height := e.textView().Size()
+			for i := 0; i < height; i++ {
+				if !e.moveCursor(down) {
+					if i == 0 {
+						e.bell(BellBoundary)
 					}
+					break
+				}
+			}
+		case tcell.KeyHome:
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				selectFrom = e.scrolledCursor()
+			}
+			if ev.Modifiers()&tcell.ModCtrl != 0 {
+				e.cursor.x = 0
+				e.cursor.y = 0
+				e.lineOffset = 0
+				e.redraw()
+			} else if start := e.rowTextStart(e.cursor.y); e.cursor.x != start {
+				e.cursor.x = start
+			} else {
+				e.cursor.x = 0
+			}
+			e.setCursor()
+		case tcell.KeyEnd:
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				selectFrom = e.scrolledCursor()
+			}
+			if ev.Modifiers()&tcell.ModCtrl != 0 {
+				e.lineOffset = e.bottomLineOffset()
+				e.cursor.y = len(e.screenBuffer) - e.lineOffset - 1
+				e.redraw()
+			}
+			e.cursor.x = e.lineWidth(e.cursor.y)
+			e.setCursor()
+		case tcell.KeyF1:
+			e.toggleHelp()
+		case tcell.KeyCtrlA:
+			keepSelecting = true
+			e.selectAll()
+		case tcell.KeyCtrlZ:
+			storeUndo = false
+			clearRedo = false
+			e.undo()
+		case tcell.KeyCtrlY:
+			storeUndo = false
+			clearRedo = false
+			e.redo()
+		case tcell.KeyCtrlC:
+			e.copySelection()
+		case tcell.KeyCtrlX:
+			e.removeSelection(true)
+			e.setCursor()
+		case tcell.KeyCtrlV:
+			e.paste()
+		case tcell.KeyCtrlB:
+			keepSelecting = true
+			e.clearSelection()
+			block := e.columnCursor()
+			e.block = &block
+		case tcell.KeyCtrlF:
+			e.prompt = &prompt{label: "Find: ", input: []rune(e.lastFind), done: func(query string) {
+				if !e.find(query, false, false, false) {
+					e.bell(BellNotFound)
+				}
+			}}
+			e.redraw()
+		case tcell.KeyCtrlG:
+			e.prompt = &prompt{label: "Go to line: ", done: func(input string) {
+				n, err := strconv.Atoi(strings.TrimSpace(input))
+				if err != nil {
+					e.bell(BellInvalidLine)
+					return
+				}
+				e.goToLine(n)
+			}}
+			e.redraw()
+		case tcell.KeyF3:
+			if !e.find(e.lastFind, e.lastFindCaseInsensitive, ev.Modifiers()&tcell.ModShift != 0, true) {
+				e.bell(BellNotFound)
+			}
+		case tcell.KeyCtrlD:
+			keepSelecting = true
+			e.duplicateLines()
+		case tcell.KeyCtrlJ:
+			keepSelecting = true
+			e.joinLines()
+		case tcell.KeyCtrlL:
+			keepSelecting = true
+			e.centerCursor()
+		case tcell.KeyCtrlUnderscore:
+			keepSelecting = true
+			e.toggleComment()
+		case tcell.KeyInsert:
+			keepSelecting = true
+			e.overwrite = !e.overwrite
+		case tcell.KeyCtrlS:
+			// Saving changes neither the content nor the selection.
+			keepSelecting = true
+			storeUndo = false
+			clearRedo = false
+			e.save()
+		case tcell.KeyUp:
+			if ev.Modifiers()&tcell.ModAlt != 0 {
+				keepSelecting = true
+				e.moveLinesKey(up)
+				break
+			}
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				selectFrom = e.scrolledCursor()
+			} else if e.collapseSelection(up) {
+				break
+			}
+			if ev.Modifiers()&tcell.ModCtrl != 0 {
+				if !e.moveCursorUntil(up, e.differentIndentness(e.cursor)) {
+					e.bell(BellBoundary)
+				}
+			} else if !e.moveCursor(up) {
+				e.bell(BellBoundary)
+			}
+		case tcell.KeyDown:
+			if ev.Modifiers()&tcell.ModAlt != 0 {
+				keepSelecting = true
+				e.moveLinesKey(down)
+				break
+			}
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				selectFrom = e.scrolledCursor()
+			} else if e.collapseSelection(down) {
+				break
+			}
+			if ev.Modifiers()&tcell.ModCtrl != 0 {
+				if !e.moveCursorUntil(down, e.differentIndentness(e.cursor)) {
+					e.bell(BellBoundary)
+				}
+			} else if !e.moveCursor(down) {
+				e.bell(BellBoundary)
+			}
+		case tcell.KeyLeft:
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				selectFrom = e.scrolledCursor()
+			} else if e.collapseSelection(left) {
+				break
+			}
+			if ev.Modifiers()&tcell.ModCtrl != 0 {
+				if !e.moveCursorUntil(left, e.differentWhitespaceness(e.cursor)) {
+					e.bell(BellBoundary)
+				}
+			} else if ev.Modifiers()&tcell.ModAlt != 0 {
+				if !e.moveCursorUntil(left, e.subwordBoundary) {
+					e.bell(BellBoundary)
 				}
+			} else if !e.moveCursor(left) {
+				e.bell(BellBoundary)
+			}
+		case tcell.KeyRight:
+			if ev.Modifiers()&tcell.ModShift != 0 {
+				selectFrom = e.scrolledCursor()
+			} else if e.collapseSelection(right) {
+				break
 			}
-			if storeUndo {
-				if newContent := runesToString(e.rawBuffer); newContent != prevContent {
-					e.undoPatches = append(e.undoPatches, patch{patches: e.differ.PatchMake(newContent, prevContent), cursor: prevCursor})
+			if ev.Modifiers()&tcell.ModCtrl != 0 {
+				if !e.moveCursorUntil(right, e.differentWhitespaceness(e.cursor)) {
+					e.bell(BellBoundary)
 				}
+			} else if ev.Modifiers()&tcell.ModAlt != 0 {
+				if !e.moveCursorUntil(right, e.subwordBoundary) {
+					e.bell(BellBoundary)
+				}
+			} else if !e.moveCursor(right) {
+				e.bell(BellBoundary)
 			}
-			if clearRedo {
-				e.redoPatches = nil
+		case tcell.KeyEsc:
+			selectFrom = nil
+			e.clearSelection()
+			if e.highlightFind {
+				e.highlightFind = false
+				e.redraw()
 			}
-			e.Screen.ShowCursor(e.cursor.x, e.cursor.y)
-			e.Screen.Show()
 		}
 	}
+	if !verticalMove {
+		e.desiredColumn = nil
+	}
+	if e.selecting {
+		if selectFrom == nil {
+			e.selecting = keepSelecting
+		} else {
+			e.replace(true, selectToPattern, "", func(string, segment, segment) bool {
+				return true
+			})
+			e.writeAt([]rune(selectToToken), e.cursor)
+		}
+	} else {
+		if selectFrom != nil {
+			e.selectFrom(*selectFrom)
+		}
+	}
+	if e.batching > 0 {
+		return false
+	}
+	if storeUndo {
+		if typed && e.continuesTyping(prevContent, prevCursor) {
+			e.undoPatches[len(e.undoPatches)-1].patches = e.differ.PatchMake(runesToString(e.rawBuffer), e.typingFrom)
+		} else if e.storeUndoPatch(prevContent, prevCursor) {
+			e.typingFrom = prevContent
+		}
+	}
+	e.typing = typed && storeUndo && !e.SuppressUndo
+	if e.typing {
+		e.typingContent, e.typingCursor, e.typingAt = runesToString(e.rawBuffer), e.rawCursor(), e.now()
+	}
+	e.publishPatch(prevContent)
+	e.notifyChange(prevContent)
+	if clearRedo {
+		e.redoPatches = nil
+	}
+	if observing {
+		e.notify(prevObservation)
+	}
+	if e.statusBarHeight() > 0 || e.HighlightCurrentLine || hadBlock || e.block != nil {
+		// Moving the cursor changes the status bar, the current line and the block selection without changing
+		// the content.
+		e.paint()
+	}
+	e.showCursor()
+	e.Screen.Show()
+	return false
+}
+
+// undo applies the last undo patch, storing a redo patch reverting it, and returns whether the content changed.
+func (e *Editor) undo() bool {
+	if len(e.undoPatches) == 0 {
+		return false
+	}
+	prevContent := runesToString(e.rawBuffer)
+	toApply := e.undoPatches[len(e.undoPatches)-1]
+	e.undoPatches = e.undoPatches[:len(e.undoPatches)-1]
+	newContent, applied := e.differ.PatchApply(toApply.patches, prevContent)
+	if !applied[0] {
+		return false
+	}
+	e.block = nil
+	e.redoPatches = append(e.redoPatches, patch{patches: e.differ.PatchMake(newContent, prevContent), cursor: toApply.cursor})
+	e.rawBuffer = stringToRunes(newContent)
+	e.redraw()
+	e.restoreCursor(toApply.cursor)
+	return newContent != prevContent
+}
+
+// redo applies the last redo patch, storing an undo patch reverting it, and returns whether the content changed.
+func (e *Editor) redo() bool {
+	if len(e.redoPatches) == 0 {
+		return false
+	}
+	prevContent := runesToString(e.rawBuffer)
+	prevCursor := e.rawCursor()
+	toApply := e.redoPatches[len(e.redoPatches)-1]
+	e.redoPatches = e.redoPatches[:len(e.redoPatches)-1]
+	newContent, applied := e.differ.PatchApply(toApply.patches, prevContent)
+	if !applied[0] {
+		return false
+	}
+	e.block = nil
+	e.rawBuffer = stringToRunes(newContent)
+	e.redraw()
+	e.restoreCursor(toApply.cursor)
+	return e.storeUndoPatch(prevContent, prevCursor)
+}
+
+// Undo reverts the last change, like Ctrl-z, and returns whether the content changed.
+func (e *Editor) Undo() bool {
+	return e.changeHistory(e.undo)
+}
+
+// Redo reapplies the last undone change, like Ctrl-y, and returns whether the content changed.
+func (e *Editor) Redo() bool {
+	return e.changeHistory(e.redo)
+}
+
+// save calls OnSave, if set, with the content, and makes it unmodified or shows the error.
+func (e *Editor) save() {
+	if e.OnSave == nil {
+		return
+	}
+	if err := e.OnSave(e.Content()); err != nil {
+		e.statusMessage = err.Error()
+		return
+	}
+	e.ResetModified()
+}
+
+// continuesTyping returns whether runes typed with prevContent and prevCursor continue the typing of the last
+// event, within UndoCoalesceInterval and with nothing else changed in between.
+func (e *Editor) continuesTyping(prevContent string, prevCursor point) bool {
+	return e.typing && len(e.undoPatches) > 0 && prevContent == e.typingContent && prevCursor == e.typingCursor &&
+		e.now().Sub(e.typingAt) < e.UndoCoalesceInterval
+}
+
+func (e *Editor) now() time.Time {
+	if e.clock == nil {
+		return time.Now()
+	}
+	return e.clock()
+}
+
+// storeUndoPatch stores a patch restoring prevContent and prevCursor, if the content has changed and undo
+// isn't suppressed. It returns whether the content has changed.
+func (e *Editor) storeUndoPatch(prevContent string, prevCursor point) bool {
+	newContent := runesToString(e.rawBuffer)
+	if newContent == prevContent {
+		return false
+	}
+	if e.SuppressUndo {
+		return true
+	}
+	e.undoPatches = append(e.undoPatches, patch{patches: e.differ.PatchMake(newContent, prevContent), cursor: prevCursor})
+	if e.MaxUndoSteps > 0 && len(e.undoPatches) > e.MaxUndoSteps {
+		// Reslicing copies nothing, and the dropped patches are collected once append has moved the kept ones
+		// to a new array, which it only does every so many patches.
+		e.undoPatches = e.undoPatches[len(e.undoPatches)-e.MaxUndoSteps:]
+	}
+	return true
+}
+
+// publishPatch calls OnPatch with a patch from prevContent to the content, if it has changed.
+func (e *Editor) publishPatch(prevContent string) {
+	if e.OnPatch == nil {
+		return
+	}
+	newContent := runesToString(e.rawBuffer)
+	if newContent == prevContent {
+		return
+	}
+	e.OnPatch(e.differ.PatchMake(prevContent, newContent), e.rawCursor().position())
+}
+
+// notifyChange calls OnChange if the plain text has changed since prevContent.
+func (e *Editor) notifyChange(prevContent string) {
+	if e.OnChange == nil {
+		return
+	}
+	newContent := runesToString(e.rawBuffer)
+	if newContent == prevContent {
+		return
+	}
+	if plainContent := PlainText(newContent); plainContent != PlainText(prevContent) {
+		e.OnChange(plainContent)
+	}
+}
+
+// ApplyRemotePatch applies a patch from OnPatch of another editor, keeping the cursor on the same text.
+// Patches apply to the text around where they were made even if it has moved, and edits whose
+// surrounding text has changed too much to be found are dropped, keeping the local text, in which case
+// it returns false. Applied patches are not undoable.
+func (e *Editor) ApplyRemotePatch(p []diffmatchpatch.Patch) bool {
+	prevContent := runesToString(e.rawBuffer)
+	newContent, applied := e.differ.PatchApply(p, prevContent)
+	all := true
+	for _, ok := range applied {
+		all = all && ok
+	}
+	if newContent == prevContent {
+		return all
+	}
+	e.block = nil
+	if !e.indexed() {
+		e.rawBuffer = stringToRunes(newContent)
+		e.contentHashed, e.unselectedHashed = false, false
+		return all
+	}
+	var prevObservation observation
+	if e.Observer != nil {
+		prevObservation = e.observe()
+	}
+	cursor := MapPosition(prevContent, newContent, e.rawCursor().position())
+	e.rawBuffer = stringToRunes(newContent)
+	e.redraw()
+	e.restoreCursor(point{x: cursor.Col, y: cursor.Line})
+	e.notifyChange(prevContent)
+	if e.Observer != nil {
+		e.notify(prevObservation)
+	}
+	e.showCursor()
+	e.Screen.Show()
+	return all
+}
+
+// change runs f as a single undoable operation, for methods changing the content outside of handleEvent.
+// Nested changes become part of the outermost one. Before the screen has a size, f runs against a layout
+// too large to wrap, and nothing is painted until a resize gives it a size.
+func (e *Editor) change(f func()) {
+	if e.batching > 0 {
+		f()
+		return
+	}
+	if !e.indexed() {
+		// New doesn't lay out, so a screen that already has a size may not be laid out yet.
+		e.layout()
+	}
+	if !e.indexed() {
+		hasViewport, viewport := e.hasViewport, e.viewport
+		e.hasViewport, e.viewport = true, view{screen: e.Screen, width: unsizedSize, height: unsizedSize}
+		e.layout()
+		e.restoreCursor(e.rawCursor())
+		defer func() {
+			cursor := e.rawCursor()
+			e.hasViewport, e.viewport = hasViewport, viewport
+			e.layout()
+			e.unsizedCursor = &cursor
+		}()
+	}
+	prevContent := runesToString(e.rawBuffer)
+	prevCursor := e.rawCursor()
+	var prevObservation observation
+	if e.Observer != nil {
+		prevObservation = e.observe()
+	}
+	e.batching++
+	f()
+	e.batching--
+	e.desiredColumn = nil
+	if e.storeUndoPatch(prevContent, prevCursor) {
+		e.redoPatches = nil
+	}
+	e.publishPatch(prevContent)
+	e.notifyChange(prevContent)
+	if e.Observer != nil {
+		e.notify(prevObservation)
+	}
+	if e.unsized() {
+		return
+	}
+	e.paint()
+	e.showCursor()
+	e.Screen.Show()
+}
+
+// unsizedSize is the width and height of the layout changes run against before the screen has a size.
+const unsizedSize = 1 << 20
+
+// unsized returns whether the layout is the one changes run against before the screen has a size.
+func (e *Editor) unsized() bool {
+	return e.hasViewport && e.viewport.width == unsizedSize
+}
+
+// changeHistory runs undo or redo like change, but without storing an undo patch for it or forgetting the redo
+// patches.
+func (e *Editor) changeHistory(f func() bool) bool {
+	if !e.indexed() {
+		return false
+	}
+	if e.batching > 0 {
+		return f()
+	}
+	prevContent := runesToString(e.rawBuffer)
+	var prevObservation observation
+	if e.Observer != nil {
+		prevObservation = e.observe()
+	}
+	e.batching++
+	changed := f()
+	e.batching--
+	e.desiredColumn = nil
+	e.typing = false
+	e.publishPatch(prevContent)
+	e.notifyChange(prevContent)
+	if e.Observer != nil {
+		e.notify(prevObservation)
+	}
+	e.paint()
+	e.showCursor()
+	e.Screen.Show()
+	return changed
+}
+
+// Batch runs fn, which may call any methods of the editor including HandleEvent, as a single undoable
+// operation that paints the screen once when done.
+func (e *Editor) Batch(fn func()) {
+	e.change(fn)
+}
+
+type direction uint8
+
+const (
+	up direction = iota
+	left
+	down
+	right
+)
+
+func (d direction) String() string {
+	switch d {
+	case up:
+		return "up"
+	case left:
+		return "left"
+	case down:
+		return "down"
+	case right:
+		return "right"
+	}
+	return fmt.Sprintf("unknown:%v", int(d))
+}
+
+func (e *Editor) canScroll(d direction) bool {
+	switch d {
+	case up:
+		return e.lineOffset > 0
+	case down:
+		return e.lineOffset < e.maxLineOffset()
+	}
+	return false
+}
+
+func (e *Editor) maxLineOffset() int {
+	if e.ScrollPastEnd {
+		return e.maxInt(0, len(e.screenBuffer)-1)
+	}
+	return e.bottomLineOffset()
+}
+
+// bottomLineOffset returns the line offset that puts the last line at the bottom of the screen.
+func (e *Editor) bottomLineOffset() int {
+	_, height := e.textView().Size()
+	return e.maxInt(0, len(e.screenBuffer)-height)
+}
+
+// ScrollToBottom scrolls so that the last line is at the bottom of the screen.
+func (e *Editor) ScrollToBottom() {
+	defer e.Screen.Show()
+	e.lineOffset = e.bottomLineOffset()
+	e.redraw()
+	e.setCursor()
+}
+
+// EnsureVisible scrolls as little as possible to have the cursor on the screen, for example after the content
+// was changed to fewer lines than were scrolled past.
+func (e *Editor) EnsureVisible() {
+	defer e.Screen.Show()
+	e.scrollAroundCursor(func(row, height int) int {
+		if row < e.lineOffset {
+			return row
+		}
+		if row >= e.lineOffset+height {
+			return row - height + 1
+		}
+		return e.lineOffset
+	})
+}
+
+// CenterCursor scrolls to have the cursor in the middle of the screen, like Ctrl-l, or as close to it as
+// scrolling allows.
+func (e *Editor) CenterCursor() {
+	defer e.Screen.Show()
+	e.centerCursor()
+}
+
+func (e *Editor) centerCursor() {
+	e.scrollAroundCursor(func(row, height int) int {
+		return row - height/2
+	})
+}
+
+// scrollAroundCursor scrolls to the line offset returned for the screenBuffer row of the cursor, clamped to
+// the content, and keeps the cursor on that row.
+func (e *Editor) scrollAroundCursor(offset func(row, height int) int) {
+	_, height := e.textView().Size()
+	if !e.indexed() || height == 0 {
+		return
+	}
+	row := e.cursor.y + e.lineOffset
+	e.limitInt(&row, 0, len(e.screenBuffer))
+	e.lineOffset = offset(row, height)
+	e.limitInt(&e.lineOffset, 0, e.maxLineOffset()+1)
+	e.redraw()
+	e.cursor.y = row - e.lineOffset
+	e.setCursor()
+	e.showCursor()
 }
 
-type direction uint8
-
-const (
-	up direction = iota
-	left
-	down
-	right
-)
-
-func (d direction) String() string {
-	switch d {
-	case up:
-		return "up"
-	case left:
-		return "left"
-	case down:
-		return "down"
-	case right:
-		return "right"
+// IsVisible returns whether the raw position, or the first visible rune after it, is on the screen.
+func (e *Editor) IsVisible(rawLine, rawCol int) bool {
+	if !e.indexed() || rawLine < 0 || rawLine >= len(e.rawBuffer) || rawCol < 0 || rawCol > len(e.rawBuffer[rawLine]) {
+		return false
 	}
-	return fmt.Sprintf("unknown:%v", int(d))
+	_, height := e.textView().Size()
+	p := e.screenBufferPoint(point{x: rawCol, y: rawLine})
+	return p.y >= e.lineOffset && p.y < e.lineOffset+height
 }
 
-func (e *Editor) canScroll(d direction) bool {
-	switch d {
-	case up:
-		return e.lineOffset > 0
-	case down:
-		_, height := e.Screen.Size()
-		return e.lineOffset+1 < len(e.screenBuffer)-height/2
+// ScrollFraction returns how far through the document the screen is scrolled, from 0.0 at the top
+// to 1.0 at the bottom. If the entire document fits on the screen it returns 1.0.
+func (e *Editor) ScrollFraction() float64 {
+	_, height := e.textView().Size()
+	maxOffset := e.maxLineOffset()
+	if maxOffset == 0 || (e.lineOffset == 0 && len(e.screenBuffer) <= height) {
+		return 1.0
 	}
-	return false
+	return float64(e.lineOffset) / float64(maxOffset)
 }
 
 func (e *Editor) scroll(d direction) {
-	width, height := e.Screen.Size()
+	width, height := e.textView().Size()
 	if width == 0 || height == 0 {
 		return
 	}
@@ -757,7 +3754,7 @@ func (e *Editor) scroll(d direction) {
 	case down:
 		e.lineOffset++
 	}
-	e.limitInt(&e.lineOffset, 0, len(e.screenBuffer)-height/2)
+	e.limitInt(&e.lineOffset, 0, e.maxLineOffset()+1)
 	e.redraw()
 }
 
@@ -767,9 +3764,11 @@ func (e *Editor) moveCursor(d direction) bool {
 	case up:
 		if e.canMoveCursor(up) {
 			e.cursor.y--
+			e.cursor.x = e.verticalColumn()
 			return true
 		} else if e.canScroll(up) {
 			e.scroll(up)
+			e.cursor.x = e.verticalColumn()
 			return true
 		}
 	case left:
@@ -788,14 +3787,19 @@ func (e *Editor) moveCursor(d direction) bool {
 	case down:
 		if e.canMoveCursor(down) {
 			e.cursor.y++
+			e.cursor.x = e.verticalColumn()
 			return true
 		} else if e.canScroll(down) {
 			e.scroll(down)
+			e.cursor.x = e.verticalColumn()
 			return true
 		}
 	case right:
 		if e.canMoveCursor(right) {
 			e.cursor.x++
+			for e.continuation(*e.scrolledCursor()) {
+				e.cursor.x++
+			}
 			return true
 		} else if e.canMoveCursor(down) {
 			e.cursor.y++
@@ -810,6 +3814,16 @@ func (e *Editor) moveCursor(d direction) bool {
 	return false
 }
 
+// verticalColumn returns the column moving up or down puts the cursor at, before clamping it to the row, and
+// remembers it for the next such move.
+func (e *Editor) verticalColumn() int {
+	if e.desiredColumn == nil {
+		x := e.cursor.x
+		e.desiredColumn = &x
+	}
+	return *e.desiredColumn
+}
+
 func (e *Editor) limitInt(i *int, minInc, maxExc int) {
 	if *i < minInc {
 		*i = minInc
@@ -839,6 +3853,17 @@ func (e *Editor) maxInt(i ...int) int {
 	return res
 }
 
+// rowTextStart returns the column of the first non-whitespace rune of a screen row, or the width of the row if
+// it is blank.
+func (e *Editor) rowTextStart(y int) int {
+	for x, r := range e.screenBuffer[y+e.lineOffset] {
+		if !unicode.IsSpace(r) {
+			return x
+		}
+	}
+	return e.lineWidth(y)
+}
+
 func (e *Editor) lineWidth(y int) int {
 	if y+e.lineOffset < len(e.screenBuffer) {
 		return len(e.screenBuffer[y+e.lineOffset])
@@ -846,17 +3871,31 @@ func (e *Editor) lineWidth(y int) int {
 	return 0
 }
 
+// rowEnd returns the last column the cursor can be at on a screen row, which is after the last rune unless the
+// raw line continues on the next row, where that position is.
+func (e *Editor) rowEnd(y int) int {
+	row := y + e.lineOffset
+	if row+1 < len(e.screenBufferIndex) && e.screenBufferIndex[row+1][0].y == e.screenBufferIndex[row][0].y {
+		return e.maxInt(0, e.lineWidth(y)-1)
+	}
+	return e.lineWidth(y)
+}
+
 func (e *Editor) setCursor() {
-	width, height := e.Screen.Size()
+	width, height := e.textView().Size()
 	if width == 0 || height == 0 {
 		return
 	}
 	e.limitInt(&e.cursor.y, 0, e.minInt(height, len(e.screenBuffer)-e.lineOffset))
-	e.limitInt(&e.cursor.x, 0, e.minInt(width, e.lineWidth(e.cursor.y)+1))
+	e.limitInt(&e.cursor.x, 0, e.minInt(width, e.rowEnd(e.cursor.y)+1))
+	// The cursor stays on the first cell of tabs.
+	for e.cursor.y+e.lineOffset < len(e.screenBuffer) && e.continuation(*e.scrolledCursor()) {
+		e.cursor.x--
+	}
 }
 
 func (e *Editor) canMoveCursor(d direction) bool {
-	width, height := e.Screen.Size()
+	width, height := e.textView().Size()
 	switch d {
 	case up:
 		return e.cursor.y > 0
@@ -865,7 +3904,7 @@ func (e *Editor) canMoveCursor(d direction) bool {
 	case down:
 		return e.cursor.y+1 < height && e.cursor.y+e.lineOffset < len(e.screenBuffer)-1
 	case right:
-		return e.cursor.x+1 < width && e.cursor.x < e.lineWidth(e.cursor.y)
+		return e.cursor.x+1 < width && e.cursor.x < e.rowEnd(e.cursor.y)
 	}
 	return false
 }
@@ -880,6 +3919,139 @@ type token struct {
 	start       bool
 	selectStart bool
 	selectEnd   bool
+	err         *ParseError
+}
+
+// Edit replaces the content of a Span with Text.
+type Edit struct {
+	Span Span
+	Text string
+}
+
+// Observer is told what the editor did. Positions are raw positions in the content without the selection tokens.
+type Observer interface {
+	// OnEdit is called with EditInsert and the inserted span of the new content, or with EditDelete or
+	// EditReplace and the removed or replaced span of the old content.
+	OnEdit(kind string, from, to Position)
+	OnCursorMove(p Position)
+	// OnSelectionChange is called with the selected span, which is empty when the selection is removed.
+	OnSelectionChange(from, to Position)
+}
+
+const (
+	EditInsert  = "insert"
+	EditDelete  = "delete"
+	EditReplace = "replace"
+)
+
+// observation is the state of the editor that notify compares to tell the Observer what changed.
+type observation struct {
+	content   []rune
+	cursor    Position
+	selection Span
+}
+
+// observe returns the observation of the current state.
+func (e *Editor) observe() observation {
+	raw := runesToString(e.rawBuffer)
+	// Rune offsets in raw of the start and end of each selection token.
+	tokens := [][2]int{}
+	for _, loc := range selectTokenPattern.FindAllStringIndex(raw, -1) {
+		tokens = append(tokens, [2]int{len([]rune(raw[:loc[0]])), len([]rune(raw[:loc[1]]))})
+	}
+	// stripped returns the offset in the content without the tokens of an offset in raw.
+	stripped := func(offset int) int {
+		res := offset
+		for _, token := range tokens {
+			if token[0] < offset {
+				res -= e.minInt(token[1], offset) - token[0]
+			}
+		}
+		return res
+	}
+	content := []rune(selectTokenPattern.ReplaceAllString(raw, ""))
+	res := observation{
+		content: content,
+		cursor:  offsetPosition(content, stripped(positionOffset([]rune(raw), e.rawCursor().position()))),
+	}
+	if len(tokens) == 2 {
+		res.selection = Span{
+			From: offsetPosition(content, stripped(tokens[0][0])),
+			To:   offsetPosition(content, stripped(tokens[1][0])),
+		}
+	}
+	return res
+}
+
+// notify tells the Observer the differences between an earlier observation and the current state.
+func (e *Editor) notify(prev observation) {
+	current := e.observe()
+	if string(prev.content) != string(current.content) {
+		prefix := 0
+		for prefix < len(prev.content) && prefix < len(current.content) && prev.content[prefix] == current.content[prefix] {
+			prefix++
+		}
+		suffix := 0
+		for suffix < len(prev.content)-prefix && suffix < len(current.content)-prefix && prev.content[len(prev.content)-1-suffix] == current.content[len(current.content)-1-suffix] {
+			suffix++
+		}
+		if removed := len(prev.content) - prefix - suffix; removed == 0 {
+			e.Observer.OnEdit(EditInsert, offsetPosition(current.content, prefix), offsetPosition(current.content, len(current.content)-suffix))
+		} else if len(current.content)-prefix-suffix == 0 {
+			e.Observer.OnEdit(EditDelete, offsetPosition(prev.content, prefix), offsetPosition(prev.content, prefix+removed))
+		} else {
+			e.Observer.OnEdit(EditReplace, offsetPosition(prev.content, prefix), offsetPosition(prev.content, prefix+removed))
+		}
+	}
+	if prev.selection != current.selection {
+		e.Observer.OnSelectionChange(current.selection.From, current.selection.To)
+	}
+	if prev.cursor != current.cursor {
+		e.Observer.OnCursorMove(current.cursor)
+	}
+}
+
+// positionOffset returns the offset in content of a position.
+func positionOffset(content []rune, p Position) int {
+	offset := 0
+	for line := 0; line < p.Line && offset < len(content); offset++ {
+		if content[offset] == '\n' {
+			line++
+		}
+	}
+	return offset + p.Col
+}
+
+// offsetPosition returns the position of an offset in content.
+func offsetPosition(content []rune, offset int) Position {
+	res := Position{}
+	for _, r := range content[:offset] {
+		if r == '\n' {
+			res.Line++
+			res.Col = 0
+		} else {
+			res.Col++
+		}
+	}
+	return res
+}
+
+// Symbol is a named position in the content, like a function or a heading, found by a SymbolProvider.
+type Symbol struct {
+	Name     string
+	Kind     string
+	Position Position
+}
+
+// ParseError describes malformed markup at a raw position.
+type ParseError struct {
+	Line    int
+	Col     int
+	Message string
+}
+
+func (p *ParseError) Error() string {
+	return fmt.Sprintf("%v:%v: %v", p.Line+1, p.Col+1, p.Message)
 }
 
 func (t *token) eq(o *token) (bool, error) {
@@ -922,6 +4094,12 @@ func (t *token) eq(o *token) (bool, error) {
 	if t.selectEnd != o.selectEnd {
 		return false, fmt.Errorf("selectEnd %v != %v", t.selectEnd, o.selectEnd)
 	}
+	if t.err != nil && o.err != nil && *t.err != *o.err {
+		return false, fmt.Errorf("err %+v != %+v", *t.err, *o.err)
+	}
+	if (t.err == nil) != (o.err == nil) {
+		return false, fmt.Errorf("err %+v != %+v", t.err, o.err)
+	}
 	return true, nil
 }
 
@@ -971,6 +4149,12 @@ func (t *token) setStyle(s tcell.Style) *token {
 	return t
 }
 
+func (t *token) setErr(format string, args ...interface{}) *token {
+	t.reset()
+	t.err = &ParseError{Line: t.pos.y, Col: t.pos.x, Message: fmt.Sprintf(format, args...)}
+	return t
+}
+
 type parseState int
 
 const (
@@ -979,6 +4163,32 @@ const (
 	tag
 )
 
+// isEntityRune returns whether r can follow the '&' of an entity.
+func isEntityRune(r rune) bool {
+	return r == '#' || r == ';' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// decodeEntity returns the rune of one of entities, or of a numeric entity like "&#39;" or "&#x27;".
+func decodeEntity(entities []Entity, name string) (rune, bool) {
+	for _, entity := range entities {
+		if entity.Name == name {
+			return entity.Rune, true
+		}
+	}
+	if !strings.HasPrefix(name, "&#") || !strings.HasSuffix(name, ";") {
+		return 0, false
+	}
+	digits, base := name[2:len(name)-1], 10
+	if strings.HasPrefix(digits, "x") || strings.HasPrefix(digits, "X") {
+		digits, base = digits[1:], 16
+	}
+	n, err := strconv.ParseUint(digits, base, 32)
+	if err != nil || !utf8.ValidRune(rune(n)) {
+		return 0, false
+	}
+	return rune(n), true
+}
+
 func (p parseState) String() string {
 	switch p {
 	case visible:
@@ -991,10 +4201,14 @@ func (p parseState) String() string {
 	return "unknown"
 }
 
-func parseTokens(buffer [][]rune, rawCB func(*token)) {
-	state := visible
+func parseTokens(entities []Entity, buffer [][]rune, rawCB func(*token)) {
+	parseTokensFrom(entities, buffer, 0, false, point{}, rawCB)
+}
 
-	inSelection := false
+// parseTokensFrom parses buffer from the start of line fromLine, which is inside a selection started at
+// selectionPos if inSelection.
+func parseTokensFrom(entities []Entity, buffer [][]rune, fromLine int, inSelection bool, selectionPos point, rawCB func(*token)) {
+	state := visible
 
 	t := &token{}
 	line := []rune{}
@@ -1004,10 +4218,27 @@ func parseTokens(buffer [][]rune, rawCB func(*token)) {
 		rawCB(t)
 		t.buffer = nil
 	}
+	// Malformed entities are reported, and their runes shown as they are.
+	literal := func(format string) {
+		runes, x := t.buffer, t.pos.x
+		t.buffer = nil
+		cb(t.setErr(format, string(runes)))
+		for idx, r := range runes {
+			t.pos.x, t.buffer = x+idx, []rune{r}
+			cb(t.setRune(r))
+		}
+	}
 
-	cb(t.setStart())
-	for t.pos.y, line = range buffer {
+	if fromLine == 0 {
+		cb(t.setStart())
+	}
+	for y := fromLine; y < len(buffer); y++ {
+		t.pos.y, line = y, buffer[y]
 		for tmpX, r = range line {
+			if state == escape && !isEntityRune(r) {
+				literal("unterminated entity %q")
+				state = visible
+			}
 			t.buffer = append(t.buffer, r)
 			switch state {
 			case visible:
@@ -1023,16 +4254,10 @@ func parseTokens(buffer [][]rune, rawCB func(*token)) {
 			case escape:
 				switch r {
 				case ';':
-					switch string(t.buffer) {
-					case "&amp;":
-						cb(t.setRune('&'))
-						state = visible
-					case "&lt;":
-						cb(t.setRune('<'))
-						state = visible
-					case "&gt;":
-						cb(t.setRune('>'))
-						state = visible
+					if decoded, ok := decodeEntity(entities, string(t.buffer)); ok {
+						cb(t.setRune(decoded))
+					} else {
+						literal("unknown entity %q")
 					}
 					state = visible
 				}
@@ -1044,6 +4269,7 @@ func parseTokens(buffer [][]rune, rawCB func(*token)) {
 						if inSelection {
 							cb(t.setSelectEnd())
 						} else {
+							selectionPos = t.pos
 							cb(t.setSelectStart())
 						}
 						inSelection = !inSelection
@@ -1054,41 +4280,202 @@ func parseTokens(buffer [][]rune, rawCB func(*token)) {
 							if fgErr == nil && bgErr == nil {
 								cb(t.setStyle(tcell.StyleDefault.Foreground(tcell.NewHexColor(int32(fgUint))).Background(tcell.NewHexColor(int32(bgUint)))))
 							}
+						} else if strings.HasPrefix(string(t.buffer), "<color:") {
+							cb(t.setErr("invalid color tag %q", string(t.buffer)))
+						} else {
+							cb(t.setErr("unknown tag %q", string(t.buffer)))
 						}
 					}
 					state = visible
 				}
 			}
 		}
+		switch state {
+		case escape:
+			literal("unterminated entity %q")
+		case tag:
+			cb(t.setErr("unterminated tag %q", string(t.buffer)))
+		}
 		if t.pos.y+1 < len(buffer) {
 			t.pos.x = tmpX + 1
 			cb(t.setNewLine())
 			state = visible
 		}
 	}
+	if inSelection {
+		eofPos := t.pos
+		t.pos = selectionPos
+		cb(t.setErr("unbalanced selection token"))
+		t.pos = eofPos
+	}
 	t.pos.x = tmpX + 1
 	cb(t.setEof())
 }
 
 func (e *Editor) redraw() {
-	e.screenBuffer = nil
-	e.screenBufferIndex = nil
+	e.layout()
+	if e.batching == 0 && !e.unsized() {
+		e.paint()
+	}
+}
+
+// layoutParams are what layout depends on apart from rawBuffer, which make it lay out every line again when
+// they change.
+type layoutParams struct {
+	wrapWidth       int
+	wrapAtWords     bool
+	tabWidth        int
+	lineLengthLimit int
+	lineLengthStyle tcell.Style
+	candidate       segment
+	hasCandidate    bool
+	find            string
+	findCase        bool
+	findStyle       tcell.Style
+	highlighting    bool
+	style           tcell.Style
+	selectStyle     tcell.Style
+}
+
+// lineLayout is the state of layout at the start of a raw line, which it resumes from when only that line
+// or later lines have changed.
+type lineLayout struct {
+	// The first screenBuffer line of the raw line.
+	row              int
+	style, prevStyle tcell.Style
+	inSelection      bool
+	selectionPos     point
+}
+
+func runesEqual(a, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// firstChangedLine returns the first raw line that changed since the last layout, or 0 if params changed.
+func (e *Editor) firstChangedLine(params layoutParams) int {
+	if e.laidOut == nil || params != e.laidOutParams {
+		return 0
+	}
+	// Matches of Find spanning lines change with lines after them.
+	if strings.Contains(params.find, "\n") {
+		return 0
+	}
+	res := 0
+	for res < len(e.rawBuffer) && res < len(e.laidOut) && runesEqual(e.rawBuffer[res], e.laidOut[res]) {
+		res++
+	}
+	if res == len(e.rawBuffer) && res == len(e.laidOut) {
+		return res
+	}
+	// The last line ends differently when lines are added or removed after it.
+	return e.minInt(res, len(e.rawBuffer)-1, len(e.lineLayouts)-1)
+}
 
+// layout rebuilds screenBuffer, screenBufferIndex and styleIndex from rawBuffer, from the first line that
+// changed since the last layout.
+func (e *Editor) layout() {
 	// No screen makes it impossible to index.
-	width, height := e.Screen.Size()
+	width, height := e.textView().Size()
 	if width == 0 || height == 0 {
+		e.screenBuffer = nil
+		e.screenBufferIndex = nil
+		e.styleIndex = nil
+		e.laidOut = nil
+		e.contentHashed, e.unselectedHashed = false, false
+		return
+	}
+
+	wrapWidth := width
+	if e.ScrollIndicators {
+		wrapWidth--
+	}
+
+	params := layoutParams{
+		wrapWidth:       wrapWidth,
+		wrapAtWords:     e.WrapAtWords,
+		tabWidth:        e.tabWidth(),
+		lineLengthLimit: e.LineLengthLimit,
+		lineLengthStyle: e.lineLengthStyle(),
+		findStyle:       e.searchHighlightStyle(),
+		highlighting:    e.Highlighter != nil,
+		style:           e.defaultStyle(),
+		selectStyle:     e.selectionStyle(),
+	}
+	if e.candidate != nil {
+		params.candidate, params.hasCandidate = *e.candidate, true
+	}
+	if e.highlightFind {
+		params.find, params.findCase = e.lastFind, e.lastFindCaseInsensitive
+	}
+	first := e.firstChangedLine(params)
+	if first == len(e.rawBuffer) {
+		e.limitInt(&e.lineOffset, 0, len(e.screenBuffer))
 		return
 	}
+	e.contentHashed, e.unselectedHashed = false, false
+	laidOut := make([][]rune, len(e.rawBuffer))
+	for idx, line := range e.rawBuffer {
+		if idx < first {
+			laidOut[idx] = e.laidOut[idx]
+		} else {
+			laidOut[idx] = append([]rune(nil), line...)
+		}
+	}
+	e.laidOut, e.laidOutParams = laidOut, params
 
-	style := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorWhite)
-	selectStyle := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
-	prevStyle := style
-	styleIndex := [][]tcell.Style{}
+	style := e.defaultStyle()
+	selectStyle := e.selectionStyle()
+	resumed := lineLayout{style: style, prevStyle: style}
+	if first > 0 {
+		resumed = e.lineLayouts[first]
+	}
+	e.screenBuffer = e.screenBuffer[:resumed.row]
+	e.screenBufferIndex = e.screenBufferIndex[:resumed.row]
+	e.styleIndex = e.styleIndex[:resumed.row]
+	e.lineLayouts = e.lineLayouts[:first]
+	style, prevStyle := resumed.style, resumed.prevStyle
+	inSelection, selectionPos := resumed.inSelection, resumed.selectionPos
+	// Visible column in the raw line, which continues across wrapped screen lines.
+	column := 0
+	// Raw segments of the matches of the last Find, in order, and the first one not yet passed.
+	findMatches := []segment{}
+	if e.highlightFind && e.lastFind != "" {
+		replace(e.entities(), e.rawBuffer, false, findPattern(e.lastFind, e.lastFindCaseInsensitive), "", func(_ string, rawSeg, _ segment) bool {
+			findMatches = append(findMatches, rawSeg)
+			return false
+		})
+	}
+	findMatchIdx := 0
+	// Styles from the Highlighter for the current raw line, and the visible rune of it being laid out.
+	var highlights []tcell.Style
+	visibleIdx := 0
 
 	beginLine := func() {
 		e.screenBuffer = append(e.screenBuffer, nil)
 		e.screenBufferIndex = append(e.screenBufferIndex, nil)
-		styleIndex = append(styleIndex, nil)
+		e.styleIndex = append(e.styleIndex, nil)
+	}
+	beginRawLine := func(rawLineIdx int) {
+		beginLine()
+		if e.Highlighter != nil {
+			highlights = e.Highlighter(plain(e.entities(), [][]rune{e.rawBuffer[rawLineIdx]})[0], rawLineIdx)
+		}
+		visibleIdx = 0
+		e.lineLayouts = append(e.lineLayouts, lineLayout{
+			row:          len(e.screenBuffer) - 1,
+			style:        style,
+			prevStyle:    prevStyle,
+			inSelection:  inSelection,
+			selectionPos: selectionPos,
+		})
 	}
 	endLine := func(rawLineIdx int) {
 		e.screenBufferIndex[len(e.screenBufferIndex)-1] = append(
@@ -1100,38 +4487,162 @@ func (e *Editor) redraw() {
 		)
 	}
 
-	parseTokens(e.rawBuffer, func(t *token) {
+	if first > 0 {
+		beginRawLine(first)
+	}
+	parseTokensFrom(e.entities(), e.rawBuffer, first, inSelection, selectionPos, func(t *token) {
 		if t.start {
-			beginLine()
+			beginRawLine(first)
 		} else if t.newLine {
 			endLine(t.pos.y)
-			beginLine()
+			beginRawLine(t.pos.y + 1)
+			column = 0
 		} else if t.rune != nil {
-			e.screenBuffer[len(e.screenBuffer)-1] = append(e.screenBuffer[len(e.screenBuffer)-1], *t.rune)
-			e.screenBufferIndex[len(e.screenBufferIndex)-1] = append(e.screenBufferIndex[len(e.screenBufferIndex)-1], t.pos)
-			styleIndex[len(styleIndex)-1] = append(styleIndex[len(styleIndex)-1], style)
-			if len(e.screenBuffer[len(e.screenBuffer)-1]) > width-1 {
+			runeStyle := style
+			if visibleIdx < len(highlights) && highlights[visibleIdx] != tcell.StyleDefault && style != selectStyle {
+				runeStyle = highlights[visibleIdx]
+			}
+			visibleIdx++
+			if e.LineLengthLimit > 0 && column >= e.LineLengthLimit && style != selectStyle {
+				runeStyle = e.lineLengthStyle()
+			}
+			for findMatchIdx < len(findMatches) && !t.pos.before(findMatches[findMatchIdx][1]) {
+				findMatchIdx++
+			}
+			if findMatchIdx < len(findMatches) && !t.pos.before(findMatches[findMatchIdx][0]) && style != selectStyle {
+				runeStyle = e.searchHighlightStyle()
+			}
+			if e.candidate != nil && !t.pos.before(e.candidate[0]) && t.pos.before(e.candidate[1]) {
+				runeStyle = selectStyle
+			}
+			// Tabs are spaces to the next tab stop, or to the end of the screen line, and wide runes are
+			// followed by an unpainted 0 cell, all indexed to the rune.
+			cell, cells, continuationCell := *t.rune, 1, rune(0)
+			if cell == '\t' {
+				cell, continuationCell = ' ', ' '
+				cells = e.minInt(e.tabWidth()-column%e.tabWidth(), wrapWidth-len(e.screenBuffer[len(e.screenBuffer)-1]))
+			} else if runewidth.RuneWidth(cell) == 2 {
+				cells = 2
+				// Wide runes that don't fit move to the next screen line.
+				if used := len(e.screenBuffer[len(e.screenBuffer)-1]); used > 0 && used+cells > wrapWidth {
+					endLine(t.pos.y)
+					beginLine()
+				}
+			}
+			for ; cells > 0; cells-- {
+				column++
+				e.screenBuffer[len(e.screenBuffer)-1] = append(e.screenBuffer[len(e.screenBuffer)-1], cell)
+				e.screenBufferIndex[len(e.screenBufferIndex)-1] = append(e.screenBufferIndex[len(e.screenBufferIndex)-1], t.pos)
+				e.styleIndex[len(e.styleIndex)-1] = append(e.styleIndex[len(e.styleIndex)-1], runeStyle)
+				cell = continuationCell
+			}
+			if row := len(e.screenBuffer) - 1; len(e.screenBuffer[row]) > wrapWidth-1 {
+				// The word after the last whitespace moves to the next screen line.
+				word := 0
+				if e.WrapAtWords {
+					for word < len(e.screenBuffer[row]) && !unicode.IsSpace(e.screenBuffer[row][len(e.screenBuffer[row])-1-word]) {
+						word++
+					}
+					if word == len(e.screenBuffer[row]) {
+						word = 0
+					}
+				}
+				cut := len(e.screenBuffer[row]) - word
+				runes := append([]rune(nil), e.screenBuffer[row][cut:]...)
+				index := append([]point(nil), e.screenBufferIndex[row][cut:]...)
+				styles := append([]tcell.Style(nil), e.styleIndex[row][cut:]...)
+				e.screenBuffer[row] = e.screenBuffer[row][:cut]
+				e.screenBufferIndex[row] = e.screenBufferIndex[row][:cut]
+				e.styleIndex[row] = e.styleIndex[row][:cut]
 				endLine(t.pos.y)
 				beginLine()
+				e.screenBuffer[row+1] = runes
+				e.screenBufferIndex[row+1] = index
+				e.styleIndex[row+1] = styles
 			}
 		} else if t.style != nil {
 			style = *t.style
 		} else if t.eof {
 			endLine(t.pos.y)
 		} else if t.selectStart {
+			inSelection, selectionPos = true, t.pos
 			prevStyle = style
 			style = selectStyle
 		} else if t.selectEnd {
+			inSelection = false
 			style = prevStyle
 		}
 	})
+	// Content shrinking, for example by undo, may have left the offset past the last line.
+	e.limitInt(&e.lineOffset, 0, len(e.screenBuffer))
+}
+
+// paint draws the visible part of screenBuffer, and any popups, on the screen.
+func (e *Editor) paint() {
+	e.draw(e.view())
+}
+
+// draw draws what paint shows on the screen on c.
+func (e *Editor) draw(c canvas) {
+	width, height := c.Size()
+	if width == 0 || height == 0 {
+		return
+	}
+
+	height -= e.statusBarHeight()
+	e.drawStatusBar(c)
+	gutter := e.gutterWidth()
+	for y := 0; y < height && gutter > 0; y++ {
+		number := []rune(strings.Repeat(" ", gutter))
+		if row := y + e.lineOffset; row < len(e.screenBufferIndex) {
+			line := e.screenBufferIndex[row][len(e.screenBufferIndex[row])-1].y
+			// Wrapped lines are numbered only on their first screen line.
+			if row == 0 || e.screenBufferIndex[row-1][len(e.screenBufferIndex[row-1])-1].y != line {
+				number = []rune(fmt.Sprintf("%*d ", gutter-1, line+1))
+			}
+		}
+		for x, r := range number {
+			c.SetContent(x, y, r, nil, e.DefaultStyle)
+		}
+	}
+	v := shiftedCanvas{canvas: c, x: gutter, width: width - gutter, height: height}
+	width -= gutter
 
+	currentLine := -1
+	if row := e.cursor.y + e.lineOffset; e.HighlightCurrentLine && !e.unfocused && row < len(e.screenBufferIndex) {
+		currentLine = e.screenBufferIndex[row][0].y
+	}
+	_, currentBackground, _ := e.currentLineStyle().Decompose()
+	blockCells := map[point]bool{}
+	if e.block != nil && e.cursorIndexed() {
+		from, _ := e.blockBounds()
+		for idx, spans := range e.blockSpans() {
+			for _, span := range spans {
+				blockCells[point{x: span.start, y: from.y + idx}] = true
+			}
+		}
+	}
 	for screenLineIdx, screenLine := range e.screenBuffer[e.lineOffset:] {
+		current := e.screenBufferIndex[screenLineIdx+e.lineOffset][0].y == currentLine
 		for screenRuneIdx, screenRune := range screenLine {
-			e.Screen.SetContent(screenRuneIdx, screenLineIdx, screenRune, nil, styleIndex[screenLineIdx+e.lineOffset][screenRuneIdx])
+			if screenRune == 0 {
+				continue
+			}
+			style := e.styleIndex[screenLineIdx+e.lineOffset][screenRuneIdx]
+			if blockCells[e.screenBufferIndex[screenLineIdx+e.lineOffset][screenRuneIdx]] {
+				style = e.selectionStyle()
+			}
+			if current && style != e.selectionStyle() && style != e.searchHighlightStyle() && style != e.lineLengthStyle() {
+				style = style.Background(currentBackground)
+			}
+			v.SetContent(screenRuneIdx, screenLineIdx, screenRune, nil, style)
+		}
+		blank := e.DefaultStyle
+		if current {
+			blank = e.currentLineStyle()
 		}
 		for x := len(screenLine); x < width; x++ {
-			e.Screen.SetContent(x, screenLineIdx, ' ', nil, tcell.StyleDefault)
+			v.SetContent(x, screenLineIdx, ' ', nil, blank)
 		}
 		if screenLineIdx+1 > height-1 {
 			break
@@ -1139,21 +4650,40 @@ func (e *Editor) redraw() {
 	}
 	for y := len(e.screenBuffer) - e.lineOffset; y < height; y++ {
 		for x := 0; x < width; x++ {
-			e.Screen.SetContent(x, y, ' ', nil, tcell.StyleDefault)
+			v.SetContent(x, y, ' ', nil, e.DefaultStyle)
+		}
+	}
+	if e.ScrollIndicators {
+		if e.canScroll(up) {
+			v.SetContent(width-1, 0, '↑', nil, tcell.StyleDefault)
+		}
+		if e.canScroll(down) {
+			v.SetContent(width-1, height-1, '↓', nil, tcell.StyleDefault)
 		}
 	}
 	for _, popup := range e.popups {
-		popup.draw(e.Screen)
+		popup.draw(c)
+	}
+	if e.prompt != nil {
+		e.prompt.draw(c)
 	}
 	if !e.hideHelp {
-		msg := DefaultHelpMessage
-		if e.HelpMessage != "" {
-			msg = e.HelpMessage
-		}
 		(&popup{
-			message: msg,
-		}).draw(e.Screen)
+			message: e.helpMessage(),
+		}).draw(c)
+	}
+}
+
+// helpMessage returns HelpMessage, or DefaultHelpMessage with the Tab line following TabWidth and UseHardTabs.
+func (e *Editor) helpMessage() string {
+	if e.HelpMessage != "" {
+		return e.HelpMessage
 	}
+	tab := fmt.Sprintf("Tab: Insert spaces to next %v-wide tab", e.tabWidth())
+	if e.UseHardTabs {
+		tab = "Tab: Insert a tab"
+	}
+	return strings.Replace(DefaultHelpMessage, "Tab: Insert spaces to next 4-wide tab", tab, 1)
 }
 
 func stringToRunes(s string) [][]rune {
@@ -1168,25 +4698,221 @@ func (e *Editor) setRaw(s string) {
 	e.rawBuffer = stringToRunes(s)
 }
 
+// Validate returns a *ParseError for each piece of malformed markup in the content.
+func (e *Editor) Validate() []error {
+	res := []error{}
+	parseTokens(e.entities(), e.rawBuffer, func(t *token) {
+		if t.err != nil {
+			res = append(res, t.err)
+		}
+	})
+	return res
+}
+
+// Content returns the content, with the line ending of LineEnding.
 func (e *Editor) Content() string {
-	return runesToString(e.rawBuffer)
+	content := runesToString(e.rawBuffer)
+	if ending := e.lineEnding(); ending != "\n" {
+		return strings.ReplaceAll(content, "\n", ending)
+	}
+	return content
+}
+
+// lineEnding returns the line ending forced by LineEnding, or the one detected when loading the content.
+func (e *Editor) lineEnding() string {
+	switch e.LineEnding {
+	case "\n", "\r\n":
+		return e.LineEnding
+	}
+	if e.detectedLineEnding == "" {
+		return "\n"
+	}
+	return e.detectedLineEnding
+}
+
+// load detects the line ending of s, and returns s with only "\n" line endings for editing.
+func (e *Editor) load(s string) string {
+	crlf := strings.Count(s, "\r\n")
+	e.detectedLineEnding = "\n"
+	if crlf > strings.Count(s, "\n")-crlf {
+		e.detectedLineEnding = "\r\n"
+	}
+	return strings.ReplaceAll(s, "\r\n", "\n")
 }
 
+// ContentHash returns a hash of Content, which is cheap to call repeatedly between changes.
+func (e *Editor) ContentHash() uint64 {
+	// Content depends on LineEnding, which changes without a layout.
+	if ending := e.lineEnding(); !e.contentHashed || ending != e.contentHashEnding {
+		e.contentHash = hashString(e.Content())
+		e.contentHashed, e.contentHashEnding = true, ending
+	}
+	return e.contentHash
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// contentUpdate is the data of the interrupt events posted by PostContent.
+type contentUpdate string
+
+// PostContent makes the edit loop replace the content like SetContent, and is, unlike the other methods, safe to
+// call from other goroutines while Edit runs. It blocks until the screen has room for the update.
+func (e *Editor) PostContent(s string) {
+	e.Screen.PostEventWait(tcell.NewEventInterrupt(contentUpdate(s)))
+}
+
+// SetContent replaces the content, keeping the cursor near the same text, and makes it the unmodified content
+// of the status bar.
 func (e *Editor) SetContent(s string) {
+	s = e.load(s)
+	e.loadedHash = hashString(selectTokenPattern.ReplaceAllString(s, ""))
+	e.block = nil
 	defer func() {
 		e.redraw()
 		e.setCursor()
 		e.Screen.Show()
 	}()
+	if !e.indexed() {
+		e.rawBuffer = stringToRunes(s)
+		return
+	}
+	prevContent := runesToString(e.rawBuffer)
+	cursor := e.rawCursor()
 	e.rawBuffer = stringToRunes(s)
+	e.redraw()
+	mapped := MapPosition(prevContent, s, cursor.position())
+	e.restoreCursor(point{x: mapped.Col, y: mapped.Line})
+}
+
+// Option configures an editor created by New or NewHeadless.
+type Option func(e *Editor)
+
+// WithTabWidth sets TabWidth.
+func WithTabWidth(width int) Option {
+	return func(e *Editor) {
+		e.TabWidth = width
+	}
+}
+
+// WithEventFilter sets EventFilter.
+func WithEventFilter(filter func(tcell.Event) []tcell.Event) Option {
+	return func(e *Editor) {
+		e.EventFilter = filter
+	}
+}
+
+// WithReadOnly sets ReadOnly.
+func WithReadOnly(readOnly bool) Option {
+	return func(e *Editor) {
+		e.ReadOnly = readOnly
+	}
+}
+
+// WithStyles sets DefaultStyle and SelectionStyle.
+func WithStyles(defaultStyle, selectionStyle tcell.Style) Option {
+	return func(e *Editor) {
+		e.DefaultStyle = defaultStyle
+		e.SelectionStyle = selectionStyle
+	}
+}
+
+// New returns an empty editor drawing to screen, ready for Edit or for the methods changing the content, which
+// lay it out on the first change.
+func New(screen tcell.Screen, opts ...Option) *Editor {
+	e := &Editor{
+		Screen:    screen,
+		differ:    diffmatchpatch.New(),
+		rawBuffer: [][]rune{nil},
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// NewHeadless returns an editor drawing to a simulation screen of the given size, for tests and scripts
+// running without a terminal.
+func NewHeadless(width, height int, opts ...Option) *Editor {
+	s := tcell.NewSimulationScreen("UTF-8")
+	// Simulation screens only fail to initialize with unknown character sets.
+	if err := s.Init(); err != nil {
+		panic(err)
+	}
+	s.SetSize(width, height)
+	e := New(s, opts...)
+	e.hideHelp = true
+	e.redraw()
+	e.setCursor()
+	return e
+}
+
+// Cells returns what the editor draws on the screen, with the style of each cell, row by row.
+func (e *Editor) Cells() [][]Cell {
+	width, height := e.view().Size()
+	res := make(cells, height)
+	for y := range res {
+		res[y] = make([]Cell, width)
+	}
+	if width > 0 {
+		e.draw(res)
+	}
+	return res
+}
+
+// RenderToString returns what the editor has drawn on the screen, one line per row, without trailing spaces.
+func (e *Editor) RenderToString() string {
+	v := e.view()
+	width, height := v.Size()
+	lines := []string{}
+	for y := 0; y < height; y++ {
+		line := []rune{}
+		for x := 0; x < width; x++ {
+			r, _, _, width := v.GetContent(x, y)
+			line = append(line, r)
+			// The cell after a wide rune is part of it.
+			if width > 1 {
+				x++
+			}
+		}
+		lines = append(lines, strings.TrimRight(string(line), " "))
+	}
+	return strings.Join(lines, "\n")
 }
 
+// Edit loads s, blocks until the quit key is pressed and returns the content
+// at that point, whether or not it was saved. If the abort key is pressed instead,
+// it returns s unchanged and ErrAborted.
+// Other methods must be called from the goroutine running Edit, for example from its callbacks, and only
+// PostContent is safe to call from other goroutines while it runs.
 func (e *Editor) Edit(s string) (string, error) {
+	return e.EditContext(context.Background(), s)
+}
+
+// EditContext is like Edit, but closes the editor and returns the content and the error of ctx when ctx is
+// cancelled.
+func (e *Editor) EditContext(ctx context.Context, s string) (string, error) {
+	if e.Screen == nil {
+		return "", fmt.Errorf("editor has no screen")
+	}
+	original := s
 	e.differ = diffmatchpatch.New()
+	s = e.load(s)
+	e.block = nil
 	e.rawBuffer = stringToRunes(s)
+	e.loadedHash = hashString(selectTokenPattern.ReplaceAllString(s, ""))
 	e.redraw()
 	e.setCursor()
 	e.Screen.Show()
-	e.pollKeys()
-	return "", nil
+	switch err := e.pollKeys(ctx); err {
+	case nil:
+		return e.Content(), nil
+	case ErrAborted:
+		return original, err
+	default:
+		return e.Content(), err
+	}
 }
@@ -1,11 +1,55 @@
 package editorview
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
+func newTestEditor(t *testing.T, width, height int, content string) *Editor {
+	e := NewHeadless(width, height)
+	e.rawBuffer = stringToRunes(content)
+	e.redraw()
+	e.setCursor()
+	return e
+}
+
+// numberedLines returns n lines of "line" followed by the line number, for content taller than the screen.
+func numberedLines(n int) string {
+	lines := []string{}
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf("line%v", i))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *Editor) press(key tcell.Key, r rune, mod tcell.ModMask) {
+	e.handleEvent(tcell.NewEventKey(key, r, mod))
+}
+
+func (e *Editor) click(x, y int) {
+	e.handleEvent(tcell.NewEventMouse(x, y, tcell.Button1, tcell.ModNone))
+	e.handleEvent(tcell.NewEventMouse(x, y, tcell.ButtonNone, tcell.ModNone))
+}
+
+func (e *Editor) selectedText() string {
+	text, _, _, _, _, _ := e.Selection()
+	return text
+}
+
+func (e *Editor) typeString(s string) {
+	for _, r := range s {
+		e.press(tcell.KeyRune, r, tcell.ModNone)
+	}
+}
+
 func makeToken(pos point, buffer []rune) *token {
 	return &token{pos: pos, buffer: buffer}
 }
@@ -37,9 +81,49 @@ ghi`,
 				makeToken(point{3, 2}, nil).setEof(),
 			},
 		},
+		{
+			text: "a&#39;&foo;&#x41;",
+			tokens: []*token{
+				makeToken(point{0, 0}, nil).setStart(),
+				makeToken(point{0, 0}, []rune{'a'}).setRune('a'),
+				makeToken(point{1, 0}, []rune("&#39;")).setRune('\''),
+				makeToken(point{6, 0}, nil).setErr(`unknown entity "&foo;"`),
+				makeToken(point{6, 0}, []rune{'&'}).setRune('&'),
+				makeToken(point{7, 0}, []rune{'f'}).setRune('f'),
+				makeToken(point{8, 0}, []rune{'o'}).setRune('o'),
+				makeToken(point{9, 0}, []rune{'o'}).setRune('o'),
+				makeToken(point{10, 0}, []rune{';'}).setRune(';'),
+				makeToken(point{11, 0}, []rune("&#x41;")).setRune('A'),
+				makeToken(point{17, 0}, nil).setEof(),
+			},
+		},
+		{
+			text: "& <b>&x\n&#xd800;",
+			tokens: []*token{
+				makeToken(point{0, 0}, nil).setStart(),
+				makeToken(point{0, 0}, nil).setErr(`unterminated entity "&"`),
+				makeToken(point{0, 0}, []rune{'&'}).setRune('&'),
+				makeToken(point{1, 0}, []rune{' '}).setRune(' '),
+				makeToken(point{2, 0}, []rune("<b>")).setErr(`unknown tag "<b>"`),
+				makeToken(point{5, 0}, nil).setErr(`unterminated entity "&x"`),
+				makeToken(point{5, 0}, []rune{'&'}).setRune('&'),
+				makeToken(point{6, 0}, []rune{'x'}).setRune('x'),
+				makeToken(point{7, 0}, nil).setNewLine(),
+				makeToken(point{0, 1}, nil).setErr(`unknown entity "&#xd800;"`),
+				makeToken(point{0, 1}, []rune{'&'}).setRune('&'),
+				makeToken(point{1, 1}, []rune{'#'}).setRune('#'),
+				makeToken(point{2, 1}, []rune{'x'}).setRune('x'),
+				makeToken(point{3, 1}, []rune{'d'}).setRune('d'),
+				makeToken(point{4, 1}, []rune{'8'}).setRune('8'),
+				makeToken(point{5, 1}, []rune{'0'}).setRune('0'),
+				makeToken(point{6, 1}, []rune{'0'}).setRune('0'),
+				makeToken(point{7, 1}, []rune{';'}).setRune(';'),
+				makeToken(point{8, 1}, nil).setEof(),
+			},
+		},
 	} {
 		count := 0
-		parseTokens(stringToRunes(tc.text), func(tok *token) {
+		parseTokens(DefaultEntities, stringToRunes(tc.text), func(tok *token) {
 			if len(tc.tokens) == 0 {
 				t.Fatalf("Got more than %v tokens", count)
 			}
@@ -82,66 +166,79 @@ func TestFlattenWithIndex(t *testing.T) {
 					raw:     point{2, 0},
 					screen:  point{2, 0},
 					flatRaw: 2,
+					markup:  true,
 				},
 				{
 					raw:     point{3, 0},
 					screen:  point{2, 0},
 					flatRaw: 3,
+					markup:  true,
 				},
 				{
 					raw:     point{4, 0},
 					screen:  point{2, 0},
 					flatRaw: 4,
+					markup:  true,
 				},
 				{
 					raw:     point{5, 0},
 					screen:  point{2, 0},
 					flatRaw: 5,
+					markup:  true,
 				},
 				{
 					raw:     point{6, 0},
 					screen:  point{2, 0},
 					flatRaw: 6,
+					markup:  true,
 				},
 				{
 					raw:     point{7, 0},
 					screen:  point{2, 0},
 					flatRaw: 7,
+					markup:  true,
 				},
 				{
 					raw:     point{8, 0},
 					screen:  point{2, 0},
 					flatRaw: 8,
+					markup:  true,
 				},
 				{
 					raw:     point{9, 0},
 					screen:  point{2, 0},
 					flatRaw: 9,
+					markup:  true,
 				},
 				{
 					raw:     point{10, 0},
 					screen:  point{2, 0},
 					flatRaw: 10,
+					markup:  true,
 				},
 				{
 					raw:     point{11, 0},
 					screen:  point{2, 0},
 					flatRaw: 11,
+					markup:  true,
 				},
 				{
 					raw:     point{12, 0},
 					screen:  point{2, 0},
 					flatRaw: 12,
+					markup:  true,
 				},
 				{
 					raw:     point{13, 0},
 					screen:  point{2, 0},
 					flatRaw: 13,
+					markup:  true,
 				},
 				{
 					raw:     point{14, 0},
 					screen:  point{2, 0},
 					flatRaw: 14,
+					markup:  true,
 				},
 				{
 					raw:     point{15, 0},
@@ -152,56 +249,67 @@ func TestFlattenWithIndex(t *testing.T) {
 					raw:     point{16, 0},
 					screen:  point{3, 0},
 					flatRaw: 16,
+					markup:  true,
 				},
 				{
 					raw:     point{17, 0},
 					screen:  point{3, 0},
 					flatRaw: 17,
+					markup:  true,
 				},
 				{
 					raw:     point{18, 0},
 					screen:  point{3, 0},
 					flatRaw: 18,
+					markup:  true,
 				},
 				{
 					raw:     point{19, 0},
 					screen:  point{3, 0},
 					flatRaw: 19,
+					markup:  true,
 				},
 				{
 					raw:     point{20, 0},
 					screen:  point{3, 0},
 					flatRaw: 20,
+					markup:  true,
 				},
 				{
 					raw:     point{21, 0},
 					screen:  point{3, 0},
 					flatRaw: 21,
+					markup:  true,
 				},
 				{
 					raw:     point{22, 0},
 					screen:  point{3, 0},
 					flatRaw: 22,
+					markup:  true,
 				},
 				{
 					raw:     point{23, 0},
 					screen:  point{3, 0},
 					flatRaw: 23,
+					markup:  true,
 				},
 				{
 					raw:     point{24, 0},
 					screen:  point{3, 0},
 					flatRaw: 24,
+					markup:  true,
 				},
 				{
 					raw:     point{25, 0},
 					screen:  point{3, 0},
 					flatRaw: 25,
+					markup:  true,
 				},
 				{
 					raw:     point{26, 0},
 					screen:  point{3, 0},
 					flatRaw: 26,
+					markup:  true,
 				},
 				{
 					raw:     point{27, 0},
@@ -295,106 +403,127 @@ func TestFlattenWithIndex(t *testing.T) {
 					raw:     point{1, 0},
 					screen:  point{1, 0},
 					flatRaw: 1,
+					markup:  true,
 				},
 				{
 					raw:     point{2, 0},
 					screen:  point{1, 0},
 					flatRaw: 2,
+					markup:  true,
 				},
 				{
 					raw:     point{3, 0},
 					screen:  point{1, 0},
 					flatRaw: 3,
+					markup:  true,
 				},
 				{
 					raw:     point{4, 0},
 					screen:  point{1, 0},
 					flatRaw: 4,
+					markup:  true,
 				},
 				{
 					raw:     point{5, 0},
 					screen:  point{1, 0},
 					flatRaw: 5,
+					markup:  true,
 				},
 				{
 					raw:     point{6, 0},
 					screen:  point{1, 0},
 					flatRaw: 6,
+					markup:  true,
 				},
 				{
 					raw:     point{7, 0},
 					screen:  point{1, 0},
 					flatRaw: 7,
+					markup:  true,
 				},
 				{
 					raw:     point{8, 0},
 					screen:  point{1, 0},
 					flatRaw: 8,
+					markup:  true,
 				},
 				{
 					raw:     point{9, 0},
 					screen:  point{1, 0},
 					flatRaw: 9,
+					markup:  true,
 				},
 				{
 					raw:     point{10, 0},
 					screen:  point{1, 0},
 					flatRaw: 10,
+					markup:  true,
 				},
 				{
 					raw:     point{11, 0},
 					screen:  point{1, 0},
 					flatRaw: 11,
+					markup:  true,
 				},
 				{
 					raw:     point{12, 0},
 					screen:  point{1, 0},
 					flatRaw: 12,
+					markup:  true,
 				},
 				{
 					raw:     point{13, 0},
 					screen:  point{1, 0},
 					flatRaw: 13,
+					markup:  true,
 				},
 				{
 					raw:     point{14, 0},
 					screen:  point{1, 0},
 					flatRaw: 14,
+					markup:  true,
 				},
 				{
 					raw:     point{15, 0},
 					screen:  point{1, 0},
 					flatRaw: 15,
+					markup:  true,
 				},
 				{
 					raw:     point{16, 0},
 					screen:  point{1, 0},
 					flatRaw: 16,
+					markup:  true,
 				},
 				{
 					raw:     point{17, 0},
 					screen:  point{1, 0},
 					flatRaw: 17,
+					markup:  true,
 				},
 				{
 					raw:     point{18, 0},
 					screen:  point{1, 0},
 					flatRaw: 18,
+					markup:  true,
 				},
 				{
 					raw:     point{19, 0},
 					screen:  point{1, 0},
 					flatRaw: 19,
+					markup:  true,
 				},
 				{
 					raw:     point{20, 0},
 					screen:  point{1, 0},
 					flatRaw: 20,
+					markup:  true,
 				},
 				{
 					raw:     point{21, 0},
 					screen:  point{1, 0},
 					flatRaw: 21,
+					markup:  true,
 				},
 				{
 					raw:     point{22, 0},
@@ -436,7 +565,7 @@ func TestFlattenWithIndex(t *testing.T) {
 			},
 		},
 	} {
-		gotRaw, gotScreen, gotRawIndex, gotScreenIndex := flattenWithIndex(stringToRunes(tc.text))
+		gotRaw, gotScreen, gotRawIndex, gotScreenIndex := flattenWithIndex(DefaultEntities, stringToRunes(tc.text))
 		if string(gotRaw) != string(tc.flatRaw) {
 			t.Fatalf("Got raw %q, wanted %q", string(gotRaw), string(tc.flatRaw))
 		}
@@ -494,7 +623,7 @@ func TestReplace(t *testing.T) {
 			result:    "ab\ndej",
 		},
 	} {
-		got := replace(stringToRunes(tc.text), tc.raw, tc.reg, tc.repl, func(match string, rawSeg, screenSeg segment) bool {
+		got := replace(DefaultEntities, stringToRunes(tc.text), tc.raw, tc.reg, tc.repl, func(match string, rawSeg, screenSeg segment) bool {
 			if match != tc.match {
 				t.Errorf("Got match %q, wanted %q", match, tc.match)
 			}
@@ -512,3 +641,4419 @@ func TestReplace(t *testing.T) {
 
 	}
 }
+
+func TestSoftTabBackspace(t *testing.T) {
+	for _, tc := range []struct {
+		text    string
+		cursorX int
+		soft    bool
+		result  string
+	}{
+		{
+			text:    "      x",
+			cursorX: 6,
+			soft:    true,
+			result:  "    x",
+		},
+		{
+			text:    "        x",
+			cursorX: 8,
+			soft:    true,
+			result:  "    x",
+		},
+		{
+			text:    "    x",
+			cursorX: 3,
+			soft:    true,
+			result:  " x",
+		},
+		{
+			text:    "  ab  x",
+			cursorX: 6,
+			soft:    true,
+			result:  "  ab x",
+		},
+		{
+			text:    "      x",
+			cursorX: 6,
+			soft:    false,
+			result:  "     x",
+		},
+	} {
+		e := newTestEditor(t, 40, 10, tc.text)
+		e.SoftTabBackspace = tc.soft
+		e.cursor.x = tc.cursorX
+		e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+		if got := e.Content(); got != tc.result {
+			t.Errorf("Got %q, wanted %q", got, tc.result)
+		}
+		if len(e.undoPatches) != 1 {
+			t.Errorf("Got %v undo patches, wanted 1", len(e.undoPatches))
+		}
+		e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		if got := e.Content(); got != tc.text {
+			t.Errorf("Got %q after undo, wanted %q", got, tc.text)
+		}
+	}
+}
+
+func TestScrollFraction(t *testing.T) {
+	e := newTestEditor(t, 20, 10, "a\nb\nc")
+	if got := e.ScrollFraction(); got != 1.0 {
+		t.Errorf("Got %v for fitting content, wanted 1.0", got)
+	}
+	e = newTestEditor(t, 20, 10, numberedLines(30))
+	if got := e.ScrollFraction(); got != 0.0 {
+		t.Errorf("Got %v at top, wanted 0.0", got)
+	}
+	for e.canScroll(down) {
+		e.scroll(down)
+	}
+	if got := e.ScrollFraction(); got != 1.0 {
+		t.Errorf("Got %v at bottom, wanted 1.0", got)
+	}
+	e.scroll(up)
+	if got := e.ScrollFraction(); got <= 0.0 || got >= 1.0 {
+		t.Errorf("Got %v in the middle, wanted between 0.0 and 1.0", got)
+	}
+}
+
+func TestScrollIndicators(t *testing.T) {
+	e := newTestEditor(t, 20, 10, numberedLines(30))
+	e.ScrollIndicators = true
+	e.redraw()
+	s := e.Screen.(tcell.SimulationScreen)
+	if r, _, _, _ := s.GetContent(19, 0); r == '↑' {
+		t.Errorf("Got up indicator at top of document")
+	}
+	if r, _, _, _ := s.GetContent(19, 9); r != '↓' {
+		t.Errorf("Got %q in bottom right corner, wanted down indicator", string(r))
+	}
+	e.scroll(down)
+	if r, _, _, _ := s.GetContent(19, 0); r != '↑' {
+		t.Errorf("Got %q in top right corner, wanted up indicator", string(r))
+	}
+}
+
+func TestScrollToEnd(t *testing.T) {
+	e := newTestEditor(t, 20, 10, numberedLines(30))
+	for e.moveCursor(down) {
+	}
+	if got := string(e.screenBuffer[e.cursor.y+e.lineOffset]); got != "line29" {
+		t.Errorf("Got cursor on %q after scrolling down, wanted last line", got)
+	}
+	if e.cursor.y != 9 || e.lineOffset != 20 {
+		t.Errorf("Got cursor %+v and line offset %v, wanted last line at bottom of screen", e.cursor, e.lineOffset)
+	}
+	e = newTestEditor(t, 20, 10, numberedLines(30))
+	e.press(tcell.KeyEnd, 0, tcell.ModCtrl)
+	if got := string(e.screenBuffer[e.cursor.y+e.lineOffset]); got != "line29" || e.cursor.x != 6 {
+		t.Errorf("Got cursor %+v on %q after End, wanted end of last line", e.cursor, got)
+	}
+	s := e.Screen.(tcell.SimulationScreen)
+	if r, _, _, _ := s.GetContent(5, 9); r != '9' {
+		t.Errorf("Got %q at end of bottom row, wanted last line visible", string(r))
+	}
+}
+
+func TestScrollRevealsLastLine(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ev   tcell.Event
+	}{
+		{name: "wheel", ev: tcell.NewEventMouse(0, 0, tcell.WheelDown, tcell.ModNone)},
+		{name: "page down", ev: tcell.NewEventKey(tcell.KeyPgDn, 0, tcell.ModNone)},
+	} {
+		e := newTestEditor(t, 20, 10, numberedLines(30))
+		for i := 0; i < 40; i++ {
+			e.handleEvent(tc.ev)
+		}
+		if e.lineOffset != 20 || e.canScroll(down) {
+			t.Errorf("%s: Got line offset %v, wanted 20 with no further scrolling", tc.name, e.lineOffset)
+		}
+		if got := strings.Split(e.RenderToString(), "\n")[9]; got != "line29" {
+			t.Errorf("%s: Got %q on the bottom row, wanted the last line", tc.name, got)
+		}
+	}
+}
+
+func TestScrollPastEnd(t *testing.T) {
+	e := newTestEditor(t, 20, 10, numberedLines(30))
+	e.ScrollPastEnd = true
+	for e.moveCursor(down) {
+	}
+	if e.lineOffset != 29 || e.cursor.y != 0 {
+		t.Errorf("Got cursor %+v and line offset %v, wanted last line at top of screen", e.cursor, e.lineOffset)
+	}
+	s := e.Screen.(tcell.SimulationScreen)
+	if r, _, _, _ := s.GetContent(0, 1); r != ' ' {
+		t.Errorf("Got %q below last line, wanted blank", string(r))
+	}
+	e.ScrollToBottom()
+	if e.lineOffset != 20 {
+		t.Errorf("Got line offset %v after ScrollToBottom, wanted 20", e.lineOffset)
+	}
+	e.press(tcell.KeyHome, 0, tcell.ModCtrl)
+	e.press(tcell.KeyEnd, 0, tcell.ModCtrl)
+	if e.lineOffset != 20 || e.cursor.y != 9 {
+		t.Errorf("Got cursor %+v and line offset %v after End, wanted last line at bottom of screen", e.cursor, e.lineOffset)
+	}
+}
+
+func TestScrollKeepsSelection(t *testing.T) {
+	for _, scroll := range []func(e *Editor){
+		func(e *Editor) {
+			e.press(tcell.KeyPgDn, 0, tcell.ModNone)
+		},
+		func(e *Editor) {
+			e.press(tcell.KeyPgDn, 0, tcell.ModNone)
+			e.press(tcell.KeyPgUp, 0, tcell.ModNone)
+		},
+		func(e *Editor) {
+			e.handleEvent(tcell.NewEventMouse(0, 0, tcell.WheelDown, tcell.ModNone))
+			e.handleEvent(tcell.NewEventMouse(0, 0, tcell.WheelDown, tcell.ModNone))
+		},
+	} {
+		e := newTestEditor(t, 20, 10, numberedLines(30))
+		for i := 0; i < 3; i++ {
+			e.press(tcell.KeyRight, 0, tcell.ModShift)
+		}
+		scroll(e)
+		if !e.selecting {
+			t.Errorf("Scrolling stopped the selection")
+		}
+		e.press(tcell.KeyCtrlC, 0, tcell.ModNone)
+		if got := runesToString(e.pasteBuffer); got != "lin" {
+			t.Errorf("Got %q copied after scrolling, wanted %q", got, "lin")
+		}
+	}
+}
+
+func TestShiftPageSelection(t *testing.T) {
+	for _, tc := range []struct {
+		downs  int
+		key    tcell.Key
+		result string
+	}{
+		{
+			downs:  24,
+			key:    tcell.KeyPgDn,
+			result: "line24\nline25\nline26\nline27\nline28\n",
+		},
+		{
+			downs:  12,
+			key:    tcell.KeyPgDn,
+			result: "line12\nline13\nline14\nline15\nline16\nline17\nline18\nline19\nline20\nline21\n",
+		},
+		{
+			downs:  15,
+			key:    tcell.KeyPgUp,
+			result: "line5\nline6\nline7\nline8\nline9\nline10\nline11\nline12\nline13\nline14\n",
+		},
+		{
+			downs:  4,
+			key:    tcell.KeyPgUp,
+			result: "line0\nline1\nline2\nline3\n",
+		},
+	} {
+		e := newTestEditor(t, 20, 10, numberedLines(30))
+		for i := 0; i < tc.downs; i++ {
+			e.press(tcell.KeyDown, 0, tcell.ModNone)
+		}
+		e.press(tc.key, 0, tcell.ModShift)
+		e.press(tcell.KeyCtrlC, 0, tcell.ModNone)
+		if got := runesToString(e.pasteBuffer); got != tc.result {
+			t.Errorf("Got %q selected after %v downs, wanted %q", got, tc.downs, tc.result)
+		}
+	}
+}
+
+func TestShiftHomeEndSelection(t *testing.T) {
+	content := numberedLines(30)
+	lines := strings.Split(content, "\n")
+	for _, tc := range []struct {
+		key    tcell.Key
+		mod    tcell.ModMask
+		result string
+	}{
+		{
+			key:    tcell.KeyHome,
+			mod:    tcell.ModShift,
+			result: "li",
+		},
+		{
+			key:    tcell.KeyEnd,
+			mod:    tcell.ModShift,
+			result: "ne20",
+		},
+		{
+			key:    tcell.KeyHome,
+			mod:    tcell.ModShift | tcell.ModCtrl,
+			result: strings.Join(lines[:20], "\n") + "\nli",
+		},
+		{
+			key:    tcell.KeyEnd,
+			mod:    tcell.ModShift | tcell.ModCtrl,
+			result: "ne20\n" + strings.Join(lines[21:], "\n"),
+		},
+	} {
+		e := newTestEditor(t, 20, 10, content)
+		for i := 0; i < 20; i++ {
+			e.press(tcell.KeyDown, 0, tcell.ModNone)
+		}
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+		e.press(tc.key, 0, tc.mod)
+		e.press(tcell.KeyCtrlC, 0, tcell.ModNone)
+		if got := runesToString(e.pasteBuffer); got != tc.result {
+			t.Errorf("Got %q selected after %v with %v, wanted %q", got, tc.key, tc.mod, tc.result)
+		}
+	}
+}
+
+func TestBell(t *testing.T) {
+	e := newTestEditor(t, 20, 10, "ab\ncd")
+	bells := []string{}
+	e.OnBell = func(reason string) {
+		bells = append(bells, reason)
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	if len(bells) != 0 {
+		t.Errorf("Got bells %+v when moving freely", bells)
+	}
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyPgDn, 0, tcell.ModNone)
+	e.press(tcell.KeyHome, 0, tcell.ModCtrl)
+	e.press(tcell.KeyLeft, 0, tcell.ModCtrl)
+	e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+	if !reflect.DeepEqual(bells, []string{BellBoundary, BellBoundary, BellBoundary, BellBoundary}) {
+		t.Errorf("Got bells %+v, wanted four boundary bells", bells)
+	}
+}
+
+func TestFocus(t *testing.T) {
+	e := newTestEditor(t, 20, 10, "abc")
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	s := e.Screen.(tcell.SimulationScreen)
+	if x, y, visible := s.GetCursor(); !visible || x != 1 || y != 0 {
+		t.Errorf("Got cursor %v,%v visible %v, wanted visible at 1,0", x, y, visible)
+	}
+	e.SetFocused(false)
+	if _, _, visible := s.GetCursor(); visible || e.Focused() {
+		t.Errorf("Got visible cursor when unfocused")
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	if _, _, visible := s.GetCursor(); visible {
+		t.Errorf("Got visible cursor after key press when unfocused")
+	}
+	e.SetFocused(true)
+	if x, y, visible := s.GetCursor(); !visible || x != 2 || y != 0 {
+		t.Errorf("Got cursor %v,%v visible %v, wanted visible at 2,0", x, y, visible)
+	}
+}
+
+func TestSubwordMovement(t *testing.T) {
+	for _, tc := range []struct {
+		text  string
+		stops []int
+	}{
+		{
+			text:  "someLongIdentifierName",
+			stops: []int{4, 8, 18, 22},
+		},
+		{
+			text:  "snake_case_word",
+			stops: []int{6, 11, 15},
+		},
+		{
+			text:  "foo barBaz",
+			stops: []int{3, 4, 7, 10},
+		},
+	} {
+		e := newTestEditor(t, 40, 10, tc.text)
+		for _, stop := range tc.stops {
+			e.press(tcell.KeyRight, 0, tcell.ModAlt)
+			if e.cursor.x != stop {
+				t.Errorf("Got cursor at %v moving right in %q, wanted %v", e.cursor.x, tc.text, stop)
+			}
+		}
+		for i := len(tc.stops) - 2; i >= 0; i-- {
+			e.press(tcell.KeyLeft, 0, tcell.ModAlt)
+			if e.cursor.x != tc.stops[i] {
+				t.Errorf("Got cursor at %v moving left in %q, wanted %v", e.cursor.x, tc.text, tc.stops[i])
+			}
+		}
+		e.press(tcell.KeyLeft, 0, tcell.ModAlt)
+		if e.cursor.x != 0 {
+			t.Errorf("Got cursor at %v moving left in %q, wanted 0", e.cursor.x, tc.text)
+		}
+	}
+}
+
+func TestCollapseSelection(t *testing.T) {
+	for _, tc := range []struct {
+		text      string
+		start     point
+		selectKey tcell.Key
+		selects   int
+		key       tcell.Key
+		cursor    point
+	}{
+		{
+			text:      "abc def ghi",
+			start:     point{4, 0},
+			selectKey: tcell.KeyRight,
+			selects:   3,
+			key:       tcell.KeyLeft,
+			cursor:    point{4, 0},
+		},
+		{
+			text:      "abc def ghi",
+			start:     point{4, 0},
+			selectKey: tcell.KeyRight,
+			selects:   3,
+			key:       tcell.KeyRight,
+			cursor:    point{7, 0},
+		},
+		{
+			text:      "abc def ghi",
+			start:     point{7, 0},
+			selectKey: tcell.KeyLeft,
+			selects:   3,
+			key:       tcell.KeyRight,
+			cursor:    point{7, 0},
+		},
+		{
+			text:      "abc\ndef\nghi",
+			start:     point{1, 0},
+			selectKey: tcell.KeyDown,
+			selects:   1,
+			key:       tcell.KeyUp,
+			cursor:    point{1, 0},
+		},
+		{
+			text:      "abc\ndef\nghi",
+			start:     point{1, 1},
+			selectKey: tcell.KeyUp,
+			selects:   1,
+			key:       tcell.KeyDown,
+			cursor:    point{1, 1},
+		},
+	} {
+		e := newTestEditor(t, 20, 10, tc.text)
+		e.cursor = tc.start
+		for i := 0; i < tc.selects; i++ {
+			e.press(tc.selectKey, 0, tcell.ModShift)
+		}
+		e.press(tc.key, 0, tcell.ModNone)
+		if e.cursor != tc.cursor {
+			t.Errorf("Got cursor %+v, wanted %+v", e.cursor, tc.cursor)
+		}
+		if got := e.Content(); got != tc.text {
+			t.Errorf("Got content %q, wanted selection cleared from %q", got, tc.text)
+		}
+	}
+}
+
+func TestTypeWithSelection(t *testing.T) {
+	for _, tc := range []struct {
+		text     string
+		start    point
+		selects  int
+		typed    string
+		result   string
+		selected string
+	}{
+		{
+			text:     "abc def ghi",
+			start:    point{4, 0},
+			selects:  3,
+			typed:    "(",
+			result:   "abc (def) ghi",
+			selected: "def",
+		},
+		{
+			text:     "abc def ghi",
+			start:    point{4, 0},
+			selects:  3,
+			typed:    "\"",
+			result:   "abc \"def\" ghi",
+			selected: "def",
+		},
+		{
+			text:     "abc def ghi",
+			start:    point{4, 0},
+			selects:  3,
+			typed:    "[\"",
+			result:   "abc [\"def\"] ghi",
+			selected: "def",
+		},
+		{
+			text:     "a<b c",
+			start:    point{0, 0},
+			selects:  3,
+			typed:    "{",
+			result:   "{a<b} c",
+			selected: "a<b",
+		},
+		{
+			text:    "abc def ghi",
+			start:   point{4, 0},
+			selects: 3,
+			typed:   "xy",
+			result:  "abc xy ghi",
+		},
+	} {
+		e := newTestEditor(t, 20, 10, Escape(tc.text))
+		e.cursor = tc.start
+		for i := 0; i < tc.selects; i++ {
+			e.press(tcell.KeyRight, 0, tcell.ModShift)
+		}
+		e.typeString(tc.typed)
+		if got := PlainText(e.Content()); got != tc.result {
+			t.Errorf("Got %q, wanted %q", got, tc.result)
+		}
+		e.pasteBuffer = nil
+		e.copySelection()
+		if got := runesToString(e.pasteBuffer); got != tc.selected {
+			t.Errorf("Got selection %q, wanted %q", got, tc.selected)
+		}
+		if len(tc.typed) == 1 && len(e.undoPatches) != tc.selects+1 {
+			t.Errorf("Got %v undo patches, wanted %v", len(e.undoPatches), tc.selects+1)
+		}
+	}
+}
+
+func TestEnter(t *testing.T) {
+	for _, tc := range []struct {
+		text       string
+		start      point
+		selectKeys []tcell.Key
+		autoIndent bool
+		indentRule func(string) int
+		result     string
+		cursor     point
+	}{
+		{
+			text:   "abc",
+			start:  point{1, 0},
+			result: "a\nbc",
+			cursor: point{0, 1},
+		},
+		{
+			text:       "    foo bar",
+			start:      point{7, 0},
+			autoIndent: true,
+			result:     "    foo\n     bar",
+			cursor:     point{4, 1},
+		},
+		{
+			text:       "  foo",
+			start:      point{1, 0},
+			autoIndent: true,
+			result:     " \n  foo",
+			cursor:     point{1, 1},
+		},
+		{
+			text:       "    foo bar\n    baz qux",
+			start:      point{7, 0},
+			selectKeys: []tcell.Key{tcell.KeyDown},
+			autoIndent: true,
+			result:     "    foo\n     qux",
+			cursor:     point{4, 1},
+		},
+		{
+			text:       "    foo bar\n    baz qux",
+			start:      point{7, 1},
+			selectKeys: []tcell.Key{tcell.KeyUp},
+			result:     "    foo\n qux",
+			cursor:     point{0, 1},
+		},
+		{
+			text:       "  if x {",
+			start:      point{8, 0},
+			autoIndent: true,
+			indentRule: OpenerIndentRule,
+			result:     "  if x {\n      ",
+			cursor:     point{6, 1},
+		},
+		{
+			text:       "  f(x) ",
+			start:      point{7, 0},
+			autoIndent: true,
+			indentRule: OpenerIndentRule,
+			result:     "  f(x) \n  ",
+			cursor:     point{2, 1},
+		},
+		{
+			text:       "  f(x)",
+			start:      point{4, 0},
+			autoIndent: true,
+			indentRule: OpenerIndentRule,
+			result:     "  f(\n      x)",
+			cursor:     point{6, 1},
+		},
+		{
+			text:       "\t\treturn x",
+			start:      point{16, 0},
+			autoIndent: true,
+			indentRule: func(prevLine string) int {
+				if strings.HasPrefix(strings.TrimSpace(prevLine), "return") {
+					return -1
+				}
+				return 0
+			},
+			result: "\t\treturn x\n\t",
+			cursor: point{4, 1},
+		},
+	} {
+		e := newTestEditor(t, 20, 10, tc.text)
+		e.AutoIndent = tc.autoIndent
+		e.IndentRule = tc.indentRule
+		e.cursor = tc.start
+		for _, key := range tc.selectKeys {
+			e.press(key, 0, tcell.ModShift)
+		}
+		e.press(tcell.KeyEnter, 0, tcell.ModNone)
+		if got := e.Content(); got != tc.result {
+			t.Errorf("Got %q, wanted %q", got, tc.result)
+		}
+		if e.cursor != tc.cursor {
+			t.Errorf("Got cursor %+v, wanted %+v", e.cursor, tc.cursor)
+		}
+		if len(e.undoPatches) != len(tc.selectKeys)+1 {
+			t.Errorf("Got %v undo patches, wanted %v", len(e.undoPatches), len(tc.selectKeys)+1)
+		}
+	}
+}
+
+func TestIndentLevel(t *testing.T) {
+	e := newTestEditor(t, 20, 10, "a\n  b\n    c\n\n\tc\n  \td\n \n<color:ffffff:000000>  e")
+	for line, want := range []int{0, 2, 4, 4, 4, 4, 4, 2} {
+		if got := e.IndentLevel(line); got != want {
+			t.Errorf("Got indent level %v for line %v, wanted %v", got, line, want)
+		}
+	}
+	e.TabWidth = 8
+	if got := e.IndentLevel(4); got != 8 {
+		t.Errorf("Got indent level %v for tab with TabWidth 8, wanted 8", got)
+	}
+	if got := e.IndentLevel(20); got != 0 {
+		t.Errorf("Got indent level %v for missing line, wanted 0", got)
+	}
+}
+
+func TestSelectIndentBlock(t *testing.T) {
+	text := "def f():\n    a\n    if x:\n        b\n\n        c\n    d\ne"
+	for _, tc := range []struct {
+		line     int
+		selected string
+	}{
+		{
+			line:     0,
+			selected: text,
+		},
+		{
+			line:     1,
+			selected: "    a\n    if x:\n        b\n\n        c\n    d",
+		},
+		{
+			line:     3,
+			selected: "        b\n\n        c",
+		},
+		{
+			line:     4,
+			selected: "        b\n\n        c",
+		},
+	} {
+		e := newTestEditor(t, 20, 10, text)
+		e.cursor = point{2, tc.line}
+		e.setCursor()
+		e.SelectIndentBlock()
+		e.copySelection()
+		if got := runesToString(e.pasteBuffer); got != tc.selected {
+			t.Errorf("Got %q selected on line %v, wanted %q", got, tc.line, tc.selected)
+		}
+		if PlainText(e.Content()) != text {
+			t.Errorf("Got %q, wanted unchanged text", PlainText(e.Content()))
+		}
+		if len(e.undoPatches) != 1 {
+			t.Errorf("Got %v undo patches, wanted 1", len(e.undoPatches))
+		}
+	}
+}
+
+func TestDedentOnCloser(t *testing.T) {
+	for _, tc := range []struct {
+		text   string
+		start  point
+		result string
+		cursor point
+	}{
+		{
+			text:   "if x {\n        ",
+			start:  point{8, 1},
+			result: "if x {\n    }",
+			cursor: point{5, 1},
+		},
+		{
+			text:   "if x {\n  ",
+			start:  point{2, 1},
+			result: "if x {\n}",
+			cursor: point{1, 1},
+		},
+		{
+			text:   "if x {\n\t\t",
+			start:  point{8, 1},
+			result: "if x {\n\t}",
+			cursor: point{5, 1},
+		},
+		{
+			text:   "if x {\n    a",
+			start:  point{5, 1},
+			result: "if x {\n    a}",
+			cursor: point{6, 1},
+		},
+		{
+			text:   "if x {\n    ",
+			start:  point{4, 1},
+			result: "if x {\n    )",
+			cursor: point{5, 1},
+		},
+	} {
+		e := newTestEditor(t, 20, 10, tc.text)
+		e.DedentOnCloser = map[rune]bool{'}': true}
+		e.cursor = tc.start
+		e.typeString(tc.result[len(tc.result)-1:])
+		if got := e.Content(); got != tc.result {
+			t.Errorf("Got %q, wanted %q", got, tc.result)
+		}
+		if e.cursor != tc.cursor {
+			t.Errorf("Got cursor %+v, wanted %+v", e.cursor, tc.cursor)
+		}
+		if len(e.undoPatches) != 1 {
+			t.Errorf("Got %v undo patches, wanted 1", len(e.undoPatches))
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		errs []error
+	}{
+		{
+			text: "a <color:ffffff:000000>b &amp; <select-from>c<select-to>",
+			errs: []error{},
+		},
+		{
+			text: "ab\ncd<color:ffffff:00",
+			errs: []error{&ParseError{Line: 1, Col: 2, Message: `unterminated tag "<color:ffffff:00"`}},
+		},
+		{
+			text: "a<color:ffffff:00000g>b",
+			errs: []error{&ParseError{Line: 0, Col: 1, Message: `invalid color tag "<color:ffffff:00000g>"`}},
+		},
+		{
+			text: "a<foo>b",
+			errs: []error{&ParseError{Line: 0, Col: 1, Message: `unknown tag "<foo>"`}},
+		},
+		{
+			text: "a&foo;b\nc&amp",
+			errs: []error{
+				&ParseError{Line: 0, Col: 1, Message: `unknown entity "&foo;"`},
+				&ParseError{Line: 1, Col: 1, Message: `unterminated entity "&amp"`},
+			},
+		},
+		{
+			text: "a\nb<select-from>c\nd",
+			errs: []error{&ParseError{Line: 1, Col: 1, Message: "unbalanced selection token"}},
+		},
+	} {
+		e := newTestEditor(t, 40, 10, tc.text)
+		if got := e.Validate(); !reflect.DeepEqual(got, tc.errs) {
+			t.Errorf("Got %v validating %q, wanted %v", got, tc.text, tc.errs)
+		}
+	}
+}
+
+func TestCustomEntity(t *testing.T) {
+	e := NewHeadless(20, 10)
+	e.Entities = []Entity{
+		{Name: "&amp;", Rune: '&'},
+		{Name: "&lt;", Rune: '<'},
+		{Name: "&gt;", Rune: '>'},
+		{Name: "&nbsp;", Rune: '\u00a0'},
+	}
+	e.SetContent("a&nbsp;bc")
+	if got := e.escape("a\u00a0<b> &"); got != "a&nbsp;&lt;b&gt; &amp;" {
+		t.Errorf("Got %q escaped", got)
+	}
+	if got := string(plain(e.entities(), e.rawBuffer)[0]); got != "a\u00a0bc" {
+		t.Errorf("Got %q as plain text", got)
+	}
+	e.cursor.x = 1
+	e.press(tcell.KeyDelete, 0, tcell.ModNone)
+	if got := e.Content(); got != "abc" {
+		t.Errorf("Got %q after deleting entity, wanted %q", got, "abc")
+	}
+	e.typeString("\u00a0")
+	if got := e.Content(); got != "a&nbsp;bc" {
+		t.Errorf("Got %q after typing entity rune, wanted %q", got, "a&nbsp;bc")
+	}
+
+	// Other editors, and the package functions, keep the DefaultEntities.
+	other := newTestEditor(t, 20, 10, "a&nbsp;bc")
+	if errs := other.Validate(); len(errs) == 0 {
+		t.Errorf("Got &nbsp; valid in an editor without it")
+	}
+	if got := Escape("a\u00a0"); got != "a\u00a0" {
+		t.Errorf("Got %q escaped by Escape, wanted the rune kept", got)
+	}
+}
+
+func TestDeleteEntityAtEndOfLine(t *testing.T) {
+	for _, text := range []string{"ab&amp;", "ab&lt;", "ab&gt;", "ab&gt;\ncd"} {
+		e := newTestEditor(t, 20, 10, text)
+		e.cursor.x = 2
+		e.press(tcell.KeyDelete, 0, tcell.ModNone)
+		if got := strings.Split(e.Content(), "\n")[0]; got != "ab" {
+			t.Errorf("Got %q after deleting last entity of %q, wanted %q", got, text, "ab")
+		}
+		e = newTestEditor(t, 20, 10, text)
+		e.cursor.x = 3
+		e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+		if got := strings.Split(e.Content(), "\n")[0]; got != "ab" {
+			t.Errorf("Got %q after backspacing last entity of %q, wanted %q", got, text, "ab")
+		}
+	}
+}
+
+func TestGoToColumn(t *testing.T) {
+	e := newTestEditor(t, 10, 10, "abc\n0123456789abcdefghij\nxyz")
+	e.cursor = point{1, 1}
+	for _, tc := range []struct {
+		col    int
+		cursor point
+	}{
+		{col: 5, cursor: point{5, 1}},
+		{col: 12, cursor: point{2, 2}},
+		{col: 25, cursor: point{0, 3}},
+		{col: -1, cursor: point{0, 1}},
+	} {
+		e.GoToColumn(tc.col)
+		if e.cursor != tc.cursor {
+			t.Errorf("Got cursor %+v for column %v, wanted %+v", e.cursor, tc.col, tc.cursor)
+		}
+	}
+	e.cursor = point{0, 4}
+	e.GoToColumn(2)
+	if e.cursor != (point{2, 4}) {
+		t.Errorf("Got cursor %+v, wanted %+v", e.cursor, point{2, 4})
+	}
+}
+
+func TestHeadless(t *testing.T) {
+	e := NewHeadless(12, 4)
+	e.SetContent("hello")
+	e.HandleEvent(tcell.NewEventKey(tcell.KeyEnd, 0, tcell.ModNone))
+	for _, r := range " world, wrapped" {
+		e.HandleEvent(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+	e.HandleEvent(tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModShift))
+	e.HandleEvent(tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModShift))
+	e.HandleEvent(tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone))
+	if got, want := e.Content(), "hello world, wrapp"; got != want {
+		t.Errorf("Got content %q, wanted %q", got, want)
+	}
+	if got, want := e.RenderToString(), "hello world,\n wrapp\n\n"; got != want {
+		t.Errorf("Got rendered %q, wanted %q", got, want)
+	}
+	if quit := e.HandleEvent(tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModNone)); !quit {
+		t.Errorf("Got no quit from Ctrl-W")
+	}
+}
+
+func TestZeroSizeScreen(t *testing.T) {
+	e := newTestEditor(t, 0, 0, "abc")
+	// Methods change the content right away, while input waits for a size.
+	e.GoToColumn(2)
+	e.SelectIndentBlock()
+	e.typeString("x")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	if got := e.Content(); got != "<select-from>abc<select-to>" {
+		t.Errorf("Got %q before having a size, wanted %q", got, "<select-from>abc<select-to>")
+	}
+	e.Screen.(tcell.SimulationScreen).SetSize(20, 5)
+	e.handleEvent(tcell.NewEventResize(20, 5))
+	if got := PlainText(e.Content()); got != "x\n" {
+		t.Errorf("Got %q after resize, wanted %q", got, "x\n")
+	}
+	if got := e.RenderToString(); got != "x\n\n\n\n" {
+		t.Errorf("Got rendered %q after resize", got)
+	}
+}
+
+func TestChangeBeforeResize(t *testing.T) {
+	e := newTestEditor(t, 0, 0, "abc")
+	e.InsertText("hello ")
+	e.Batch(func() {
+		e.InsertText("1")
+		e.InsertText("2\n")
+	})
+	if got, want := e.Content(), "hello 12\nabc"; got != want {
+		t.Errorf("Got %q before having a size, wanted %q", got, want)
+	}
+	if line, col := e.CursorPosition(); line != 1 || col != 0 {
+		t.Errorf("Got cursor at %v,%v before having a size, wanted 1,0", line, col)
+	}
+	if len(e.undoPatches) != 2 {
+		t.Errorf("Got %v undo patches, wanted one for each change", len(e.undoPatches))
+	}
+	e.Screen.(tcell.SimulationScreen).SetSize(5, 5)
+	e.handleEvent(tcell.NewEventResize(5, 5))
+	if got, want := e.RenderToString(), "hello\n 12\nabc\n\n"; got != want {
+		t.Errorf("Got rendered %q after resize, wanted %q", got, want)
+	}
+	if line, col := e.CursorPosition(); line != 1 || col != 0 {
+		t.Errorf("Got cursor at %v,%v after resize, wanted 1,0", line, col)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "abc\ndef")
+	e.Batch(func() {
+		e.HandleEvent(tcell.NewEventKey(tcell.KeyEnd, 0, tcell.ModNone))
+		for _, r := range "123" {
+			e.HandleEvent(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+		}
+		e.HandleEvent(tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModNone))
+		e.GoToColumn(0)
+		e.HandleEvent(tcell.NewEventKey(tcell.KeyDelete, 0, tcell.ModNone))
+		if got := e.RenderToString(); got != "abc\ndef\n\n\n" {
+			t.Errorf("Got %q rendered during batch, wanted nothing painted yet", got)
+		}
+	})
+	if got := e.Content(); got != "abc123\nef" {
+		t.Errorf("Got %q after batch, wanted %q", got, "abc123\nef")
+	}
+	if got := e.RenderToString(); got != "abc123\nef\n\n\n" {
+		t.Errorf("Got %q rendered after batch", got)
+	}
+	if len(e.undoPatches) != 1 {
+		t.Fatalf("Got %v undo patches, wanted 1", len(e.undoPatches))
+	}
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got := e.Content(); got != "abc\ndef" {
+		t.Errorf("Got %q after undo, wanted %q", got, "abc\ndef")
+	}
+}
+
+func TestUndoCursor(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		content    string
+		keys       func(e *Editor)
+		wantCursor point
+		wantOffset int
+	}{
+		{
+			name:    "paste",
+			content: "ab\ncd",
+			keys: func(e *Editor) {
+				e.pasteBuffer = stringToRunes("1\n2\n3\n4\n5\n6\n7\n8")
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyCtrlV, 0, tcell.ModNone)
+			},
+			wantCursor: point{x: 1, y: 0},
+			wantOffset: 0,
+		},
+		{
+			name:    "ctrl-end then type",
+			content: "a\nb\nc\nd\ne\nf\ng\nh",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyEnd, 0, tcell.ModCtrl)
+				e.typeString("\nxyz")
+			},
+			wantCursor: point{x: 1, y: 2},
+			wantOffset: 5,
+		},
+	} {
+		e := newTestEditor(t, 10, 3, tc.content)
+		tc.keys(e)
+		for len(e.undoPatches) > 0 {
+			e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		}
+		if got := e.Content(); got != tc.content {
+			t.Errorf("%s: Got %q after undo, wanted %q", tc.name, got, tc.content)
+		}
+		if e.cursor != tc.wantCursor || e.lineOffset != tc.wantOffset {
+			t.Errorf("%s: Got cursor %v at offset %v after undo, wanted %v at offset %v", tc.name, e.cursor, e.lineOffset, tc.wantCursor, tc.wantOffset)
+		}
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+	for _, tc := range []struct {
+		content  string
+		pattern  string
+		repl     string
+		want     string
+		replaced int
+	}{
+		{
+			content:  "a color <color:ff0000:000000>red color",
+			pattern:  "color",
+			repl:     "colour",
+			want:     "a colour <color:ff0000:000000>red colour",
+			replaced: 2,
+		},
+		{
+			content:  "ab<color:ff0000:000000>cd",
+			pattern:  "b",
+			repl:     "x",
+			want:     "ax<color:ff0000:000000>cd",
+			replaced: 1,
+		},
+		{
+			content:  "ab<color:ff0000:000000>cd",
+			pattern:  "bc",
+			repl:     "XY",
+			want:     "aXY<color:ff0000:000000>d",
+			replaced: 1,
+		},
+		{
+			content:  "a<select-from>bc<select-to>d",
+			pattern:  "select|b",
+			repl:     "x",
+			want:     "a<select-from>xc<select-to>d",
+			replaced: 1,
+		},
+		{
+			content:  "foo1 foo22\nfoo",
+			pattern:  `foo(\d*)`,
+			repl:     "bar$1",
+			want:     "bar1 bar22\nbar",
+			replaced: 3,
+		},
+		{
+			content:  "a &lt; b",
+			pattern:  "<",
+			repl:     ">",
+			want:     "a &gt; b",
+			replaced: 1,
+		},
+		{
+			content:  "abc",
+			pattern:  "x",
+			repl:     "y",
+			want:     "abc",
+			replaced: 0,
+		},
+		{
+			content:  "x &lt;b&gt; &amp; y",
+			pattern:  `x (.*) y`,
+			repl:     "<$1>",
+			want:     "&lt;&lt;b&gt; &amp;&gt;",
+			replaced: 1,
+		},
+		{
+			content:  "a<color:ff0000:000000>&lt;b",
+			pattern:  `(?P<open><)(\w)|(z)`,
+			repl:     "${2}$3${open}",
+			want:     "a<color:ff0000:000000>b&lt;",
+			replaced: 1,
+		},
+		{
+			content:  "abab",
+			pattern:  "ab",
+			repl:     "x",
+			want:     "xx",
+			replaced: 2,
+		},
+		{
+			content:  "aaa",
+			pattern:  "aa",
+			repl:     "b",
+			want:     "ba",
+			replaced: 1,
+		},
+	} {
+		e := newTestEditor(t, 40, 5, tc.content)
+		if got := e.ReplaceAll(regexp.MustCompile(tc.pattern), Escape(tc.repl)); got != tc.replaced {
+			t.Errorf("Got %v replaced in %q, wanted %v", got, tc.content, tc.replaced)
+		}
+		if got := e.Content(); got != tc.want {
+			t.Errorf("Got %q after replacing %q in %q, wanted %q", got, tc.pattern, tc.content, tc.want)
+		}
+		if errs := e.Validate(); len(errs) > 0 {
+			t.Errorf("Got %v validating after replacing %q in %q, wanted none", errs, tc.pattern, tc.content)
+		}
+	}
+	e := newTestEditor(t, 40, 5, "foo bar\nfoo")
+	e.cursor = point{5, 0}
+	e.ReplaceAll(regexp.MustCompile("foo"), "f")
+	if want := (point{3, 0}); e.cursor != want {
+		t.Errorf("Got cursor %v after replacing before it, wanted %v", e.cursor, want)
+	}
+	e.cursor = point{1, 1}
+	e.ReplaceAll(regexp.MustCompile("f"), "")
+	if want := (point{0, 1}); e.cursor != want {
+		t.Errorf("Got cursor %v after replacing around it, wanted %v", e.cursor, want)
+	}
+}
+
+func TestStripMarkup(t *testing.T) {
+	e := newTestEditor(t, 40, 5, "a<color:ff0000:000000>red\n<color:00ff00:000000>gr<select-from>een<color:ffffff:000000> pl<select-to>ain")
+	wantRemoved := []Span{
+		{Position{0, 1}, Position{0, 22}},
+		{Position{1, 0}, Position{1, 21}},
+		{Position{1, 39}, Position{1, 60}},
+	}
+	if got := e.StripMarkup(); !reflect.DeepEqual(got, wantRemoved) {
+		t.Errorf("Got removed %+v, wanted %+v", got, wantRemoved)
+	}
+	if got, want := e.Content(), "ared\ngr<select-from>een pl<select-to>ain"; got != want {
+		t.Errorf("Got %q after stripping, wanted %q", got, want)
+	}
+	e.copySelection()
+	if got := runesToString(e.pasteBuffer); got != "een pl" {
+		t.Errorf("Got %q selected after stripping, wanted %q", got, "een pl")
+	}
+	if got := e.StripMarkup(); got != nil {
+		t.Errorf("Got removed %+v from plain content, wanted nothing", got)
+	}
+	if len(e.undoPatches) != 1 {
+		t.Fatalf("Got %v undo patches, wanted 1", len(e.undoPatches))
+	}
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := e.Content(), "a<color:ff0000:000000>red\n<color:00ff00:000000>gr<select-from>een<color:ffffff:000000> pl<select-to>ain"; got != want {
+		t.Errorf("Got %q after undo, wanted %q", got, want)
+	}
+}
+
+func TestLineLengthLimit(t *testing.T) {
+	e := newTestEditor(t, 4, 10, "abcdefgh\nab\nabc<select-from>de<select-to>fg")
+	e.LineLengthLimit = 3
+	e.redraw()
+	warn := e.lineLengthStyle()
+	got := []string{}
+	for y, line := range e.screenBuffer {
+		rawLine := e.screenBufferIndex[y][0].y
+		for len(got) <= rawLine {
+			got = append(got, "")
+		}
+		for x := range line {
+			if e.styleIndex[y][x] == warn {
+				got[rawLine] += "!"
+			} else {
+				got[rawLine] += "."
+			}
+		}
+	}
+	want := []string{"...!!!!!", "..", ".....!!"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got highlights %q, wanted %q", got, want)
+	}
+	if _, _, style, _ := e.Screen.GetContent(0, 1); style != warn {
+		t.Errorf("Got style %v at the start of a wrapped overlong line, wanted %v", style, warn)
+	}
+}
+
+func TestSelectCommands(t *testing.T) {
+	content := "foo bar_baz, <color:ff0000:000000>qux\n  second line\nlast"
+	for _, tc := range []struct {
+		name   string
+		cursor point
+		sel    func(e *Editor)
+		want   string
+	}{
+		{
+			name:   "word",
+			cursor: point{6, 0},
+			sel:    (*Editor).SelectWord,
+			want:   "bar_baz",
+		},
+		{
+			name:   "whitespace after punctuation",
+			cursor: point{12, 0},
+			sel:    (*Editor).SelectWord,
+			want:   " ",
+		},
+		{
+			name:   "whitespace",
+			cursor: point{1, 1},
+			sel:    (*Editor).SelectWord,
+			want:   "  ",
+		},
+		{
+			name:   "word after color",
+			cursor: point{14, 0},
+			sel:    (*Editor).SelectWord,
+			want:   "qux",
+		},
+		{
+			name:   "word before punctuation",
+			cursor: point{11, 0},
+			sel:    (*Editor).SelectWord,
+			want:   "bar_baz",
+		},
+		{
+			name:   "word at end of line",
+			cursor: point{4, 2},
+			sel:    (*Editor).SelectWord,
+			want:   "last",
+		},
+		{
+			name:   "line",
+			cursor: point{3, 1},
+			sel:    func(e *Editor) { e.SelectLine(false) },
+			want:   "  second line",
+		},
+		{
+			name:   "line with newline",
+			cursor: point{3, 1},
+			sel:    func(e *Editor) { e.SelectLine(true) },
+			want:   "  second line\n",
+		},
+		{
+			name:   "last line with newline",
+			cursor: point{0, 2},
+			sel:    func(e *Editor) { e.SelectLine(true) },
+			want:   "last",
+		},
+		{
+			name:   "all",
+			cursor: point{2, 1},
+			sel:    (*Editor).SelectAll,
+			want:   "foo bar_baz, qux\n  second line\nlast",
+		},
+	} {
+		e := newTestEditor(t, 40, 5, content)
+		e.cursor = tc.cursor
+		tc.sel(e)
+		if got := e.selectedText(); got != tc.want {
+			t.Errorf("%s: Got %q selected, wanted %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGoToSymbol(t *testing.T) {
+	funcPattern := regexp.MustCompile(`(?m)^func (\w+)`)
+	provider := func(content string) []Symbol {
+		res := []Symbol{}
+		for _, match := range funcPattern.FindAllStringSubmatchIndex(content, -1) {
+			line := strings.Count(content[:match[2]], "\n")
+			col := len([]rune(content[strings.LastIndex(content[:match[2]], "\n")+1 : match[2]]))
+			res = append(res, Symbol{Name: content[match[2]:match[3]], Kind: "func", Position: Position{Line: line, Col: col}})
+		}
+		return res
+	}
+	e := newTestEditor(t, 20, 3, "package x\n\nfunc a() {\n}\n\nfunc b() {\n}\n\nfunc c() {\n}")
+	if e.GoToSymbol("a") {
+		t.Errorf("Got symbol found without a provider")
+	}
+	e.SymbolProvider = provider
+	if got := len(e.Symbols()); got != 3 {
+		t.Errorf("Got %v symbols, wanted 3", got)
+	}
+	for _, tc := range []struct {
+		name       string
+		wantCursor point
+		wantOffset int
+	}{
+		{name: "c", wantCursor: point{5, 2}, wantOffset: 6},
+		{name: "a", wantCursor: point{5, 0}, wantOffset: 2},
+		{name: "b", wantCursor: point{5, 2}, wantOffset: 3},
+	} {
+		if !e.GoToSymbol(tc.name) {
+			t.Errorf("Got %q not found", tc.name)
+		}
+		if e.cursor != tc.wantCursor || e.lineOffset != tc.wantOffset {
+			t.Errorf("Got cursor %v at offset %v for %q, wanted %v at offset %v", e.cursor, e.lineOffset, tc.name, tc.wantCursor, tc.wantOffset)
+		}
+	}
+	if e.GoToSymbol("d") {
+		t.Errorf("Got missing symbol found")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "abc\ndef")
+	initial := e.ContentHash()
+	if got := e.ContentHash(); got != initial {
+		t.Errorf("Got hash %v on second call, wanted %v", got, initial)
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	if got := e.ContentHash(); got != initial {
+		t.Errorf("Got hash %v after moving, wanted %v", got, initial)
+	}
+	e.typeString("x")
+	edited := e.ContentHash()
+	if edited == initial {
+		t.Errorf("Got unchanged hash %v after typing", edited)
+	}
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got := e.ContentHash(); got != initial {
+		t.Errorf("Got hash %v after undo, wanted %v", got, initial)
+	}
+	e.SetContent("other")
+	if got := e.ContentHash(); got == initial || got == edited {
+		t.Errorf("Got stale hash %v after SetContent", got)
+	}
+
+	e.SetContent("a\nb")
+	if got, want := e.ContentHash(), hashString("a\nb"); got != want {
+		t.Errorf("Got hash %v with LineEnding \\n, wanted %v", got, want)
+	}
+	e.LineEnding = "\r\n"
+	if got, want := e.ContentHash(), hashString("a\r\nb"); got != want {
+		t.Errorf("Got hash %v after changing LineEnding to \\r\\n, wanted %v", got, want)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "abc def\nghi")
+	e.ReadOnly = true
+	bells := []string{}
+	e.OnBell = func(reason string) {
+		bells = append(bells, reason)
+	}
+	e.pasteBuffer = stringToRunes("old")
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.press(tcell.KeyCtrlC, 0, tcell.ModNone)
+	if got := runesToString(e.pasteBuffer); got != "abc" {
+		t.Errorf("Got %q copied, wanted %q", got, "abc")
+	}
+	e.pasteBuffer = stringToRunes("new")
+	for _, key := range []tcell.Key{tcell.KeyCtrlX, tcell.KeyCtrlV, tcell.KeyRune, tcell.KeyEnter, tcell.KeyBackspace2, tcell.KeyDelete, tcell.KeyTab} {
+		e.press(key, 'x', tcell.ModNone)
+	}
+	if got, want := e.Content(), "<select-from>abc<select-to> def\nghi"; got != want {
+		t.Errorf("Got %q after editing read-only, wanted %q", got, want)
+	}
+	if got := runesToString(e.pasteBuffer); got != "new" {
+		t.Errorf("Got %q in paste buffer after cutting read-only, wanted %q", got, "new")
+	}
+	if len(bells) != 7 || bells[0] != BellReadOnly {
+		t.Errorf("Got bells %+v, wanted 7 read-only bells", bells)
+	}
+	e.ReadOnly = false
+	e.press(tcell.KeyCtrlX, 0, tcell.ModNone)
+	if got, want := e.Content(), " def\nghi"; got != want {
+		t.Errorf("Got %q after cutting, wanted %q", got, want)
+	}
+}
+
+func TestIsVisible(t *testing.T) {
+	e := newTestEditor(t, 5, 3, "a\nb\nabcdefgh\nc\n<color:ff0000:000000>d\ne")
+	e.scroll(down)
+	e.scroll(down)
+	for _, tc := range []struct {
+		line, col int
+		want      bool
+	}{
+		{0, 0, false},
+		{1, 1, false},
+		{2, 0, true},
+		{2, 7, true},
+		{3, 0, true},
+		{4, 0, false},
+		{4, 21, false},
+		{5, 0, false},
+		{2, 9, false},
+		{6, 0, false},
+		{-1, 0, false},
+	} {
+		if got := e.IsVisible(tc.line, tc.col); got != tc.want {
+			t.Errorf("Got visible %v for %v:%v, wanted %v", got, tc.line, tc.col, tc.want)
+		}
+	}
+	e.scroll(down)
+	e.scroll(down)
+	for _, tc := range []struct {
+		line, col int
+		want      bool
+	}{
+		{2, 0, false},
+		{2, 5, false},
+		{3, 0, true},
+		{4, 0, true},
+		{4, 21, true},
+	} {
+		if got := e.IsVisible(tc.line, tc.col); got != tc.want {
+			t.Errorf("Got visible %v for %v:%v after scrolling further, wanted %v", got, tc.line, tc.col, tc.want)
+		}
+	}
+}
+
+func TestInsertAt(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		line, col   int
+		text        string
+		wantContent string
+		wantCursor  point
+	}{
+		{
+			name:        "before cursor",
+			line:        1,
+			col:         0,
+			text:        "<x>",
+			wantContent: "abc\n&lt;x&gt;def\nghi",
+			wantCursor:  point{5, 1},
+		},
+		{
+			name:        "at cursor",
+			line:        1,
+			col:         2,
+			text:        "1\n2",
+			wantContent: "abc\nde1\n2f\nghi",
+			wantCursor:  point{1, 2},
+		},
+		{
+			name:        "after cursor",
+			line:        1,
+			col:         3,
+			text:        "x",
+			wantContent: "abc\ndefx\nghi",
+			wantCursor:  point{2, 1},
+		},
+		{
+			name:        "lines before cursor",
+			line:        0,
+			col:         1,
+			text:        "1\n2\n",
+			wantContent: "a1\n2\nbc\ndef\nghi",
+			wantCursor:  point{2, 3},
+		},
+		{
+			name:        "clamped",
+			line:        9,
+			col:         9,
+			text:        "x",
+			wantContent: "abc\ndef\nghix",
+			wantCursor:  point{2, 1},
+		},
+	} {
+		e := newTestEditor(t, 20, 5, "abc\ndef\nghi")
+		e.press(tcell.KeyDown, 0, tcell.ModNone)
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+		e.InsertAt(tc.line, tc.col, tc.text)
+		if got := e.Content(); got != tc.wantContent {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.wantContent)
+		}
+		if e.cursor != tc.wantCursor {
+			t.Errorf("%s: Got cursor %v, wanted %v", tc.name, e.cursor, tc.wantCursor)
+		}
+		e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		if got := e.Content(); got != "abc\ndef\nghi" {
+			t.Errorf("%s: Got %q after undo", tc.name, got)
+		}
+	}
+}
+
+func TestReplaceRange(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		content     string
+		from, to    Position
+		text        string
+		wantContent string
+		wantCursor  point
+	}{
+		{
+			name:        "single line",
+			content:     "abc def ghi",
+			from:        Position{0, 4},
+			to:          Position{0, 7},
+			text:        "x<y",
+			wantContent: "abc x&lt;y ghi",
+			wantCursor:  point{7, 0},
+		},
+		{
+			name:        "reversed",
+			content:     "abc def ghi",
+			from:        Position{0, 7},
+			to:          Position{0, 4},
+			text:        "",
+			wantContent: "abc  ghi",
+			wantCursor:  point{4, 0},
+		},
+		{
+			name:        "multi line",
+			content:     "abc\ndef\nghi",
+			from:        Position{0, 1},
+			to:          Position{2, 2},
+			text:        "1\n2",
+			wantContent: "a1\n2i",
+			wantCursor:  point{1, 1},
+		},
+		{
+			name:        "into lines",
+			content:     "abc\ndef",
+			from:        Position{1, 1},
+			to:          Position{1, 1},
+			text:        "1\n2\n3",
+			wantContent: "abc\nd1\n2\n3ef",
+			wantCursor:  point{1, 3},
+		},
+		{
+			name:        "clamped",
+			content:     "abc\ndef",
+			from:        Position{1, 1},
+			to:          Position{5, 0},
+			text:        "x",
+			wantContent: "abc\ndx",
+			wantCursor:  point{2, 1},
+		},
+		{
+			name:        "keeps selection",
+			content:     "ab<select-from>cd<select-to>ef",
+			from:        Position{0, 1},
+			to:          Position{0, 16},
+			text:        "x",
+			wantContent: "ax<select-from>d<select-to>ef",
+			wantCursor:  point{2, 0},
+		},
+	} {
+		e := newTestEditor(t, 20, 5, tc.content)
+		e.ReplaceRange(tc.from, tc.to, tc.text)
+		if got := e.Content(); got != tc.wantContent {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.wantContent)
+		}
+		if e.cursor != tc.wantCursor {
+			t.Errorf("%s: Got cursor %v, wanted %v", tc.name, e.cursor, tc.wantCursor)
+		}
+		e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		if got := e.Content(); got != tc.content {
+			t.Errorf("%s: Got %q after undo, wanted %q", tc.name, got, tc.content)
+		}
+	}
+}
+
+func TestApplyEdits(t *testing.T) {
+	content := "func a() {\n\treturn 1\n}\nfunc b() {}"
+	e := newTestEditor(t, 20, 5, content)
+	if err := e.ApplyEdits([]Edit{
+		{Span: Span{Position{3, 5}, Position{3, 6}}, Text: "bee"},
+		{Span: Span{Position{1, 0}, Position{1, 1}}, Text: "    "},
+		{Span: Span{Position{0, 5}, Position{0, 6}}, Text: "ay"},
+		{Span: Span{Position{1, 9}, Position{1, 9}}, Text: " + 1"},
+		{Span: Span{Position{1, 9}, Position{1, 9}}, Text: " + 2"},
+		{Span: Span{Position{2, 1}, Position{2, 0}}, Text: "} // a"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.Content(), "func ay() {\n    return 1 + 1 + 2\n} // a\nfunc bee() {}"; got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+	if e.cursor != (point{7, 0}) {
+		t.Errorf("Got cursor %v, wanted after the first edit", e.cursor)
+	}
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got := e.Content(); got != content {
+		t.Errorf("Got %q after undo, wanted %q", got, content)
+	}
+	if err := e.ApplyEdits([]Edit{
+		{Span: Span{Position{0, 0}, Position{0, 4}}, Text: "fn"},
+		{Span: Span{Position{0, 3}, Position{0, 6}}, Text: "x"},
+	}); err == nil {
+		t.Errorf("Got no error for overlapping edits")
+	}
+	if got := e.Content(); got != content {
+		t.Errorf("Got %q after overlapping edits, wanted it unchanged", got)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	spaces := regexp.MustCompile(` +`)
+	trailing := regexp.MustCompile(` +(\n|$)`)
+	content := "a   b  c\nd    e  \nf"
+	e := newTestEditor(t, 20, 5, content)
+	e.Formatter = func(s string) (string, error) {
+		return trailing.ReplaceAllString(spaces.ReplaceAllString(s, " "), "$1"), nil
+	}
+	for _, r := range "~~~~~~~" {
+		e.press(tcell.KeyRight, r, tcell.ModNone)
+	}
+	e.press(tcell.KeyRune, 'F', tcell.ModAlt)
+	if got, want := e.Content(), "a b c\nd e\nf"; got != want {
+		t.Errorf("Got %q after formatting, wanted %q", got, want)
+	}
+	if e.cursor != (point{4, 0}) {
+		t.Errorf("Got cursor %v after formatting, wanted it on the same rune at 4,0", e.cursor)
+	}
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	if err := e.Format(); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.undoPatches) != 1 {
+		t.Errorf("Got %v undo patches after formatting formatted content, wanted 1", len(e.undoPatches))
+	}
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got := e.Content(); got != content {
+		t.Errorf("Got %q after undo, wanted %q", got, content)
+	}
+	bells := []string{}
+	e.OnBell = func(reason string) {
+		bells = append(bells, reason)
+	}
+	e.Formatter = func(s string) (string, error) {
+		return "", fmt.Errorf("syntax error")
+	}
+	e.press(tcell.KeyRune, 'F', tcell.ModAlt)
+	if got := e.Content(); got != content {
+		t.Errorf("Got %q after failed formatting, wanted %q", got, content)
+	}
+	if !reflect.DeepEqual(bells, []string{BellFormat}) {
+		t.Errorf("Got bells %+v, wanted a format bell", bells)
+	}
+
+	e.Formatter = func(s string) (string, error) {
+		return "a < b & c", nil
+	}
+	if err := e.Format(); err == nil {
+		t.Errorf("Got no error formatting to invalid markup")
+	}
+	if got := e.Content(); got != content {
+		t.Errorf("Got %q after formatting to invalid markup, wanted %q", got, content)
+	}
+	e.Formatter = func(s string) (string, error) {
+		return "<color:ff0000:000000>a &lt; b", nil
+	}
+	if err := e.Format(); err != nil {
+		t.Errorf("Got %v formatting to valid markup", err)
+	}
+	if got, want := e.Content(), "<color:ff0000:000000>a &lt; b"; got != want {
+		t.Errorf("Got %q after formatting to valid markup, wanted %q", got, want)
+	}
+}
+
+func TestHardTabs(t *testing.T) {
+	e := newTestEditor(t, 10, 5, "ab")
+	e.UseHardTabs = true
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyTab, 0, tcell.ModNone)
+	if got := e.Content(); got != "a\tb" {
+		t.Errorf("Got %q after tab, wanted %q", got, "a\tb")
+	}
+	if e.cursor != (point{4, 0}) {
+		t.Errorf("Got cursor %v after tab, wanted it at the next tab stop", e.cursor)
+	}
+	if got := e.RenderToString(); got != "a   b\n\n\n\n" {
+		t.Errorf("Got rendered %q", got)
+	}
+	e.press(tcell.KeyLeft, 0, tcell.ModNone)
+	if e.cursor != (point{1, 0}) {
+		t.Errorf("Got cursor %v after moving left over the tab, wanted 1,0", e.cursor)
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	if e.cursor != (point{4, 0}) {
+		t.Errorf("Got cursor %v after moving right over the tab, wanted 4,0", e.cursor)
+	}
+	e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+	if got := e.Content(); got != "ab" {
+		t.Errorf("Got %q after backspace, wanted %q", got, "ab")
+	}
+	if e.cursor != (point{1, 0}) {
+		t.Errorf("Got cursor %v after backspace, wanted 1,0", e.cursor)
+	}
+
+	e = newTestEditor(t, 10, 5, "\tx\n\t\ty\nabcdefghi\tj")
+	if got := e.RenderToString(); got != "    x\n        y\nabcdefghi\nj\n" {
+		t.Errorf("Got rendered %q, wanted tabs to stop at the end of the screen line", got)
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	if e.cursor != (point{5, 0}) {
+		t.Errorf("Got cursor %v, wanted 5,0", e.cursor)
+	}
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	if e.cursor != (point{4, 1}) {
+		t.Errorf("Got cursor %v after moving down into a tab, wanted it at the start of the tab", e.cursor)
+	}
+}
+
+func TestMapPosition(t *testing.T) {
+	for _, tc := range []struct {
+		old, new string
+		p, want  Position
+	}{
+		{"a=b+c", "a = b + c", Position{0, 4}, Position{0, 8}},
+		{"a=b+c", "a = b + c", Position{0, 2}, Position{0, 4}},
+		{"a = b + c", "a=b+c", Position{0, 8}, Position{0, 4}},
+		{"a = b + c", "a=b+c", Position{0, 5}, Position{0, 3}},
+		{"if x {\ny()\n}", "if x {\n\ty()\n}", Position{1, 1}, Position{1, 2}},
+		{"f(a,b)\ng()", "f(\n\ta,\n\tb,\n)\ng()", Position{1, 1}, Position{4, 1}},
+		{"abc", "abc", Position{5, 5}, Position{0, 3}},
+	} {
+		if got := MapPosition(tc.old, tc.new, tc.p); got != tc.want {
+			t.Errorf("Got %+v mapping %+v from %q to %q, wanted %+v", got, tc.p, tc.old, tc.new, tc.want)
+		}
+	}
+	e := newTestEditor(t, 20, 5, "x=1\ny=2")
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.SetContent("x = 1\ny = 2")
+	if e.cursor != (point{4, 1}) {
+		t.Errorf("Got cursor %v after SetContent, wanted it still before the 2", e.cursor)
+	}
+}
+
+func TestDedent(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		content    string
+		keys       func(e *Editor)
+		want       string
+		wantCursor point
+	}{
+		{
+			name:    "line",
+			content: "      abc\n    def",
+			keys: func(e *Editor) {
+				e.GoToColumn(7)
+				e.press(tcell.KeyBacktab, 0, tcell.ModNone)
+			},
+			want:       "  abc\n    def",
+			wantCursor: point{3, 0},
+		},
+		{
+			name:    "short indentation",
+			content: "  abc",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyTab, 0, tcell.ModShift)
+			},
+			want:       "abc",
+			wantCursor: point{0, 0},
+		},
+		{
+			name:    "no indentation",
+			content: "abc",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyBacktab, 0, tcell.ModNone)
+			},
+			want:       "abc",
+			wantCursor: point{1, 0},
+		},
+		{
+			name:    "tab",
+			content: "\t\tabc",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyBacktab, 0, tcell.ModNone)
+			},
+			want:       "\tabc",
+			wantCursor: point{0, 0},
+		},
+		{
+			name:    "selection",
+			content: "    a\n  b\nc\n        d\n    e",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyBacktab, 0, tcell.ModNone)
+			},
+			want:       "<select-from>a\nb\nc\n<select-to>    d\n    e",
+			wantCursor: point{0, 3},
+		},
+		{
+			name:    "selection ending at line start",
+			content: "    a\n    b",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				// The first Home goes to the text of the line.
+				e.press(tcell.KeyHome, 0, tcell.ModShift)
+				e.press(tcell.KeyHome, 0, tcell.ModShift)
+				e.press(tcell.KeyBacktab, 0, tcell.ModNone)
+			},
+			want:       "<select-from>a\n<select-to>    b",
+			wantCursor: point{0, 1},
+		},
+	} {
+		e := newTestEditor(t, 20, 10, tc.content)
+		tc.keys(e)
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if e.cursor != tc.wantCursor {
+			t.Errorf("%s: Got cursor %v, wanted %v", tc.name, e.cursor, tc.wantCursor)
+		}
+		if tc.want != tc.content {
+			e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+			if got := e.Content(); !strings.HasPrefix(selectTokenPattern.ReplaceAllString(got, ""), tc.content) {
+				t.Errorf("%s: Got %q after undo, wanted %q", tc.name, got, tc.content)
+			}
+		}
+	}
+}
+
+func TestWideRunesAndTabs(t *testing.T) {
+	e := newTestEditor(t, 12, 5, "日本\tx\na\t日\ty\n日本語日本語x")
+	if got, want := e.RenderToString(), "日本    x\na   日  y\n日本語日本語\nx\n"; got != want {
+		t.Errorf("Got rendered %q, wanted %q", got, want)
+	}
+	for _, tc := range []struct {
+		key        tcell.Key
+		wantCursor point
+	}{
+		{tcell.KeyRight, point{2, 0}},
+		{tcell.KeyRight, point{4, 0}},
+		{tcell.KeyRight, point{8, 0}},
+		{tcell.KeyLeft, point{4, 0}},
+		{tcell.KeyDown, point{4, 1}},
+		{tcell.KeyRight, point{6, 1}},
+		{tcell.KeyRight, point{8, 1}},
+		{tcell.KeyLeft, point{6, 1}},
+		{tcell.KeyUp, point{4, 0}},
+	} {
+		e.press(tc.key, 0, tcell.ModNone)
+		if e.cursor != tc.wantCursor {
+			t.Errorf("Got cursor %v, wanted %v", e.cursor, tc.wantCursor)
+		}
+	}
+	e = newTestEditor(t, 4, 5, "a日本")
+	if got, want := e.RenderToString(), "a日\n本\n\n\n"; got != want {
+		t.Errorf("Got rendered %q, wanted wide runes that don't fit on the next line", got)
+	}
+	e = newTestEditor(t, 6, 5, "a😀b日c")
+	for _, tc := range []struct {
+		click      point
+		wantCursor point
+	}{
+		{point{2, 0}, point{1, 0}},
+		{point{5, 0}, point{4, 0}},
+		{point{1, 1}, point{1, 1}},
+	} {
+		e.click(tc.click.x, tc.click.y)
+		if e.cursor != tc.wantCursor {
+			t.Errorf("Got cursor %v after clicking %v, wanted the start of the wide rune at %v", e.cursor, tc.click, tc.wantCursor)
+		}
+	}
+}
+
+func TestIndentSelection(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		content       string
+		hardTabs      bool
+		keys          func(e *Editor)
+		want          string
+		wantSelection string
+	}{
+		{
+			name:    "lines",
+			content: "ab\ncd\nef\ngh",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+			},
+			want:          "    a<select-from>b\n    cd\n    e<select-to>f\ngh",
+			wantSelection: "b\n    cd\n    e",
+		},
+		{
+			name:    "ending at line start",
+			content: "ab\ncd\nef",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+			},
+			want:          "    <select-from>ab\n    cd\n<select-to>ef",
+			wantSelection: "ab\n    cd\n",
+		},
+		{
+			name:     "hard tabs",
+			content:  "ab\ncd",
+			hardTabs: true,
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyRight, 0, tcell.ModShift)
+			},
+			want:          "\t<select-from>ab\n\tc<select-to>d",
+			wantSelection: "ab\n\tc",
+		},
+		{
+			name:    "single line",
+			content: "abc",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModShift)
+			},
+			want:          "<select-from>a<select-to>   bc",
+			wantSelection: "a",
+		},
+	} {
+		e := newTestEditor(t, 20, 10, tc.content)
+		e.UseHardTabs = tc.hardTabs
+		tc.keys(e)
+		selected := e.Content()
+		e.press(tcell.KeyTab, 0, tcell.ModNone)
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if got := e.selectedText(); got != tc.wantSelection {
+			t.Errorf("%s: Got %q selected, wanted %q", tc.name, got, tc.wantSelection)
+		}
+		e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		if got := e.Content(); got != selected {
+			t.Errorf("%s: Got %q after undo, wanted %q", tc.name, got, selected)
+		}
+	}
+}
+
+type recordingObserver []string
+
+func (r *recordingObserver) OnEdit(kind string, from, to Position) {
+	*r = append(*r, fmt.Sprintf("edit %s %v:%v-%v:%v", kind, from.Line, from.Col, to.Line, to.Col))
+}
+
+func (r *recordingObserver) OnCursorMove(p Position) {
+	*r = append(*r, fmt.Sprintf("cursor %v:%v", p.Line, p.Col))
+}
+
+func (r *recordingObserver) OnSelectionChange(from, to Position) {
+	*r = append(*r, fmt.Sprintf("selection %v:%v-%v:%v", from.Line, from.Col, to.Line, to.Col))
+}
+
+func TestObserver(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "x\ny")
+	observer := &recordingObserver{}
+	e.Observer = observer
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.typeString("ab")
+	e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+	e.press(tcell.KeyLeft, 0, tcell.ModShift)
+	e.press(tcell.KeyDelete, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.ReplaceRange(Position{0, 0}, Position{0, 1}, "zz")
+	want := recordingObserver{
+		"cursor 1:0",
+		"edit insert 1:0-1:1",
+		"cursor 1:1",
+		"edit insert 1:1-1:2",
+		"cursor 1:2",
+		"edit delete 1:1-1:2",
+		"cursor 1:1",
+		"selection 1:0-1:1",
+		"cursor 1:0",
+		"edit delete 1:0-1:1",
+		"selection 0:0-0:0",
+		"cursor 1:1",
+		"edit replace 0:0-0:1",
+		"cursor 0:2",
+	}
+	if !reflect.DeepEqual(*observer, want) {
+		t.Errorf("Got events\n%q\n, wanted\n%q", *observer, want)
+	}
+}
+
+func TestFind(t *testing.T) {
+	e := newTestEditor(t, 20, 3, "foo bar\nFoo <color:ff0000:000000>baz\n\nbar foo")
+	for _, tc := range []struct {
+		query           string
+		caseInsensitive bool
+		want            string
+		wantCursor      point
+		wantOffset      int
+	}{
+		{"foo", false, "<select-from>foo<select-to> bar\nFoo <color:ff0000:000000>baz\n\nbar foo", point{3, 0}, 0},
+		{"foo", false, "foo bar\nFoo <color:ff0000:000000>baz\n\nbar <select-from>foo<select-to>", point{7, 2}, 1},
+		{"foo", true, "<select-from>foo<select-to> bar\nFoo <color:ff0000:000000>baz\n\nbar foo", point{3, 0}, 0},
+		{"foo", true, "foo bar\n<select-from>Foo<select-to> <color:ff0000:000000>baz\n\nbar foo", point{3, 1}, 0},
+		{"O B", true, "fo<select-from>o b<select-to>ar\nFoo <color:ff0000:000000>baz\n\nbar foo", point{5, 0}, 0},
+		{"O B", true, "foo bar\nFo<select-from>o <color:ff0000:000000>b<select-to>az\n\nbar foo", point{5, 1}, 0},
+	} {
+		if !e.Find(tc.query, tc.caseInsensitive) {
+			t.Errorf("Got %q not found", tc.query)
+		}
+		if got := e.Content(); got != tc.want {
+			t.Errorf("Got %q after finding %q, wanted %q", got, tc.query, tc.want)
+		}
+		if e.cursor != tc.wantCursor || e.lineOffset != tc.wantOffset {
+			t.Errorf("Got cursor %v at offset %v after finding %q, wanted %v at offset %v", e.cursor, e.lineOffset, tc.query, tc.wantCursor, tc.wantOffset)
+		}
+	}
+	for _, query := range []string{"O B", "zzz", ""} {
+		if e.Find(query, false) {
+			t.Errorf("Got %q found, wanted no match", query)
+		}
+	}
+}
+
+func TestFindPrompt(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "abc\nxyz abc")
+	bells := []string{}
+	e.OnBell = func(reason string) {
+		bells = append(bells, reason)
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyCtrlF, 0, tcell.ModNone)
+	e.typeString("abx")
+	e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+	e.typeString("c")
+	if got := strings.Split(e.RenderToString(), "\n")[4]; got != "Find: abc" {
+		t.Errorf("Got bottom line %q while finding, wanted the prompt", got)
+	}
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	if got, want := e.Content(), "abc\nxyz <select-from>abc<select-to>"; got != want {
+		t.Errorf("Got %q after finding, wanted %q", got, want)
+	}
+	e.press(tcell.KeyCtrlF, 0, tcell.ModNone)
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	if got, want := e.Content(), "<select-from>abc<select-to>\nxyz abc"; got != want {
+		t.Errorf("Got %q after finding again, wanted %q", got, want)
+	}
+	e.press(tcell.KeyCtrlF, 0, tcell.ModNone)
+	e.typeString("q")
+	e.press(tcell.KeyEsc, 0, tcell.ModNone)
+	e.press(tcell.KeyCtrlF, 0, tcell.ModNone)
+	e.typeString("q")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	if !reflect.DeepEqual(bells, []string{BellNotFound}) {
+		t.Errorf("Got bells %+v, wanted one not-found bell", bells)
+	}
+	if got := strings.Split(e.RenderToString(), "\n")[4]; got != "" {
+		t.Errorf("Got bottom line %q after finding, wanted the prompt gone", got)
+	}
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := e.Content(), "abc\nxyz <select-from>abc<select-to>"; got != want {
+		t.Errorf("Got %q after undo, wanted %q", got, want)
+	}
+}
+
+func TestFindNextPrev(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "ab <color:ff0000:000000>a<color:000000:ffffff>b abab")
+	if e.FindNext() {
+		t.Errorf("Got match without a query")
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	if !e.Find("ab", false) {
+		t.Fatalf("Got no match")
+	}
+	selections := []string{}
+	record := func() {
+		line, col := e.lineRuneColumn(e.cursor)
+		selections = append(selections, fmt.Sprintf("%v:%v %q", line, col, e.selectedText()))
+	}
+	record()
+	for _, f := range []func(){
+		func() { e.FindNext() },
+		func() { e.FindNext() },
+		func() { e.FindNext() },
+		func() { e.FindPrev() },
+		func() { e.press(tcell.KeyF3, 0, tcell.ModShift) },
+		func() { e.press(tcell.KeyF3, 0, tcell.ModNone) },
+		func() {
+			e.press(tcell.KeyLeft, 0, tcell.ModNone)
+			e.press(tcell.KeyF3, 0, tcell.ModNone)
+		},
+	} {
+		f()
+		record()
+	}
+	want := []string{
+		`0:5 "ab"`,
+		`0:8 "ab"`,
+		`0:10 "ab"`,
+		`0:2 "ab"`,
+		`0:10 "ab"`,
+		`0:8 "ab"`,
+		`0:10 "ab"`,
+		`0:2 "ab"`,
+	}
+	if !reflect.DeepEqual(selections, want) {
+		t.Errorf("Got selections %q, wanted %q", selections, want)
+	}
+}
+
+func TestFindNextFromMatchAtCursor(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "ab ab ab")
+	if !e.Find("ab", false) {
+		t.Fatalf("Got no match")
+	}
+	e.press(tcell.KeyEsc, 0, tcell.ModNone)
+	e.press(tcell.KeyHome, 0, tcell.ModCtrl)
+	for _, want := range []string{"0:5", "0:8", "0:2"} {
+		e.FindNext()
+		line, col := e.lineRuneColumn(e.cursor)
+		if got := fmt.Sprintf("%v:%v", line, col); got != want || e.selectedText() != "ab" {
+			t.Errorf("Got cursor at %v selecting %q, wanted %v selecting \"ab\"", got, e.selectedText(), want)
+		}
+		e.press(tcell.KeyEsc, 0, tcell.ModNone)
+		e.press(tcell.KeyLeft, 0, tcell.ModNone)
+		e.press(tcell.KeyLeft, 0, tcell.ModNone)
+	}
+}
+
+func TestViewport(t *testing.T) {
+	e := NewHeadless(9, 5)
+	s := e.Screen.(tcell.SimulationScreen)
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 9; x++ {
+			s.SetContent(x, y, '.', nil, tcell.StyleDefault)
+		}
+	}
+	e.SetViewport(2, 1, 4, 3)
+	e.SetContent("abcdef\ng")
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	lines := []string{}
+	for y := 0; y < 5; y++ {
+		line := []rune{}
+		for x := 0; x < 9; x++ {
+			r, _, _, _ := s.GetContent(x, y)
+			line = append(line, r)
+		}
+		lines = append(lines, string(line))
+	}
+	want := []string{
+		".........",
+		"..abcd...",
+		"..ef  ...",
+		"..g   ...",
+		".........",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Got screen %q, wanted %q", lines, want)
+	}
+	if got, want := e.RenderToString(), "abcd\nef\ng"; got != want {
+		t.Errorf("Got rendered %q, wanted %q", got, want)
+	}
+	if x, y, visible := s.GetCursor(); !visible || x != 3 || y != 3 {
+		t.Errorf("Got cursor %v,%v visible %v, wanted 3,3 visible", x, y, visible)
+	}
+}
+
+func TestViewportInput(t *testing.T) {
+	e := newTestEditor(t, 10, 6, "abcdef\ngh\nij\nkl")
+	s := e.Screen.(tcell.SimulationScreen)
+	s.Clear()
+	e.SetViewport(3, 2, 4, 3)
+	for _, tc := range []struct {
+		x, y       int
+		wantCursor point
+	}{
+		{4, 2, point{1, 0}},
+		{5, 3, point{2, 1}},
+		{6, 4, point{2, 2}},
+		{0, 0, point{2, 2}},
+		{7, 2, point{2, 2}},
+		{4, 5, point{2, 2}},
+		{3, 2, point{0, 0}},
+	} {
+		e.click(tc.x, tc.y)
+		if e.cursor != tc.wantCursor {
+			t.Errorf("Got cursor %v after clicking %v,%v, wanted %v", e.cursor, tc.x, tc.y, tc.wantCursor)
+		}
+	}
+	e.click(5, 3)
+	e.typeString("XY")
+	if got, want := e.Content(), "abcdefXY\ngh\nij\nkl"; got != want {
+		t.Errorf("Got content %q, wanted %q", got, want)
+	}
+	for i := 0; i < 3; i++ {
+		e.press(tcell.KeyDown, 0, tcell.ModNone)
+	}
+	if e.cursor.y != 2 || e.lineOffset != 3 {
+		t.Errorf("Got cursor %v and offset %v, wanted the view to scroll after its 3 rows", e.cursor, e.lineOffset)
+	}
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 10; x++ {
+			if _, inside := e.view().inside(x, y); inside {
+				continue
+			}
+			if r, _, _, _ := s.GetContent(x, y); r != ' ' {
+				t.Errorf("Got %q at %v,%v outside the view, wanted it untouched", r, x, y)
+			}
+		}
+	}
+}
+
+func TestInteractiveReplace(t *testing.T) {
+	for _, tc := range []struct {
+		answers     string
+		wantContent string
+	}{
+		{"yny", "a dag, <color:00ff00:000000>a cat<color:000000:ffffff>, a dag"},
+		{"nyn", "a cat, <color:00ff00:000000>a dag<color:000000:ffffff>, a cat"},
+		{"na", "a cat, <color:00ff00:000000>a dag<color:000000:ffffff>, a dag"},
+		{"yq", "a dag, <color:00ff00:000000>a cat<color:000000:ffffff>, a cat"},
+		{"y\x1b", "a dag, <color:00ff00:000000>a cat<color:000000:ffffff>, a cat"},
+	} {
+		e := newTestEditor(t, 40, 5, "a cat, <color:00ff00:000000>a cat<color:000000:ffffff>, a cat")
+		e.press(tcell.KeyCtrlR, 0, tcell.ModNone)
+		e.typeString("c(a)t")
+		e.press(tcell.KeyEnter, 0, tcell.ModNone)
+		e.typeString("d${1}g")
+		e.press(tcell.KeyEnter, 0, tcell.ModNone)
+		if got := strings.Split(e.RenderToString(), "\n")[4]; got != "Replace? (y/n/a/q)" {
+			t.Errorf("Got bottom line %q while replacing, wanted the question", got)
+		}
+		if e.styleIndex[0][2] == e.styleIndex[0][0] || e.styleIndex[0][5] != e.styleIndex[0][0] {
+			t.Errorf("Got styles %v, wanted the first match highlighted", e.styleIndex[0][:6])
+		}
+		for _, answer := range tc.answers {
+			if answer == '\x1b' {
+				e.press(tcell.KeyEsc, 0, tcell.ModNone)
+			} else {
+				e.press(tcell.KeyRune, answer, tcell.ModNone)
+			}
+		}
+		if got := e.Content(); got != tc.wantContent {
+			t.Errorf("Got %q after answering %q, wanted %q", got, tc.answers, tc.wantContent)
+		}
+		if e.prompt != nil || e.candidate != nil {
+			t.Errorf("Got prompt %+v and candidate %v after answering %q, wanted neither", e.prompt, e.candidate, tc.answers)
+		}
+		e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		if got, want := e.Content(), "a cat, <color:00ff00:000000>a cat<color:000000:ffffff>, a cat"; got != want {
+			t.Errorf("Got %q after undoing %q, wanted %q", got, tc.answers, want)
+		}
+	}
+	e := newTestEditor(t, 40, 5, "x &lt;b&gt; y")
+	e.press(tcell.KeyCtrlR, 0, tcell.ModNone)
+	e.typeString("x (.*) y")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	e.typeString("<$1> & $1")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	e.press(tcell.KeyRune, 'y', tcell.ModNone)
+	if got, want := e.Content(), "&lt;&lt;b&gt;&gt; &amp; &lt;b&gt;"; got != want {
+		t.Errorf("Got %q after replacing with submatches, wanted %q", got, want)
+	}
+	if errs := e.Validate(); len(errs) > 0 {
+		t.Errorf("Got %v validating after replacing with submatches, wanted none", errs)
+	}
+
+	e = newTestEditor(t, 40, 5, "abc")
+	bells := []string{}
+	e.OnBell = func(reason string) {
+		bells = append(bells, reason)
+	}
+	e.press(tcell.KeyCtrlR, 0, tcell.ModNone)
+	e.typeString("(")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	e.press(tcell.KeyCtrlR, 0, tcell.ModNone)
+	e.typeString("x")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	if !reflect.DeepEqual(bells, []string{BellInvalidPattern, BellNotFound}) {
+		t.Errorf("Got bells %+v, wanted invalid-pattern and not-found", bells)
+	}
+
+	// Ctrl-Backspace, which terminals send as 0x08 like Ctrl-h, still removes a word.
+	e = newTestEditor(t, 40, 5, "foo bar")
+	e.press(tcell.KeyEnd, 0, tcell.ModNone)
+	e.press(tcell.KeyBackspace, 0, tcell.ModCtrl)
+	if e.prompt != nil {
+		t.Errorf("Got a prompt after Ctrl-Backspace, wanted none")
+	}
+	if got := e.Content(); got != "foo " {
+		t.Errorf("Got %q after Ctrl-Backspace, wanted the word removed", got)
+	}
+}
+
+func TestCells(t *testing.T) {
+	e := newTestEditor(t, 4, 3, "a<color:00ff00:000000>b日\ncd")
+	plain := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorWhite)
+	green := tcell.StyleDefault.Foreground(tcell.NewHexColor(0x00ff00)).Background(tcell.NewHexColor(0x000000))
+	want := [][]Cell{
+		{{Rune: 'a', Style: plain}, {Rune: 'b', Style: green}, {Rune: '日', Style: green}, {}},
+		// The full line wraps to an empty screen line.
+		{{Rune: ' '}, {Rune: ' '}, {Rune: ' '}, {Rune: ' '}},
+		{{Rune: 'c', Style: green}, {Rune: 'd', Style: green}, {Rune: ' '}, {Rune: ' '}},
+	}
+	if got := e.Cells(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got cells %+v, wanted %+v", got, want)
+	}
+	e.SetViewport(1, 1, 2, 1)
+	want = [][]Cell{
+		{{Rune: 'a', Style: plain}, {Rune: 'b', Style: green}},
+	}
+	if got := e.Cells(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got cells %+v in the viewport, wanted %+v", got, want)
+	}
+}
+
+func TestSearchHighlight(t *testing.T) {
+	e := newTestEditor(t, 5, 5, "ab xAb\nab")
+	plain := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorWhite)
+	selected := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
+	highlight := e.searchHighlightStyle()
+	styles := func() [][]tcell.Style {
+		res := [][]tcell.Style{}
+		for _, row := range e.Cells() {
+			styles := []tcell.Style{}
+			for _, cell := range row {
+				if cell.Rune != ' ' {
+					styles = append(styles, cell.Style)
+				}
+			}
+			res = append(res, styles)
+		}
+		return res
+	}
+	if !e.Find("ab", true) {
+		t.Fatalf("Got no match")
+	}
+	want := [][]tcell.Style{
+		// Matches wrapping to the next line are highlighted on both.
+		{selected, selected, plain, highlight},
+		{highlight},
+		{highlight, highlight},
+		{},
+		{},
+	}
+	if got := styles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got styles %v, wanted %v", got, want)
+	}
+	e.press(tcell.KeyEsc, 0, tcell.ModNone)
+	want = [][]tcell.Style{
+		{plain, plain, plain, plain},
+		{plain},
+		{plain, plain},
+		{},
+		{},
+	}
+	if got := styles(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got styles %v after Esc, wanted %v", got, want)
+	}
+}
+
+func TestSuppressUndo(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "")
+	e.typeString("a")
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	e.SuppressUndo = true
+	e.typeString("hello")
+	e.InsertAt(0, 5, " world")
+	e.SuppressUndo = false
+	if len(e.undoPatches) != 0 || len(e.redoPatches) != 0 {
+		t.Errorf("Got %v undo and %v redo patches, wanted none", len(e.undoPatches), len(e.redoPatches))
+	}
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := e.Content(), "hello world"; got != want {
+		t.Errorf("Got %q after undo, wanted %q", got, want)
+	}
+}
+
+func TestApplyRemotePatch(t *testing.T) {
+	local := newTestEditor(t, 20, 5, "hello world\nbye")
+	remote := newTestEditor(t, 20, 5, "hello world\nbye")
+	cursors := []Position{}
+	remote.OnPatch = func(p []diffmatchpatch.Patch, cursor Position) {
+		cursors = append(cursors, cursor)
+		if !local.ApplyRemotePatch(p) {
+			t.Errorf("Got patch %v not applied", p)
+		}
+	}
+	local.cursor = point{2, 1}
+	local.typeString("e")
+	remote.press(tcell.KeyRight, 0, tcell.ModNone)
+	remote.typeString("i, ")
+	if got, want := local.Content(), "hi, ello world\nbyee"; got != want {
+		t.Errorf("Got %q after the remote edit, wanted %q", got, want)
+	}
+	if line, col := local.lineRuneColumn(local.cursor); line != 1 || col != 3 {
+		t.Errorf("Got cursor at %v,%v, wanted it after the local edit at 1,3", line, col)
+	}
+	remote.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := local.Content(), "hi,ello world\nbyee"; got != want {
+		t.Errorf("Got %q after the remote undo, wanted %q", got, want)
+	}
+	if !reflect.DeepEqual(cursors, []Position{{0, 2}, {0, 3}, {0, 4}, {0, 3}}) {
+		t.Errorf("Got remote cursors %+v", cursors)
+	}
+	if len(local.undoPatches) != 1 {
+		t.Errorf("Got %v local undo patches, wanted only the local edit", len(local.undoPatches))
+	}
+	p := local.differ.PatchMake("0123456789", "0123X56789")
+	if local.ApplyRemotePatch(p) {
+		t.Errorf("Got a patch for different content applied")
+	}
+	if got, want := local.Content(), "hi,ello world\nbyee"; got != want {
+		t.Errorf("Got %q after a failed patch, wanted %q", got, want)
+	}
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// Not drawn yet, so the patch can't map a cursor.
+	unindexed := New(screen)
+	unindexed.ResetModified()
+	hash := unindexed.ContentHash()
+	if unindexed.IsModified() {
+		t.Errorf("Got the unindexed editor modified before the patch")
+	}
+	if !unindexed.ApplyRemotePatch(unindexed.differ.PatchMake("", "a")) {
+		t.Errorf("Got the patch to the unindexed editor not applied")
+	}
+	if unindexed.ContentHash() == hash {
+		t.Errorf("Got the content hash unchanged by the patch to the unindexed editor")
+	}
+	if !unindexed.IsModified() {
+		t.Errorf("Got the unindexed editor unmodified after the patch")
+	}
+}
+
+func TestGoToLine(t *testing.T) {
+	e := newTestEditor(t, 4, 3, "a\nbcdefgh\ni\nj\nk")
+	for _, tc := range []struct {
+		line           int
+		wantLineOffset int
+		wantCursor     point
+	}{
+		{4, 2, point{0, 2}},
+		{2, 1, point{0, 0}},
+		{1, 0, point{0, 0}},
+		{99, 3, point{0, 2}},
+		{-1, 0, point{0, 0}},
+	} {
+		e.GoToLine(tc.line)
+		if e.lineOffset != tc.wantLineOffset || e.cursor != tc.wantCursor {
+			t.Errorf("Got offset %v and cursor %v going to line %v, wanted %v and %v", e.lineOffset, e.cursor, tc.line, tc.wantLineOffset, tc.wantCursor)
+		}
+	}
+	bells := []string{}
+	e.OnBell = func(reason string) {
+		bells = append(bells, reason)
+	}
+	e.press(tcell.KeyCtrlG, 0, tcell.ModNone)
+	e.typeString("3")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	if line, _ := e.lineColumn(e.cursor); line != 2 {
+		t.Errorf("Got cursor on line %v after Ctrl-g 3, wanted 2", line)
+	}
+	e.press(tcell.KeyCtrlG, 0, tcell.ModNone)
+	e.typeString("x")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	if !reflect.DeepEqual(bells, []string{BellInvalidLine}) {
+		t.Errorf("Got bells %+v, wanted one invalid-line bell", bells)
+	}
+}
+
+func TestLineNumbers(t *testing.T) {
+	e := newTestEditor(t, 7, 5, "a\nbcdefg\n\nd\ne\nf\ng\nh\ni\nj")
+	e.ShowLineNumbers = true
+	e.redraw()
+	e.setCursor()
+	if got, want := e.RenderToString(), " 1 a\n 2 bcde\n   fg\n 3\n 4 d"; got != want {
+		t.Errorf("Got rendered %q, wanted %q", got, want)
+	}
+	e.click(4, 2)
+	e.typeString("X")
+	if got, want := e.Content(), "a\nbcdefXg\n\nd\ne\nf\ng\nh\ni\nj"; got != want {
+		t.Errorf("Got %q after clicking and typing, wanted %q", got, want)
+	}
+	e.click(1, 4)
+	e.typeString("Y")
+	if got, want := e.Content(), "a\nbcdefXg\n\nYd\ne\nf\ng\nh\ni\nj"; got != want {
+		t.Errorf("Got %q after clicking the line number and typing, wanted %q", got, want)
+	}
+	e.press(tcell.KeyEnd, 0, tcell.ModCtrl)
+	if got, want := e.RenderToString(), " 7 g\n 8 h\n 9 i\n10 j"; !strings.HasSuffix(got, want) {
+		t.Errorf("Got rendered %q, wanted it to end with %q", got, want)
+	}
+	if x, y, _ := e.Screen.(tcell.SimulationScreen).GetCursor(); x != 4 || y != 4 {
+		t.Errorf("Got cursor shown at %v,%v, wanted 4,4", x, y)
+	}
+}
+
+func TestIncrementalLayout(t *testing.T) {
+	e := newTestEditor(t, 6, 5, "abc<color:ff0000:000000>def\nghijklmn\n日本語日本\n\tx\n<select-from>y\nz<select-to>\nlast")
+	e.LineLengthLimit = 4
+	e.redraw()
+	for _, tc := range []struct {
+		edit func()
+		// Whether the first screen line is kept from the layout before the edit.
+		keepsFirst bool
+	}{
+		{func() { e.InsertAt(6, 4, "!") }, true},
+		{func() { e.InsertAt(2, 0, "日") }, true},
+		{func() {
+			e.rawBuffer[1] = append([]rune("<color:00ff00:000000>"), e.rawBuffer[1]...)
+			e.redraw()
+		}, true},
+		{func() { e.InsertAt(4, 0, "a\nb") }, true},
+		{func() { e.ReplaceRange(Position{5, 0}, Position{8, 0}, "") }, true},
+		{func() { e.InsertAt(6, 4, "\nmore\n") }, true},
+		{func() { e.ReplaceRange(Position{5, 0}, Position{8, 0}, "") }, true},
+		{func() { e.Find("k", false) }, false},
+		{func() { e.InsertAt(3, 0, "k") }, true},
+		{func() { e.InsertAt(0, 0, "x") }, false},
+	} {
+		first := &e.screenBuffer[0][0]
+		tc.edit()
+		if keptFirst := first == &e.screenBuffer[0][0]; keptFirst != tc.keepsFirst {
+			t.Errorf("Got first screen line kept %v laying out %q, wanted %v", keptFirst, e.Content(), tc.keepsFirst)
+		}
+		screenBuffer, screenBufferIndex, styleIndex := e.screenBuffer, e.screenBufferIndex, e.styleIndex
+		e.laidOut = nil
+		e.layout()
+		if !reflect.DeepEqual(screenBuffer, e.screenBuffer) || !reflect.DeepEqual(screenBufferIndex, e.screenBufferIndex) || !reflect.DeepEqual(styleIndex, e.styleIndex) {
+			t.Errorf("Got layout %q %v %v of %q, wanted %q %v %v", screenBuffer, screenBufferIndex, styleIndex, e.Content(), e.screenBuffer, e.screenBufferIndex, e.styleIndex)
+		}
+	}
+}
+
+func BenchmarkTyping(b *testing.B) {
+	e := NewHeadless(80, 25)
+	e.SetContent(strings.Repeat("<color:ff0000:000000>Lorem ipsum dolor sit amet, consectetur adipiscing elit.\n", 2000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.InsertAt(1500, 0, "x")
+	}
+}
+
+type testClipboard struct {
+	content string
+	err     error
+}
+
+func (c *testClipboard) Get() (string, error) {
+	return c.content, c.err
+}
+
+func (c *testClipboard) Set(s string) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.content = s
+	return nil
+}
+
+func TestClipboard(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "a<select-from>b&amp;\nc<select-to>d")
+	clipboard := &testClipboard{}
+	e.Clipboard = clipboard
+	e.press(tcell.KeyCtrlC, 0, tcell.ModNone)
+	if got, want := clipboard.content, "b&\nc"; got != want {
+		t.Errorf("Got clipboard %q after copying, wanted %q", got, want)
+	}
+	clipboard.content = "x<y\r\nz"
+	e.cursor = point{1, 1}
+	e.press(tcell.KeyCtrlV, 0, tcell.ModNone)
+	if got, want := e.Content(), "a<select-from>b&amp;\nc<select-to>x&lt;y\nzd"; got != want {
+		t.Errorf("Got %q after pasting, wanted %q", got, want)
+	}
+	e.SetContent("<select-from>cut<select-to> me")
+	e.press(tcell.KeyCtrlX, 0, tcell.ModNone)
+	if got, want := clipboard.content, "cut"; got != want {
+		t.Errorf("Got clipboard %q after cutting, wanted %q", got, want)
+	}
+	clipboard.err = fmt.Errorf("no clipboard")
+	e.SetContent("<select-from>kept<select-to> ")
+	e.press(tcell.KeyCtrlC, 0, tcell.ModNone)
+	e.press(tcell.KeyEnd, 0, tcell.ModNone)
+	e.press(tcell.KeyCtrlV, 0, tcell.ModNone)
+	if got, want := e.Content(), "<select-from>kept<select-to> kept"; got != want {
+		t.Errorf("Got %q after pasting with a failing clipboard, wanted %q", got, want)
+	}
+}
+
+func TestSelectAllKey(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "a<select-from>b<select-to>c\nde")
+	e.press(tcell.KeyCtrlA, 0, tcell.ModNone)
+	if got, want := e.Content(), "<select-from>abc\nde<select-to>"; got != want {
+		t.Errorf("Got %q after Ctrl-a, wanted %q", got, want)
+	}
+	if want := (point{2, 1}); e.cursor != want || !e.selecting {
+		t.Errorf("Got cursor %v selecting %v, wanted %v selecting", e.cursor, e.selecting, want)
+	}
+	if got, want := e.selectedText(), "abc\nde"; got != want {
+		t.Errorf("Got selection %q, wanted %q", got, want)
+	}
+	e.press(tcell.KeyF1, 0, tcell.ModNone)
+	if !strings.Contains(e.RenderToString(), "F1") {
+		t.Errorf("Got %q after F1, wanted the help", e.RenderToString())
+	}
+}
+
+func TestHelpMessage(t *testing.T) {
+	for _, tc := range []struct {
+		tabWidth    int
+		useHardTabs bool
+		helpMessage string
+		want        string
+	}{
+		{want: "\nTab: Insert spaces to next 4-wide tab, or indent selected lines\n"},
+		{tabWidth: 2, want: "\nTab: Insert spaces to next 2-wide tab, or indent selected lines\n"},
+		{useHardTabs: true, want: "\nTab: Insert a tab, or indent selected lines\n"},
+		{helpMessage: "custom", want: "custom"},
+	} {
+		e := newTestEditor(t, 20, 5, "")
+		e.TabWidth, e.UseHardTabs, e.HelpMessage = tc.tabWidth, tc.useHardTabs, tc.helpMessage
+		if got := e.helpMessage(); !strings.Contains(got, tc.want) {
+			t.Errorf("Got help %q with TabWidth %v and UseHardTabs %v, wanted it to contain %q", got, tc.tabWidth, tc.useHardTabs, tc.want)
+		}
+	}
+}
+
+func TestMouseDrag(t *testing.T) {
+	for _, tc := range []struct {
+		from, to      point
+		wantSelection string
+	}{
+		{point{1, 1}, point{2, 2}, "ef\ngh"},
+		{point{2, 2}, point{1, 0}, "bc\ndef\ngh"},
+		{point{2, 0}, point{0, 0}, "ab"},
+	} {
+		e := newTestEditor(t, 20, 5, "a<select-from>b<select-to>c\ndef\nghi")
+		e.handleEvent(tcell.NewEventMouse(tc.from.x, tc.from.y, tcell.Button1, tcell.ModNone))
+		if e.selectedText() != "" {
+			t.Errorf("Got selection %q after pressing, wanted it cleared", e.selectedText())
+		}
+		e.handleEvent(tcell.NewEventMouse(1, 1, tcell.Button1, tcell.ModNone))
+		e.handleEvent(tcell.NewEventMouse(tc.to.x, tc.to.y, tcell.Button1, tcell.ModNone))
+		e.handleEvent(tcell.NewEventMouse(tc.to.x, tc.to.y, tcell.ButtonNone, tcell.ModNone))
+		if got := e.selectedText(); got != tc.wantSelection {
+			t.Errorf("Got selection %q dragging from %v to %v, wanted %q", got, tc.from, tc.to, tc.wantSelection)
+		}
+		if e.cursor != tc.to || !e.selecting {
+			t.Errorf("Got cursor %v selecting %v after dragging to %v, wanted it there selecting", e.cursor, e.selecting, tc.to)
+		}
+	}
+	e := newTestEditor(t, 20, 5, "abc\ndef")
+	e.click(1, 0)
+	e.click(2, 1)
+	if e.selectedText() != "" {
+		t.Errorf("Got selection %q after clicks, wanted none", e.selectedText())
+	}
+}
+
+func TestStatusBar(t *testing.T) {
+	e := NewHeadless(13, 4)
+	e.ShowStatusBar = true
+	e.SetContent("ab\ncdefghijklmnop\nq")
+	e.press(tcell.KeyHome, 0, tcell.ModCtrl)
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	if got, want := e.RenderToString(), "ab\ncdefghijklmno\np\nLn 2, Col 2"; got != want {
+		t.Errorf("Got rendered %q, wanted %q", got, want)
+	}
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	if e.cursor.y != 2 || e.lineOffset != 1 {
+		t.Errorf("Got cursor %v and offset %v, wanted the text to scroll above the status bar", e.cursor, e.lineOffset)
+	}
+	e.typeString("x")
+	if got, want := strings.Split(e.RenderToString(), "\n")[3], "Ln 3, Col 3 *"; got != want {
+		t.Errorf("Got status %q after typing, wanted %q", got, want)
+	}
+	e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+	e.press(tcell.KeyLeft, 0, tcell.ModShift)
+	if got, want := strings.Split(e.RenderToString(), "\n")[3], "Ln 3, Col 1"; got != want {
+		t.Errorf("Got status %q after undoing the change by hand and selecting, wanted %q", got, want)
+	}
+	if style := e.Cells()[3][0].Style; style != tcell.StyleDefault.Reverse(true) {
+		t.Errorf("Got status bar style %v, wanted reversed", style)
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "a<color:ff0000:000000>b &amp; c")
+	changes := []string{}
+	e.OnChange = func(content string) {
+		changes = append(changes, content)
+	}
+	for _, f := range []func(){
+		func() { e.press(tcell.KeyRight, 0, tcell.ModNone) },
+		func() { e.press(tcell.KeyRight, 0, tcell.ModShift) },
+		func() { e.press(tcell.KeyCtrlX, 0, tcell.ModNone) },
+		func() { e.press(tcell.KeyCtrlV, 0, tcell.ModNone) },
+		func() { e.press(tcell.KeyCtrlV, 0, tcell.ModNone) },
+		func() { e.typeString("x") },
+		func() { e.ReplaceAll(regexp.MustCompile("x"), "y") },
+		func() {
+			e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+			e.press(tcell.KeyCtrlY, 0, tcell.ModNone)
+			e.press(tcell.KeyDown, 0, tcell.ModNone)
+		},
+	} {
+		f()
+	}
+	want := []string{"a & c", "a b& c", "a bb& c", "a bbx& c", "a bby& c", "a bbx& c", "a bby& c"}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Got changes %q, wanted %q", changes, want)
+	}
+}
+
+func TestCursorPosition(t *testing.T) {
+	e := newTestEditor(t, 4, 2, "abcdefg\n<color:ff0000:000000>h\nij")
+	for _, tc := range []struct {
+		line, col         int
+		wantLine, wantCol int
+		wantCursor        point
+		wantLineOffset    int
+	}{
+		{0, 5, 0, 5, point{1, 1}, 0},
+		{2, 1, 2, 1, point{1, 1}, 2},
+		{1, 3, 1, 21, point{0, 0}, 2},
+		{0, 99, 0, 7, point{3, 0}, 1},
+		{99, 0, 2, 2, point{2, 1}, 2},
+		{-1, 3, 0, 0, point{0, 0}, 0},
+	} {
+		e.SetCursorPosition(tc.line, tc.col)
+		if line, col := e.CursorPosition(); line != tc.wantLine || col != tc.wantCol {
+			t.Errorf("Got position %v,%v after setting %v,%v, wanted %v,%v", line, col, tc.line, tc.col, tc.wantLine, tc.wantCol)
+		}
+		if e.cursor != tc.wantCursor || e.lineOffset != tc.wantLineOffset {
+			t.Errorf("Got cursor %v and offset %v after setting %v,%v, wanted %v and %v", e.cursor, e.lineOffset, tc.line, tc.col, tc.wantCursor, tc.wantLineOffset)
+		}
+	}
+}
+
+func TestSelectionRange(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "ab<color:ff0000:000000>cd\nef")
+	if text, _, _, _, _, ok := e.Selection(); ok || text != "" {
+		t.Errorf("Got selection %q, %v without selecting, wanted none", text, ok)
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.press(tcell.KeyDown, 0, tcell.ModShift)
+	content := e.Content()
+	text, startLine, startCol, endLine, endCol, ok := e.Selection()
+	if !ok || text != "abcd\nef" {
+		t.Errorf("Got selection %q, %v, wanted %q", text, ok, "abcd\nef")
+	}
+	lines := strings.Split(content, "\n")
+	if got := lines[startLine][:startCol]; got != selectFromToken {
+		t.Errorf("Got %q before the selection start %v,%v, wanted %q", got, startLine, startCol, selectFromToken)
+	}
+	if got := lines[endLine][endCol:]; got != selectToToken {
+		t.Errorf("Got %q after the selection end %v,%v, wanted %q", got, endLine, endCol, selectToToken)
+	}
+	if e.Content() != content {
+		t.Errorf("Got content %q after getting the selection, wanted %q", e.Content(), content)
+	}
+}
+
+func TestSave(t *testing.T) {
+	e := NewHeadless(30, 3)
+	e.ShowStatusBar = true
+	e.SetContent("ab")
+	saved := []string{}
+	var saveErr error
+	e.OnSave = func(content string) error {
+		saved = append(saved, content)
+		return saveErr
+	}
+	status := func() string {
+		return strings.Split(e.RenderToString(), "\n")[2]
+	}
+	e.typeString("c")
+	e.press(tcell.KeyLeft, 0, tcell.ModShift)
+	saveErr = fmt.Errorf("disk full")
+	e.press(tcell.KeyCtrlS, 0, tcell.ModNone)
+	if got, want := status(), "Ln 1, Col 3 *  disk full"; got != want {
+		t.Errorf("Got status %q after failing to save, wanted %q", got, want)
+	}
+	e.press(tcell.KeyLeft, 0, tcell.ModShift)
+	if got, want := status(), "Ln 1, Col 2 *"; got != want {
+		t.Errorf("Got status %q after the next key, wanted %q", got, want)
+	}
+	saveErr = nil
+	undoPatches := len(e.undoPatches)
+	e.press(tcell.KeyCtrlS, 0, tcell.ModNone)
+	if got, want := status(), "Ln 1, Col 2"; got != want {
+		t.Errorf("Got status %q after saving, wanted %q", got, want)
+	}
+	if got, want := e.selectedText(), "bc"; got != want {
+		t.Errorf("Got selection %q after saving, wanted %q", got, want)
+	}
+	if len(saved) != 2 || saved[1] != e.Content() {
+		t.Errorf("Got saved %q, wanted twice with the content %q", saved, e.Content())
+	}
+	if len(e.undoPatches) != undoPatches {
+		t.Errorf("Got %v undo patches after saving, wanted %v", len(e.undoPatches), undoPatches)
+	}
+}
+
+func TestLineEnding(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		lineEnding string
+		content    string
+		want       string
+	}{
+		{name: "lf", content: "a\nb\n", want: "ax\nb\n"},
+		{name: "crlf", content: "a\r\nb\r\n", want: "ax\r\nb\r\n"},
+		{name: "mostly crlf", content: "a\r\nb\nc\r\n", want: "ax\r\nb\r\nc\r\n"},
+		{name: "mostly lf", content: "a\r\nb\nc\n", want: "ax\nb\nc\n"},
+		{name: "forced lf", lineEnding: "\n", content: "a\r\nb\r\n", want: "ax\nb\n"},
+		{name: "forced crlf", lineEnding: "\r\n", content: "a\nb\n", want: "ax\r\nb\r\n"},
+		{name: "auto", lineEnding: "auto", content: "a\r\nb", want: "ax\r\nb"},
+	} {
+		e := NewHeadless(10, 5)
+		e.LineEnding = tc.lineEnding
+		e.SetContent(tc.content)
+		e.press(tcell.KeyHome, 0, tcell.ModCtrl)
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+		e.typeString("x")
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got content %q, wanted %q", tc.name, got, tc.want)
+		}
+		if got := e.RenderToString(); strings.ContainsRune(got, '\r') {
+			t.Errorf("%s: Got rendered %q, wanted no carriage returns", tc.name, got)
+		}
+	}
+}
+
+func TestTrimTrailingWhitespace(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		content    string
+		cursor     Position
+		want       string
+		wantCursor Position
+	}{
+		{
+			name:       "spaces and tabs",
+			content:    "a  \nb\t \t\nc",
+			cursor:     Position{Line: 2, Col: 1},
+			want:       "a\nb\nc",
+			wantCursor: Position{Line: 2, Col: 1},
+		},
+		{
+			name:       "cursor in whitespace",
+			content:    "ab   \ncd",
+			cursor:     Position{Line: 0, Col: 4},
+			want:       "ab\ncd",
+			wantCursor: Position{Line: 0, Col: 2},
+		},
+		{
+			name:       "markup after whitespace",
+			content:    "a <color:ff0000:000000>\nb<color:ff0000:000000>  ",
+			cursor:     Position{Line: 0, Col: 0},
+			want:       "a <color:ff0000:000000>\nb<color:ff0000:000000>",
+			wantCursor: Position{Line: 0, Col: 0},
+		},
+		{
+			name:       "leading and inner whitespace",
+			content:    "  a b",
+			cursor:     Position{Line: 0, Col: 0},
+			want:       "  a b",
+			wantCursor: Position{Line: 0, Col: 0},
+		},
+	} {
+		e := newTestEditor(t, 40, 5, tc.content)
+		e.SetCursorPosition(tc.cursor.Line, tc.cursor.Col)
+		undoPatches := len(e.undoPatches)
+		e.TrimTrailingWhitespace()
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if line, col := e.CursorPosition(); line != tc.wantCursor.Line || col != tc.wantCursor.Col {
+			t.Errorf("%s: Got cursor %v,%v, wanted %+v", tc.name, line, col, tc.wantCursor)
+		}
+		wantPatches := undoPatches
+		if tc.want != tc.content {
+			wantPatches++
+		}
+		if len(e.undoPatches) != wantPatches {
+			t.Errorf("%s: Got %v undo patches, wanted %v", tc.name, len(e.undoPatches), wantPatches)
+		}
+	}
+	e := newTestEditor(t, 40, 5, "a \nb  ")
+	e.TrimTrailingWhitespace()
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := e.Content(), "a \nb  "; got != want {
+		t.Errorf("Got %q after undoing, wanted %q", got, want)
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	e := NewHeadless(20, 3)
+	e.ShowStatusBar = true
+	e.SetContent("a&amp;b\ncd")
+	e.press(tcell.KeyHome, 0, tcell.ModCtrl)
+	e.press(tcell.KeyInsert, 0, tcell.ModNone)
+	if got, want := strings.Split(e.RenderToString(), "\n")[2], "Ln 1, Col 1 OVR"; got != want {
+		t.Errorf("Got status %q, wanted %q", got, want)
+	}
+	e.typeString("xyzw")
+	if got, want := e.Content(), "xyzw\ncd"; got != want {
+		t.Errorf("Got %q after overwriting past the end of the line, wanted %q", got, want)
+	}
+	e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+	if got, want := e.Content(), "xyz\ncd"; got != want {
+		t.Errorf("Got %q after backspace, wanted %q", got, want)
+	}
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyHome, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.typeString("<")
+	if got, want := e.Content(), "xyz\n&lt;d"; got != want {
+		t.Errorf("Got %q after typing over a selection, wanted %q", got, want)
+	}
+	e.press(tcell.KeyInsert, 0, tcell.ModNone)
+	e.typeString("e")
+	if got, want := e.Content(), "xyz\n&lt;ed"; got != want {
+		t.Errorf("Got %q after leaving overwrite, wanted %q", got, want)
+	}
+	if got, want := strings.Split(e.RenderToString(), "\n")[2], "Ln 2, Col 3 *"; got != want {
+		t.Errorf("Got status %q, wanted %q", got, want)
+	}
+}
+
+func TestDuplicateLines(t *testing.T) {
+	e := newTestEditor(t, 20, 10, "<color:ff0000:000000>ab\ncd\nef")
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyCtrlD, 0, tcell.ModNone)
+	if got, want := e.Content(), "<color:ff0000:000000>ab\ncd\ncd\nef"; got != want {
+		t.Errorf("Got %q after duplicating a line, wanted %q", got, want)
+	}
+	if line, col := e.CursorPosition(); line != 2 || col != 1 {
+		t.Errorf("Got cursor %v,%v, wanted 2,1", line, col)
+	}
+	e.press(tcell.KeyHome, 0, tcell.ModCtrl)
+	e.press(tcell.KeyDown, 0, tcell.ModShift)
+	e.press(tcell.KeyCtrlD, 0, tcell.ModNone)
+	if got, want := PlainText(e.Content()), "ab\nab\ncd\ncd\nef"; got != want {
+		t.Errorf("Got %q after duplicating selected lines, wanted %q", got, want)
+	}
+	if got, want := e.selectedText(), "ab\n"; got != want {
+		t.Errorf("Got selection %q, wanted %q on the lower copy", got, want)
+	}
+	if got, want := e.Cells()[0][0].Style, tcell.StyleDefault.Foreground(tcell.NewHexColor(0xff0000)).Background(tcell.NewHexColor(0x000000)); got != want {
+		t.Errorf("Got style %v of the copied line, wanted %v", got, want)
+	}
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := PlainText(e.Content()), "ab\ncd\ncd\nef"; got != want {
+		t.Errorf("Got %q after undoing, wanted %q", got, want)
+	}
+}
+
+func TestMoveLines(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		content       string
+		keys          func(e *Editor)
+		want          string
+		wantSelection string
+		wantCursor    Position
+		wantBells     []string
+	}{
+		{
+			name:    "line up",
+			content: "a\nbc\nd",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyUp, 0, tcell.ModAlt)
+			},
+			want:       "bc\na\nd",
+			wantCursor: Position{Line: 0, Col: 1},
+		},
+		{
+			name:    "line down",
+			content: "a\nbc\nd",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModAlt)
+				e.press(tcell.KeyDown, 0, tcell.ModAlt)
+			},
+			want:       "bc\nd\na",
+			wantCursor: Position{Line: 2, Col: 0},
+		},
+		{
+			name:    "boundaries",
+			content: "a\nb",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyUp, 0, tcell.ModAlt)
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyDown, 0, tcell.ModAlt)
+			},
+			want:       "a\nb",
+			wantCursor: Position{Line: 1, Col: 0},
+			wantBells:  []string{BellBoundary, BellBoundary},
+		},
+		{
+			name:    "selected lines",
+			content: "a\nbc\nde\nf",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModAlt)
+			},
+			want:          "a\nf\nb<select-from>c\nd<select-to>e",
+			wantSelection: "c\nd",
+			wantCursor:    Position{Line: 3, Col: 12},
+		},
+		{
+			name:    "selection backwards on one line",
+			content: "a\nbcd",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyEnd, 0, tcell.ModNone)
+				e.press(tcell.KeyLeft, 0, tcell.ModShift)
+				e.press(tcell.KeyLeft, 0, tcell.ModShift)
+				e.press(tcell.KeyUp, 0, tcell.ModAlt)
+			},
+			want:          "b<select-to>cd<select-from>\na",
+			wantSelection: "cd",
+			wantCursor:    Position{Line: 0, Col: 12},
+		},
+		{
+			name:    "selection ending at the start of the next line",
+			content: "a\nb\nc",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModAlt)
+			},
+			want:          "b\n<select-from>a\n<select-to>c",
+			wantSelection: "a\n",
+			wantCursor:    Position{Line: 2, Col: 11},
+		},
+		{
+			name:    "selection ending at the start of the last line",
+			content: "a\nb",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModAlt)
+			},
+			want:          "b\n<select-from>a<select-to>",
+			wantSelection: "a",
+			wantCursor:    Position{Line: 1, Col: 25},
+		},
+	} {
+		e := newTestEditor(t, 20, 5, tc.content)
+		bells := []string{}
+		e.OnBell = func(reason string) {
+			bells = append(bells, reason)
+		}
+		tc.keys(e)
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if got := e.selectedText(); got != tc.wantSelection {
+			t.Errorf("%s: Got selection %q, wanted %q", tc.name, got, tc.wantSelection)
+		}
+		if line, col := e.CursorPosition(); line != tc.wantCursor.Line || col != tc.wantCursor.Col {
+			t.Errorf("%s: Got cursor %v,%v, wanted %+v", tc.name, line, col, tc.wantCursor)
+		}
+		if len(bells) != len(tc.wantBells) {
+			t.Errorf("%s: Got bells %q, wanted %q", tc.name, bells, tc.wantBells)
+		}
+	}
+	e := newTestEditor(t, 20, 5, "a\nb")
+	e.press(tcell.KeyDown, 0, tcell.ModAlt)
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := e.Content(), "a\nb"; got != want {
+		t.Errorf("Got %q after undoing, wanted %q", got, want)
+	}
+}
+
+func TestHome(t *testing.T) {
+	e := newTestEditor(t, 8, 5, "  \tab\n    cdefghij\n   ")
+	for _, tc := range []struct {
+		keys       func()
+		wantCursor point
+	}{
+		{func() { e.press(tcell.KeyEnd, 0, tcell.ModNone) }, point{6, 0}},
+		{func() { e.press(tcell.KeyHome, 0, tcell.ModNone) }, point{4, 0}},
+		{func() { e.press(tcell.KeyHome, 0, tcell.ModNone) }, point{0, 0}},
+		{func() { e.press(tcell.KeyHome, 0, tcell.ModNone) }, point{4, 0}},
+		{func() { e.press(tcell.KeyDown, 0, tcell.ModNone); e.press(tcell.KeyDown, 0, tcell.ModNone) }, point{4, 2}},
+		{func() { e.press(tcell.KeyHome, 0, tcell.ModNone) }, point{0, 2}},
+		{func() { e.press(tcell.KeyDown, 0, tcell.ModNone); e.press(tcell.KeyHome, 0, tcell.ModNone) }, point{3, 3}},
+		{func() { e.press(tcell.KeyHome, 0, tcell.ModNone) }, point{0, 3}},
+		{func() { e.press(tcell.KeyHome, 0, tcell.ModCtrl) }, point{0, 0}},
+	} {
+		tc.keys()
+		if e.cursor != tc.wantCursor {
+			t.Errorf("Got cursor %v, wanted %v", e.cursor, tc.wantCursor)
+		}
+	}
+}
+
+func TestAutoClosePairs(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		content    string
+		keys       func(e *Editor)
+		want       string
+		wantCursor Position
+	}{
+		{
+			name:       "opener",
+			content:    "ab",
+			keys:       func(e *Editor) { e.press(tcell.KeyRight, 0, tcell.ModNone); e.typeString("(") },
+			want:       "a()b",
+			wantCursor: Position{Line: 0, Col: 2},
+		},
+		{
+			name:       "type over closer",
+			content:    "",
+			keys:       func(e *Editor) { e.typeString("(x)y") },
+			want:       "(x)y",
+			wantCursor: Position{Line: 0, Col: 4},
+		},
+		{
+			name:       "quotes",
+			content:    "",
+			keys:       func(e *Editor) { e.typeString(`"x"`) },
+			want:       `"x"`,
+			wantCursor: Position{Line: 0, Col: 3},
+		},
+		{
+			name:       "escaped",
+			content:    "",
+			keys:       func(e *Editor) { e.typeString("<a>") },
+			want:       "&lt;a&gt;",
+			wantCursor: Position{Line: 0, Col: 9},
+		},
+		{
+			name:       "closer without pair",
+			content:    "",
+			keys:       func(e *Editor) { e.typeString(")") },
+			want:       ")",
+			wantCursor: Position{Line: 0, Col: 1},
+		},
+		{
+			name:    "wrap selection",
+			content: "ab",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModShift)
+				e.typeString("<")
+			},
+			want:       "&lt;<select-from>a<select-to>&gt;b",
+			wantCursor: Position{Line: 0, Col: 29},
+		},
+		{
+			name:    "closer replacing selection",
+			content: ")",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModShift)
+				e.typeString(")")
+			},
+			want:       ")",
+			wantCursor: Position{Line: 0, Col: 1},
+		},
+	} {
+		e := newTestEditor(t, 20, 5, tc.content)
+		e.SelectionPairs = map[rune]rune{}
+		e.AutoClosePairs = map[rune]rune{'(': ')', '"': '"', '<': '>'}
+		tc.keys(e)
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if line, col := e.CursorPosition(); line != tc.wantCursor.Line || col != tc.wantCursor.Col {
+			t.Errorf("%s: Got cursor %v,%v, wanted %+v", tc.name, line, col, tc.wantCursor)
+		}
+	}
+	e := newTestEditor(t, 20, 5, "")
+	e.AutoClosePairs = map[rune]rune{'(': ')'}
+	e.typeString("(")
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got := e.Content(); got != "" {
+		t.Errorf("Got %q after undoing, wanted the pair undone at once", got)
+	}
+}
+
+func TestHighlighter(t *testing.T) {
+	red := tcell.StyleDefault.Foreground(tcell.ColorRed)
+	green := tcell.StyleDefault.Foreground(tcell.NewHexColor(0x00ff00)).Background(tcell.NewHexColor(0x000000))
+	base := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorWhite)
+	selected := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
+	calls := []string{}
+	e := newTestEditor(t, 20, 5, "&lt;if x\n<color:00ff00:000000>if y")
+	e.Highlighter = func(line []rune, lineIdx int) []tcell.Style {
+		calls = append(calls, fmt.Sprintf("%v:%v", lineIdx, string(line)))
+		res := make([]tcell.Style, len(line)+5)
+		for idx := 0; idx+1 < len(line); idx++ {
+			if string(line[idx:idx+2]) == "if" {
+				res[idx], res[idx+1] = red, red
+			}
+		}
+		// The last visible rune has no style.
+		return res[:len(line)-1]
+	}
+	e.redraw()
+	wantStyles := func(name string, want [][]tcell.Style) {
+		cells := e.Cells()
+		for y, row := range want {
+			for x, style := range row {
+				if got := cells[y][x].Style; got != style {
+					t.Errorf("%s: Got style %v at %v,%v, wanted %v", name, got, x, y, style)
+				}
+			}
+		}
+	}
+	wantStyles("highlighted", [][]tcell.Style{
+		{base, red, red, base, base},
+		{red, red, green, green},
+	})
+	if got, want := calls, []string{"0:<if x", "1:if y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got calls %q, wanted %q", got, want)
+	}
+	calls = nil
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyHome, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	wantStyles("selected", [][]tcell.Style{
+		{base, red, red, base, base},
+		{selected, red, green, green},
+	})
+	for _, call := range calls {
+		if !strings.HasPrefix(call, "1:") {
+			t.Errorf("Got call %q after selecting on the second line, wanted only the second line highlighted again", call)
+		}
+	}
+	e.Highlighter = nil
+	e.redraw()
+	wantStyles("without highlighter", [][]tcell.Style{
+		{base, base, base, base, base},
+		{selected, green, green, green},
+	})
+}
+
+func TestDefaultAndSelectionStyles(t *testing.T) {
+	e := newTestEditor(t, 4, 3, "ab\nc")
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	for _, tc := range []struct {
+		name      string
+		style     tcell.Style
+		selection tcell.Style
+		wantText  tcell.Style
+		wantSel   tcell.Style
+		wantBlank tcell.Style
+	}{
+		{
+			name:      "unset",
+			wantText:  tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorWhite),
+			wantSel:   tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack),
+			wantBlank: tcell.StyleDefault,
+		},
+		{
+			name:      "dark",
+			style:     tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorNavy),
+			selection: tcell.StyleDefault.Foreground(tcell.ColorNavy).Background(tcell.ColorYellow),
+			wantText:  tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorNavy),
+			wantSel:   tcell.StyleDefault.Foreground(tcell.ColorNavy).Background(tcell.ColorYellow),
+			wantBlank: tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorNavy),
+		},
+	} {
+		e.DefaultStyle, e.SelectionStyle = tc.style, tc.selection
+		e.redraw()
+		cells := e.Cells()
+		if got := cells[0][0].Style; got != tc.wantSel {
+			t.Errorf("%s: Got selection style %v, wanted %v", tc.name, got, tc.wantSel)
+		}
+		if got := cells[0][1].Style; got != tc.wantText {
+			t.Errorf("%s: Got text style %v, wanted %v", tc.name, got, tc.wantText)
+		}
+		for _, p := range []point{{3, 0}, {1, 1}, {0, 2}} {
+			if got := cells[p.y][p.x].Style; got != tc.wantBlank {
+				t.Errorf("%s: Got blank style %v at %v, wanted %v", tc.name, got, p, tc.wantBlank)
+			}
+		}
+	}
+}
+
+func TestUndoCoalescing(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "")
+	now := time.Unix(0, 0)
+	e.clock = func() time.Time {
+		return now
+	}
+	e.UndoCoalesceInterval = time.Second
+	e.typeString("ab")
+	now = now.Add(2 * time.Second)
+	e.typeString("cd")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	e.typeString("ef")
+	e.press(tcell.KeyLeft, 0, tcell.ModNone)
+	e.typeString("gh")
+	e.SetCursorPosition(1, 4)
+	e.typeString("i")
+	e.InsertAt(0, 0, "j")
+	e.typeString("k")
+	for _, want := range []string{
+		"jabcd\neghfi",
+		"abcd\neghfi",
+		"abcd\neghf",
+		"abcd\nef",
+		"abcd\n",
+		"abcd",
+		"ab",
+		"",
+	} {
+		e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		if got := e.Content(); got != want {
+			t.Errorf("Got %q after undoing, wanted %q", got, want)
+		}
+	}
+	e.press(tcell.KeyCtrlY, 0, tcell.ModNone)
+	if got, want := e.Content(), "ab"; got != want {
+		t.Errorf("Got %q after redoing, wanted %q", got, want)
+	}
+}
+
+func TestMaxUndoSteps(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "")
+	e.MaxUndoSteps = 3
+	e.typeString("abcde")
+	if len(e.undoPatches) != 3 {
+		t.Errorf("Got %v undo patches, wanted 3", len(e.undoPatches))
+	}
+	for _, want := range []string{"abcd", "abc", "ab", "ab"} {
+		e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		if got := e.Content(); got != want {
+			t.Errorf("Got %q after undoing, wanted %q", got, want)
+		}
+	}
+	for _, want := range []string{"abc", "abcd", "abcde", "abcde"} {
+		e.press(tcell.KeyCtrlY, 0, tcell.ModNone)
+		if got := e.Content(); got != want {
+			t.Errorf("Got %q after redoing, wanted %q", got, want)
+		}
+	}
+
+	// Dropping the oldest patch doesn't copy the others on every edit.
+	e = newTestEditor(t, 20, 5, "")
+	e.MaxUndoSteps = 10
+	// The end of the array of the patches only moves when they are copied.
+	arrayEnd := func() *patch {
+		if cap(e.undoPatches) == 0 {
+			return nil
+		}
+		return &e.undoPatches[:cap(e.undoPatches)][cap(e.undoPatches)-1]
+	}
+	copies := 0
+	for i := 0; i < 100; i++ {
+		prevEnd := arrayEnd()
+		e.typeString("a")
+		if arrayEnd() != prevEnd {
+			copies++
+		}
+	}
+	if len(e.undoPatches) != 10 || copies > 20 {
+		t.Errorf("Got %v undo patches copied %v times in 100 edits, wanted 10 copied rarely", len(e.undoPatches), copies)
+	}
+}
+
+func TestToggleComment(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		prefix        string
+		content       string
+		keys          func(e *Editor)
+		want          string
+		wantSelection string
+		wantCursor    Position
+	}{
+		{
+			name:    "line",
+			prefix:  "// ",
+			content: "a\n  bc",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyEnd, 0, tcell.ModNone)
+				e.press(tcell.KeyCtrlUnderscore, 0, tcell.ModNone)
+			},
+			want:       "a\n  // bc",
+			wantCursor: Position{Line: 1, Col: 7},
+		},
+		{
+			name:    "uncomment line",
+			prefix:  "// ",
+			content: "\t// a\n//\n//b",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyEnd, 0, tcell.ModNone)
+				e.press(tcell.KeyRune, '/', tcell.ModCtrl)
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyCtrlUnderscore, 0, tcell.ModNone)
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyCtrlUnderscore, 0, tcell.ModNone)
+			},
+			want:       "\ta\n\nb",
+			wantCursor: Position{Line: 2, Col: 0},
+		},
+		{
+			name:    "selected lines with some commented",
+			prefix:  "# ",
+			content: "# a\n\n<color:ff0000:000000>  b\nc",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyEnd, 0, tcell.ModShift)
+				e.press(tcell.KeyCtrlUnderscore, 0, tcell.ModNone)
+			},
+			want:          "<select-from># # a\n\n<color:ff0000:000000>  # b<select-to>\nc",
+			wantSelection: "# # a\n\n  # b",
+			wantCursor:    Position{Line: 2, Col: 37},
+		},
+		{
+			name:    "uncomment selected lines",
+			prefix:  "# ",
+			content: "# a\n  # b\nc",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyEnd, 0, tcell.ModShift)
+				e.press(tcell.KeyCtrlUnderscore, 0, tcell.ModNone)
+			},
+			want:          "<select-from>a\n  b<select-to>\nc",
+			wantSelection: "a\n  b",
+			wantCursor:    Position{Line: 1, Col: 14},
+		},
+		{
+			name:    "escaped prefix",
+			prefix:  "<!-- ",
+			content: "a",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyCtrlUnderscore, 0, tcell.ModNone)
+			},
+			want:       "&lt;!-- a",
+			wantCursor: Position{Line: 0, Col: 8},
+		},
+		{
+			name:    "no prefix",
+			content: "a",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyCtrlUnderscore, 0, tcell.ModNone)
+			},
+			want:       "a",
+			wantCursor: Position{Line: 0, Col: 0},
+		},
+	} {
+		e := newTestEditor(t, 40, 5, tc.content)
+		e.CommentPrefix = tc.prefix
+		tc.keys(e)
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if got := e.selectedText(); got != tc.wantSelection {
+			t.Errorf("%s: Got selection %q, wanted %q", tc.name, got, tc.wantSelection)
+		}
+		if line, col := e.CursorPosition(); line != tc.wantCursor.Line || col != tc.wantCursor.Col {
+			t.Errorf("%s: Got cursor %v,%v, wanted %+v", tc.name, line, col, tc.wantCursor)
+		}
+	}
+	e := newTestEditor(t, 40, 5, "a\nb")
+	e.CommentPrefix = "// "
+	e.press(tcell.KeyDown, 0, tcell.ModShift)
+	e.press(tcell.KeyEnd, 0, tcell.ModShift)
+	e.press(tcell.KeyCtrlUnderscore, 0, tcell.ModNone)
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := PlainText(e.Content()), "a\nb"; got != want {
+		t.Errorf("Got %q after undoing, wanted %q", got, want)
+	}
+}
+
+func TestWrapAtWords(t *testing.T) {
+	e := newTestEditor(t, 10, 5, "hello world foo barbazquxquux")
+	e.WrapAtWords = true
+	e.redraw()
+	if got, want := e.RenderToString(), "hello\nworld foo\nbarbazquxq\nuux\n"; got != want {
+		t.Errorf("Got rendered %q, wanted %q", got, want)
+	}
+	for _, tc := range []struct {
+		click   point
+		wantCol int
+	}{
+		{point{0, 1}, 6},
+		{point{4, 1}, 10},
+		{point{0, 2}, 16},
+		{point{2, 3}, 28},
+	} {
+		e.click(tc.click.x, tc.click.y)
+		if line, col := e.CursorPosition(); line != 0 || col != tc.wantCol {
+			t.Errorf("Got cursor %v,%v after clicking %v, wanted 0,%v", line, col, tc.click, tc.wantCol)
+		}
+	}
+	e.press(tcell.KeyHome, 0, tcell.ModCtrl)
+	for i := 0; i < 6; i++ {
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+	}
+	if e.cursor != (point{0, 1}) {
+		t.Errorf("Got cursor %v after moving past the wrapped whitespace, wanted %v", e.cursor, point{0, 1})
+	}
+	e.WrapAtWords = false
+	e.redraw()
+	if got, want := e.RenderToString(), "hello worl\nd foo barb\nazquxquux\n\n"; got != want {
+		t.Errorf("Got rendered %q without WrapAtWords, wanted %q", got, want)
+	}
+}
+
+func TestDesiredColumn(t *testing.T) {
+	e := newTestEditor(t, 10, 3, "abcdef\nab\n\nabcdefgh\nabcdefghijklm")
+	for _, tc := range []struct {
+		keys       func()
+		wantCursor Position
+	}{
+		{func() { e.press(tcell.KeyEnd, 0, tcell.ModNone); e.press(tcell.KeyLeft, 0, tcell.ModNone) }, Position{Line: 0, Col: 5}},
+		{func() { e.press(tcell.KeyDown, 0, tcell.ModNone) }, Position{Line: 1, Col: 2}},
+		{func() { e.press(tcell.KeyDown, 0, tcell.ModNone) }, Position{Line: 2, Col: 0}},
+		{func() { e.press(tcell.KeyDown, 0, tcell.ModNone) }, Position{Line: 3, Col: 5}},
+		{func() { e.press(tcell.KeyDown, 0, tcell.ModNone) }, Position{Line: 4, Col: 5}},
+		{func() { e.press(tcell.KeyDown, 0, tcell.ModNone) }, Position{Line: 4, Col: 13}},
+		{func() { e.press(tcell.KeyPgUp, 0, tcell.ModNone) }, Position{Line: 2, Col: 0}},
+		{func() { e.press(tcell.KeyUp, 0, tcell.ModNone) }, Position{Line: 1, Col: 2}},
+		{func() { e.press(tcell.KeyLeft, 0, tcell.ModNone) }, Position{Line: 1, Col: 1}},
+		{func() { e.press(tcell.KeyUp, 0, tcell.ModNone) }, Position{Line: 0, Col: 1}},
+		{func() { e.press(tcell.KeyDown, 0, tcell.ModNone); e.press(tcell.KeyDown, 0, tcell.ModNone) }, Position{Line: 2, Col: 0}},
+		{func() { e.typeString("x"); e.press(tcell.KeyDown, 0, tcell.ModNone) }, Position{Line: 3, Col: 1}},
+	} {
+		tc.keys()
+		if line, col := e.CursorPosition(); line != tc.wantCursor.Line || col != tc.wantCursor.Col {
+			t.Errorf("Got cursor %v,%v, wanted %+v", line, col, tc.wantCursor)
+		}
+	}
+}
+
+func TestDeleteWordForward(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		content   string
+		keys      func(e *Editor)
+		want      string
+		wantBells []string
+	}{
+		{
+			name:    "word",
+			content: "ab cd",
+			keys:    func(e *Editor) { e.press(tcell.KeyDelete, 0, tcell.ModCtrl) },
+			want:    " cd",
+		},
+		{
+			name:    "whitespace",
+			content: "ab \t cd",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyDelete, 0, tcell.ModCtrl)
+			},
+			want: "abcd",
+		},
+		{
+			name:    "markup and entities",
+			content: "a&amp;<color:ff0000:000000>b c",
+			keys:    func(e *Editor) { e.press(tcell.KeyDelete, 0, tcell.ModCtrl) },
+			want:    "<color:ff0000:000000> c",
+		},
+		{
+			name:    "line end",
+			content: "ab\ncd",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyDelete, 0, tcell.ModCtrl)
+				e.press(tcell.KeyDelete, 0, tcell.ModCtrl)
+			},
+			want:      "a\ncd",
+			wantBells: []string{BellBoundary},
+		},
+		{
+			name:    "selection",
+			content: "ab cd",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModShift)
+				e.press(tcell.KeyDelete, 0, tcell.ModCtrl)
+			},
+			want: "b cd",
+		},
+	} {
+		e := newTestEditor(t, 20, 5, tc.content)
+		bells := []string{}
+		e.OnBell = func(reason string) {
+			bells = append(bells, reason)
+		}
+		tc.keys(e)
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if !reflect.DeepEqual(bells, tc.wantBells) && (len(bells) > 0 || len(tc.wantBells) > 0) {
+			t.Errorf("%s: Got bells %q, wanted %q", tc.name, bells, tc.wantBells)
+		}
+	}
+}
+
+func TestSelectionCase(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "ab &amp; <color:ff0000:000000>cß\nd1é\nfg")
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyDown, 0, tcell.ModShift)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.ToUpperSelection()
+	if got, want := e.Content(), "a<select-from>B &amp; <color:ff0000:000000>Cß\nD1<select-to>é\nfg"; got != want {
+		t.Errorf("Got %q after uppercasing, wanted %q", got, want)
+	}
+	cursor := e.cursor
+	e.press(tcell.KeyRune, 'l', tcell.ModAlt)
+	if got, want := e.Content(), "a<select-from>b &amp; <color:ff0000:000000>cß\nd1<select-to>é\nfg"; got != want {
+		t.Errorf("Got %q after lowercasing, wanted %q", got, want)
+	}
+	if e.cursor != cursor {
+		t.Errorf("Got cursor %v after lowercasing, wanted %v", e.cursor, cursor)
+	}
+	e.press(tcell.KeyRune, 'u', tcell.ModAlt)
+	e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+	if got, want := e.selectedText(), "b & cß\nd1"; got != want {
+		t.Errorf("Got selection %q after undoing, wanted %q", got, want)
+	}
+	e.press(tcell.KeyEsc, 0, tcell.ModNone)
+	e.ToUpperSelection()
+	if got, want := e.Content(), "ab &amp; <color:ff0000:000000>cß\nd1é\nfg"; got != want {
+		t.Errorf("Got %q after uppercasing without a selection, wanted %q", got, want)
+	}
+}
+
+func TestSortSelectedLines(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		content       string
+		keys          func(e *Editor)
+		descending    bool
+		want          string
+		wantSelection string
+	}{
+		{
+			name:    "whole lines",
+			content: "x\ncherry\n<color:ff0000:000000>apple\nbanana\ny",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModNone)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyEnd, 0, tcell.ModShift)
+			},
+			want:          "x\n<select-from><color:ff0000:000000>apple\nbanana\ncherry<select-to>\ny",
+			wantSelection: "apple\nbanana\ncherry",
+		},
+		{
+			name:    "descending and backwards",
+			content: "b\nc\na",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyEnd, 0, tcell.ModCtrl)
+				e.press(tcell.KeyHome, 0, tcell.ModCtrl|tcell.ModShift)
+			},
+			descending:    true,
+			want:          "<select-to>c\nb\na<select-from>",
+			wantSelection: "c\nb\na",
+		},
+		{
+			name:    "partial lines",
+			content: "d\nc\nb\na",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyRight, 0, tcell.ModNone)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyHome, 0, tcell.ModShift)
+			},
+			want:          "d<select-from>\nb\nc\n<select-to>a",
+			wantSelection: "\nb\nc\n",
+		},
+	} {
+		e := newTestEditor(t, 20, 5, tc.content)
+		tc.keys(e)
+		e.SortSelectedLines(tc.descending)
+		if got := e.Content(); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if got := e.selectedText(); got != tc.wantSelection {
+			t.Errorf("%s: Got selection %q, wanted %q", tc.name, got, tc.wantSelection)
+		}
+		e.press(tcell.KeyCtrlZ, 0, tcell.ModNone)
+		if got := PlainText(e.Content()); got != PlainText(tc.content) {
+			t.Errorf("%s: Got %q after undoing, wanted %q", tc.name, got, PlainText(tc.content))
+		}
+	}
+}
+
+func TestHighlightCurrentLine(t *testing.T) {
+	e := newTestEditor(t, 4, 4, "ab\ncdefg\n<color:ff0000:000000>hi")
+	e.HighlightCurrentLine = true
+	base := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorWhite)
+	current := tcell.StyleDefault.Foreground(tcell.ColorBlack).Background(tcell.ColorLightGray)
+	selected := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
+	red := tcell.StyleDefault.Foreground(tcell.NewHexColor(0xff0000)).Background(tcell.NewHexColor(0x000000))
+	for _, tc := range []struct {
+		name string
+		keys func()
+		want [][]tcell.Style
+	}{
+		{
+			name: "first line",
+			keys: func() { e.press(tcell.KeyRight, 0, tcell.ModNone) },
+			want: [][]tcell.Style{
+				{current, current, current, current},
+				{base, base, base, base},
+			},
+		},
+		{
+			name: "wrapped line with selection",
+			keys: func() { e.press(tcell.KeyDown, 0, tcell.ModNone); e.press(tcell.KeyRight, 0, tcell.ModShift) },
+			want: [][]tcell.Style{
+				{base, base, tcell.StyleDefault, tcell.StyleDefault},
+				{current, selected, current, current},
+				{current, current, current},
+			},
+		},
+		{
+			name: "colored line",
+			keys: func() { e.press(tcell.KeyEsc, 0, tcell.ModNone); e.press(tcell.KeyEnd, 0, tcell.ModCtrl) },
+			want: [][]tcell.Style{
+				{base, base},
+				{base, base, base, base},
+				{base},
+				{red.Background(tcell.ColorLightGray), red.Background(tcell.ColorLightGray), current, current},
+			},
+		},
+		{
+			name: "unfocused",
+			keys: func() { e.SetFocused(false) },
+			want: [][]tcell.Style{
+				{base, base},
+				{base, base, base, base},
+				{base},
+				{red, red, tcell.StyleDefault, tcell.StyleDefault},
+			},
+		},
+	} {
+		tc.keys()
+		cells := e.Cells()
+		for y, row := range tc.want {
+			for x, style := range row {
+				if got := cells[y][x].Style; got != style {
+					t.Errorf("%s: Got style %v at %v,%v, wanted %v", tc.name, got, x, y, style)
+				}
+			}
+		}
+	}
+	screen := e.Screen.(tcell.SimulationScreen)
+	if _, _, got, _ := screen.GetContent(0, 3); got != red {
+		t.Errorf("Got style %v on the screen while unfocused, wanted %v", got, red)
+	}
+	e.SetFocused(true)
+	if _, _, got, _ := screen.GetContent(0, 3); got != red.Background(tcell.ColorLightGray) {
+		t.Errorf("Got style %v on the screen after focusing, wanted the current line highlighted", got)
+	}
+	if got, want := e.Content(), "ab\ncdefg\n<color:ff0000:000000>hi"; got != want {
+		t.Errorf("Got content %q, wanted %q", got, want)
+	}
+}
+
+type finiCountingScreen struct {
+	tcell.Screen
+	finis int
+}
+
+func (s *finiCountingScreen) Fini() {
+	s.finis++
+}
+
+func TestQuit(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		setup        func(e *Editor)
+		keys         []*tcell.EventKey
+		wantQuit     []bool
+		manageScreen bool
+	}{
+		{
+			name:     "default",
+			keys:     []*tcell.EventKey{tcell.NewEventKey(tcell.KeyCtrlO, 0, tcell.ModNone), tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModNone)},
+			wantQuit: []bool{false, true},
+		},
+		{
+			name:     "quit key",
+			setup:    func(e *Editor) { e.QuitKey = tcell.KeyCtrlQ },
+			keys:     []*tcell.EventKey{tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModNone), tcell.NewEventKey(tcell.KeyCtrlQ, 0, tcell.ModNone)},
+			wantQuit: []bool{false, true},
+		},
+		{
+			name: "predicate",
+			setup: func(e *Editor) {
+				escapes := 0
+				e.ShouldQuit = func(ev *tcell.EventKey) bool {
+					if ev.Key() != tcell.KeyEsc {
+						escapes = 0
+						return false
+					}
+					escapes++
+					return escapes == 2
+				}
+			},
+			keys: []*tcell.EventKey{
+				tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone),
+				tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModNone),
+				tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone),
+				tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone),
+			},
+			wantQuit: []bool{false, false, false, true},
+		},
+		{
+			name:         "managed screen",
+			setup:        func(e *Editor) { e.ManageScreen = true },
+			keys:         []*tcell.EventKey{tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModNone)},
+			wantQuit:     []bool{true},
+			manageScreen: true,
+		},
+	} {
+		e := newTestEditor(t, 10, 3, "a")
+		screen := &finiCountingScreen{Screen: e.Screen}
+		e.Screen = screen
+		if tc.setup != nil {
+			tc.setup(e)
+		}
+		for idx, ev := range tc.keys {
+			if got := e.HandleEvent(ev); got != tc.wantQuit[idx] {
+				t.Errorf("%s: Got quit %v for key %v, wanted %v", tc.name, got, ev.Name(), tc.wantQuit[idx])
+			}
+		}
+		wantFinis := 1
+		if tc.manageScreen {
+			wantFinis = 0
+		}
+		if screen.finis != wantFinis {
+			t.Errorf("%s: Got %v finalizations of the screen, wanted %v", tc.name, screen.finis, wantFinis)
+		}
+	}
+}
+
+func TestEdit(t *testing.T) {
+	e := NewHeadless(20, 5)
+	screen := e.Screen.(tcell.SimulationScreen)
+	screen.InjectKey(tcell.KeyEnd, 0, tcell.ModNone)
+	screen.InjectKey(tcell.KeyRune, '!', tcell.ModNone)
+	screen.InjectKey(tcell.KeyCtrlW, 0, tcell.ModNone)
+	got, err := e.Edit("a &amp; b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a &amp; b!"; got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+	if want := "a & b!"; PlainText(got) != want {
+		t.Errorf("Got plain text %q, wanted %q", PlainText(got), want)
+	}
+
+	if _, err := (&Editor{}).Edit("a"); err == nil {
+		t.Errorf("Got no error for an editor without a screen, wanted one")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		abortKey    tcell.Key
+		key         tcell.Key
+		wantContent string
+		wantErr     error
+	}{
+		{name: "quit", key: tcell.KeyCtrlW, wantContent: "a!"},
+		{name: "abort", key: tcell.KeyCtrlQ, wantContent: "a", wantErr: ErrAborted},
+		{name: "abort key", abortKey: tcell.KeyF10, key: tcell.KeyF10, wantContent: "a", wantErr: ErrAborted},
+	} {
+		e := NewHeadless(20, 5)
+		e.AbortKey = tc.abortKey
+		screen := e.Screen.(tcell.SimulationScreen)
+		screen.InjectKey(tcell.KeyEnd, 0, tcell.ModNone)
+		screen.InjectKey(tcell.KeyRune, '!', tcell.ModNone)
+		screen.InjectKey(tc.key, 0, tcell.ModNone)
+		got, err := e.Edit("a")
+		if err != tc.wantErr {
+			t.Errorf("%s: Got error %v, wanted %v", tc.name, err, tc.wantErr)
+		}
+		if got != tc.wantContent {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.wantContent)
+		}
+		if e.Aborted() != (tc.wantErr != nil) {
+			t.Errorf("%s: Got Aborted() %v, wanted %v", tc.name, e.Aborted(), tc.wantErr != nil)
+		}
+	}
+}
+
+func TestIsModified(t *testing.T) {
+	e := NewHeadless(30, 3)
+	e.SetContent("ab")
+	check := func(when string, want bool) {
+		t.Helper()
+		if got := e.IsModified(); got != want {
+			t.Errorf("Got IsModified() %v %s, wanted %v", got, when, want)
+		}
+	}
+	check("after SetContent", false)
+	e.typeString("c")
+	check("after typing", true)
+	e.press(tcell.KeyLeft, 0, tcell.ModShift)
+	e.press(tcell.KeyBackspace2, 0, tcell.ModNone)
+	check("after deleting the typing", false)
+	e.typeString("d")
+	e.ResetModified()
+	check("after ResetModified", false)
+	e.press(tcell.KeyLeft, 0, tcell.ModShift)
+	check("after selecting", false)
+	e.OnSave = func(string) error { return nil }
+	e.typeString("e")
+	check("after typing again", true)
+	e.press(tcell.KeyCtrlS, 0, tcell.ModNone)
+	check("after saving", false)
+	e.SetContent("x")
+	check("after setting new content", false)
+}
+
+func TestEditContext(t *testing.T) {
+	e := NewHeadless(20, 5)
+	screen := &finiCountingScreen{Screen: e.Screen}
+	e.Screen = screen
+	ctx, cancel := context.WithCancel(context.Background())
+	e.OnChange = func(string) {
+		cancel()
+	}
+	screen.Screen.(tcell.SimulationScreen).InjectKey(tcell.KeyRune, '!', tcell.ModNone)
+	got, err := e.EditContext(ctx, "a")
+	if err != context.Canceled {
+		t.Errorf("Got error %v, wanted %v", err, context.Canceled)
+	}
+	if want := "!a"; got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+	if screen.finis != 1 {
+		t.Errorf("Got %v finalizations of the screen, wanted 1", screen.finis)
+	}
+}
+
+func TestNew(t *testing.T) {
+	s := tcell.NewSimulationScreen("UTF-8")
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.SetSize(20, 5)
+	filtered := 0
+	defaultStyle := tcell.StyleDefault.Foreground(tcell.ColorYellow)
+	selectionStyle := tcell.StyleDefault.Background(tcell.ColorRed)
+	e := New(s,
+		WithTabWidth(2),
+		WithEventFilter(func(ev tcell.Event) []tcell.Event {
+			filtered++
+			return []tcell.Event{ev}
+		}),
+		WithReadOnly(true),
+		WithStyles(defaultStyle, selectionStyle),
+	)
+	if e.TabWidth != 2 || !e.ReadOnly || e.DefaultStyle != defaultStyle || e.SelectionStyle != selectionStyle {
+		t.Errorf("Got %+v, wanted the options applied", e)
+	}
+	if e.EventFilter(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone)); filtered != 1 {
+		t.Errorf("Got %v filtered events, wanted 1", filtered)
+	}
+	e.SetContent("a a")
+	if got := e.ReplaceAll(regexp.MustCompile("a"), "b"); got != 2 {
+		t.Errorf("Got %v replacements before Edit, wanted 2", got)
+	}
+	if got, want := e.Content(), "b b"; got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+
+	fresh := New(s)
+	fresh.InsertText("a\nb")
+	fresh.Batch(func() {
+		fresh.InsertText("c")
+	})
+	if got, want := fresh.Content(), "a\nbc"; got != want {
+		t.Errorf("Got %q after changes straight after New, wanted %q", got, want)
+	}
+	if line, col := fresh.CursorPosition(); line != 1 || col != 2 {
+		t.Errorf("Got cursor at %v,%v after changes straight after New, wanted 1,2", line, col)
+	}
+	if !fresh.indexed() {
+		t.Errorf("Got no layout after changes straight after New on a screen with a size")
+	}
+
+	h := NewHeadless(10, 3, WithTabWidth(8))
+	if h.TabWidth != 8 {
+		t.Errorf("Got TabWidth %v for the headless editor, wanted 8", h.TabWidth)
+	}
+}
+
+func TestPostContent(t *testing.T) {
+	e := NewHeadless(20, 5)
+	screen := e.Screen.(tcell.SimulationScreen)
+	go func() {
+		for i := 0; i < 100; i++ {
+			e.PostContent(fmt.Sprintf("content %v", i))
+			screen.PostEventWait(tcell.NewEventKey(tcell.KeyRune, 'x', tcell.ModNone))
+		}
+		e.PostContent("final")
+		screen.PostEventWait(tcell.NewEventKey(tcell.KeyCtrlW, 0, tcell.ModNone))
+	}()
+	got, err := e.Edit("initial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "final"; got != want {
+		t.Errorf("Got %q, wanted %q", got, want)
+	}
+}
+
+func TestUndoRedoMethods(t *testing.T) {
+	e := newTestEditor(t, 20, 3, "")
+	changes := []string{}
+	e.OnChange = func(content string) {
+		changes = append(changes, content)
+	}
+	if e.Undo() {
+		t.Errorf("Got Undo() true without changes, wanted false")
+	}
+	e.typeString("a")
+	e.press(tcell.KeyEnter, 0, tcell.ModNone)
+	e.typeString("b")
+	for _, tc := range []struct {
+		name        string
+		f           func() bool
+		wantChanged bool
+		wantContent string
+	}{
+		{name: "undo", f: e.Undo, wantChanged: true, wantContent: "a\n"},
+		{name: "undo", f: e.Undo, wantChanged: true, wantContent: "a"},
+		{name: "redo", f: e.Redo, wantChanged: true, wantContent: "a\n"},
+		{name: "undo", f: e.Undo, wantChanged: true, wantContent: "a"},
+		{name: "undo", f: e.Undo, wantChanged: true, wantContent: ""},
+		{name: "undo", f: e.Undo, wantChanged: false, wantContent: ""},
+		{name: "redo", f: func() bool {
+			e.press(tcell.KeyCtrlY, 0, tcell.ModNone)
+			return true
+		}, wantChanged: true, wantContent: "a"},
+		{name: "redo", f: e.Redo, wantChanged: true, wantContent: "a\n"},
+		{name: "redo", f: e.Redo, wantChanged: true, wantContent: "a\nb"},
+		{name: "redo", f: e.Redo, wantChanged: false, wantContent: "a\nb"},
+	} {
+		changes = changes[:0]
+		if got := tc.f(); got != tc.wantChanged {
+			t.Errorf("%s to %q: Got changed %v, wanted %v", tc.name, tc.wantContent, got, tc.wantChanged)
+		}
+		if got := e.Content(); got != tc.wantContent {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.wantContent)
+		}
+		if tc.wantChanged && (len(changes) != 1 || changes[0] != tc.wantContent) {
+			t.Errorf("%s to %q: Got changes %q, wanted one with the content", tc.name, tc.wantContent, changes)
+		}
+	}
+}
+
+func TestClipboardMethods(t *testing.T) {
+	e := newTestEditor(t, 20, 5, "ab cd")
+	e.SetCursorPosition(0, 3)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.press(tcell.KeyRight, 0, tcell.ModShift)
+	e.Copy()
+	undoPatches := len(e.undoPatches)
+	e.Cut()
+	if got, want := e.Content(), "ab "; got != want {
+		t.Errorf("Got %q after Cut, wanted %q", got, want)
+	}
+	e.SetCursorPosition(0, 0)
+	e.Paste()
+	if got, want := e.Content(), "cdab "; got != want {
+		t.Errorf("Got %q after Paste, wanted %q", got, want)
+	}
+	e.InsertText("<x> &\r\ny\nz")
+	if got, want := e.Content(), "cd&lt;x&gt; &amp;\ny\nzab "; got != want {
+		t.Errorf("Got %q after InsertText, wanted %q", got, want)
+	}
+	if line, col := e.CursorPosition(); line != 2 || col != 1 {
+		t.Errorf("Got cursor at %v:%v after InsertText, wanted 2:1", line, col)
+	}
+	if got := len(e.undoPatches) - undoPatches; got != 3 {
+		t.Errorf("Got %v undo patches, wanted one per Cut, Paste and InsertText", got)
+	}
+	e.Undo()
+	if got, want := e.Content(), "cdab "; got != want {
+		t.Errorf("Got %q after undoing InsertText, wanted %q", got, want)
+	}
+}
+
+func TestWordBoundary(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		boundary *regexp.Regexp
+		keys     []*tcell.EventKey
+		wantText string
+		wantCol  int
+	}{
+		{
+			name:     "default right",
+			keys:     []*tcell.EventKey{tcell.NewEventKey(tcell.KeyRight, 0, tcell.ModCtrl)},
+			wantText: "foo_bar baz",
+			wantCol:  7,
+		},
+		{
+			name:     "snake right",
+			boundary: regexp.MustCompile(`[\s_]`),
+			keys:     []*tcell.EventKey{tcell.NewEventKey(tcell.KeyRight, 0, tcell.ModCtrl)},
+			wantText: "foo_bar baz",
+			wantCol:  3,
+		},
+		{
+			name:     "snake delete forward",
+			boundary: regexp.MustCompile(`[\s_]`),
+			keys:     []*tcell.EventKey{tcell.NewEventKey(tcell.KeyDelete, 0, tcell.ModCtrl)},
+			wantText: "_bar baz",
+			wantCol:  0,
+		},
+		{
+			name:     "snake delete backward",
+			boundary: regexp.MustCompile(`[\s_]`),
+			keys: []*tcell.EventKey{
+				tcell.NewEventKey(tcell.KeyEnd, 0, tcell.ModNone),
+				tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModNone),
+				tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModNone),
+				tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModNone),
+				tcell.NewEventKey(tcell.KeyLeft, 0, tcell.ModNone),
+				tcell.NewEventKey(tcell.KeyBackspace, 0, tcell.ModCtrl),
+			},
+			wantText: "foo_ baz",
+			wantCol:  4,
+		},
+	} {
+		e := newTestEditor(t, 30, 3, "foo_bar baz")
+		e.WordBoundary = tc.boundary
+		for _, ev := range tc.keys {
+			e.handleEvent(ev)
+		}
+		if got := e.Content(); got != tc.wantText {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.wantText)
+		}
+		if _, col := e.CursorPosition(); col != tc.wantCol {
+			t.Errorf("%s: Got cursor at column %v, wanted %v", tc.name, col, tc.wantCol)
+		}
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"plain",
+		"a < b > c & d",
+		"&&&",
+		"&amp;",
+		"&amp;lt;",
+		"&lt;&gt;",
+		"<&>&<",
+		"&am&p;",
+	} {
+		if got := Unescape(Escape(s)); got != s {
+			t.Errorf("Got %q from Unescape(Escape(%q)), wanted it back", got, s)
+		}
+	}
+	for _, tc := range []struct {
+		escaped string
+		want    string
+	}{
+		{escaped: "&amp;lt;", want: "&lt;"},
+		{escaped: "&amp;amp;", want: "&amp;"},
+		{escaped: "&lt;b&gt; &amp", want: "<b> &amp"},
+	} {
+		if got := Unescape(tc.escaped); got != tc.want {
+			t.Errorf("Got %q from Unescape(%q), wanted %q", got, tc.escaped, tc.want)
+		}
+	}
+}
+
+func TestNumericAndUnknownEntities(t *testing.T) {
+	e := newTestEditor(t, 20, 3, "a&#39;b&foo;c & d")
+	if got, want := e.RenderToString(), "a'b&foo;c & d\n\n"; got != want {
+		t.Errorf("Got %q rendered, wanted %q", got, want)
+	}
+	if got, want := PlainText(e.Content()), "a'b&foo;c & d"; got != want {
+		t.Errorf("Got plain text %q, wanted %q", got, want)
+	}
+	e.SetCursorPosition(0, 1)
+	e.press(tcell.KeyDelete, 0, tcell.ModNone)
+	if got, want := e.Content(), "ab&foo;c & d"; got != want {
+		t.Errorf("Got %q after deleting the numeric entity, wanted %q", got, want)
+	}
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyDelete, 0, tcell.ModNone)
+	if got, want := e.Content(), "abfoo;c & d"; got != want {
+		t.Errorf("Got %q after deleting the ampersand of the unknown entity, wanted %q", got, want)
+	}
+}
+
+func TestBlockSelection(t *testing.T) {
+	e := newTestEditor(t, 20, 6, "abcdef\nghijkl\nmn\nopqrst")
+	e.SetCursorPosition(0, 1)
+	e.press(tcell.KeyCtrlB, 0, tcell.ModNone)
+	for _, key := range []tcell.Key{tcell.KeyDown, tcell.KeyDown, tcell.KeyDown, tcell.KeyRight, tcell.KeyRight} {
+		e.press(key, 0, tcell.ModNone)
+	}
+	selected := ""
+	for _, row := range e.Cells()[:4] {
+		for _, cell := range row {
+			if cell.Style == e.selectionStyle() {
+				selected += string(cell.Rune)
+			}
+		}
+		selected += "|"
+	}
+	if want := "bc|hi|n|pq|"; selected != want {
+		t.Errorf("Got %q drawn as selected, wanted %q", selected, want)
+	}
+	e.press(tcell.KeyCtrlX, 0, tcell.ModNone)
+	if got, want := e.Content(), "adef\ngjkl\nm\norst"; got != want {
+		t.Errorf("Got %q after cutting the block, wanted %q", got, want)
+	}
+	if got, want := runesToString(e.pasteBuffer), "bc\nhi\nn\npq"; got != want {
+		t.Errorf("Got %q cut, wanted %q", got, want)
+	}
+	if line, col := e.CursorPosition(); line != 0 || col != 1 {
+		t.Errorf("Got cursor at %v:%v after cutting the block, wanted 0:1", line, col)
+	}
+	e.press(tcell.KeyCtrlV, 0, tcell.ModNone)
+	if got, want := e.Content(), "abcdef\nghijkl\nmn\nopqrst"; got != want {
+		t.Errorf("Got %q after pasting the block, wanted %q", got, want)
+	}
+	if line, col := e.CursorPosition(); line != 3 || col != 3 {
+		t.Errorf("Got cursor at %v:%v after pasting the block, wanted 3:3", line, col)
+	}
+
+	e = newTestEditor(t, 20, 6, "ab\nc")
+	e.press(tcell.KeyCtrlB, 0, tcell.ModNone)
+	e.press(tcell.KeyDown, 0, tcell.ModNone)
+	e.press(tcell.KeyRight, 0, tcell.ModNone)
+	e.press(tcell.KeyCtrlC, 0, tcell.ModNone)
+	e.press(tcell.KeyEnd, 0, tcell.ModCtrl)
+	e.press(tcell.KeyCtrlV, 0, tcell.ModNone)
+	if got, want := e.Content(), "ab\nca\n c"; got != want {
+		t.Errorf("Got %q after pasting the block past the end, wanted %q", got, want)
+	}
+
+	e = newTestEditor(t, 20, 6, "abcdef\ng&amp;ijkl")
+	e.handleEvent(tcell.NewEventMouse(1, 0, tcell.Button1, tcell.ModAlt))
+	e.handleEvent(tcell.NewEventMouse(3, 1, tcell.Button1, tcell.ModAlt))
+	e.handleEvent(tcell.NewEventMouse(3, 1, tcell.ButtonNone, tcell.ModNone))
+	if got := e.selectedText(); got != "" {
+		t.Errorf("Got linear selection %q after Alt-dragging, wanted none", got)
+	}
+	e.Copy()
+	if got, want := runesToString(e.pasteBuffer), "bc\n&i"; got != want {
+		t.Errorf("Got %q copied after Alt-dragging, wanted %q", got, want)
+	}
+	e.press(tcell.KeyRune, 'x', tcell.ModNone)
+	if e.block != nil {
+		t.Errorf("Got block selection after typing, wanted none")
+	}
+	if got, want := e.Content(), "abcdef\ng&amp;ixjkl"; got != want {
+		t.Errorf("Got %q after typing, wanted %q", got, want)
+	}
+}
+
+func TestJoinLines(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		content       string
+		withoutSpace  bool
+		keys          func(e *Editor)
+		want          string
+		wantSelection string
+		wantCursor    Position
+	}{
+		{
+			name:       "next line",
+			content:    "foo\n    bar\nbaz",
+			keys:       func(e *Editor) { e.SetCursorPosition(0, 1) },
+			want:       "foo bar\nbaz",
+			wantCursor: Position{Line: 0, Col: 3},
+		},
+		{
+			name:         "without space",
+			content:      "foo\n  bar",
+			withoutSpace: true,
+			want:         "foobar",
+			wantCursor:   Position{Line: 0, Col: 3},
+		},
+		{
+			name:       "trailing space",
+			content:    "foo \n\tbar",
+			want:       "foo bar",
+			wantCursor: Position{Line: 0, Col: 4},
+		},
+		{
+			name:       "blank line",
+			content:    "foo\n   \nbar",
+			want:       "foo\nbar",
+			wantCursor: Position{Line: 0, Col: 3},
+		},
+		{
+			name:       "leading markup",
+			content:    "a\n  <color:ff0000:000000>b",
+			want:       "a <color:ff0000:000000>b",
+			wantCursor: Position{Line: 0, Col: 1},
+		},
+		{
+			name:       "last line",
+			content:    "foo\nbar",
+			keys:       func(e *Editor) { e.press(tcell.KeyDown, 0, tcell.ModNone) },
+			want:       "foo\nbar",
+			wantCursor: Position{Line: 1, Col: 0},
+		},
+		{
+			name:    "selected lines",
+			content: "a\n  b\n\tc\nd",
+			keys: func(e *Editor) {
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyDown, 0, tcell.ModShift)
+				e.press(tcell.KeyRight, 0, tcell.ModShift)
+			},
+			want:          "a b c\nd",
+			wantSelection: "a b ",
+			wantCursor:    Position{Line: 0, Col: len("<select-from>a b <select-to>")},
+		},
+	} {
+		e := newTestEditor(t, 20, 10, tc.content)
+		e.JoinWithoutSpace = tc.withoutSpace
+		if tc.keys != nil {
+			tc.keys(e)
+		}
+		undoPatches := len(e.undoPatches)
+		e.press(tcell.KeyCtrlJ, 0, tcell.ModNone)
+		if got := selectTokenPattern.ReplaceAllString(e.Content(), ""); got != tc.want {
+			t.Errorf("%s: Got %q, wanted %q", tc.name, got, tc.want)
+		}
+		if got := e.selectedText(); got != tc.wantSelection {
+			t.Errorf("%s: Got selection %q, wanted %q", tc.name, got, tc.wantSelection)
+		}
+		line, col := e.CursorPosition()
+		if got := (Position{Line: line, Col: col}); got != tc.wantCursor {
+			t.Errorf("%s: Got cursor %+v, wanted %+v", tc.name, got, tc.wantCursor)
+		}
+		wantPatches := 1
+		if tc.want == tc.content {
+			wantPatches = 0
+		}
+		if got := len(e.undoPatches) - undoPatches; got != wantPatches {
+			t.Errorf("%s: Got %v undo patches, wanted %v", tc.name, got, wantPatches)
+		}
+	}
+}
+
+func TestCenterCursorAndEnsureVisible(t *testing.T) {
+	for _, tc := range []struct {
+		line           int
+		ctrlL          bool
+		wantLineOffset int
+	}{
+		{line: 10, wantLineOffset: 8},
+		{line: 10, ctrlL: true, wantLineOffset: 8},
+		{line: 1, wantLineOffset: 0},
+		{line: 19, ctrlL: true, wantLineOffset: 15},
+	} {
+		e := newTestEditor(t, 10, 5, numberedLines(20))
+		e.SetCursorPosition(tc.line, 0)
+		if tc.ctrlL {
+			e.press(tcell.KeyCtrlL, 0, tcell.ModNone)
+		} else {
+			e.CenterCursor()
+		}
+		if e.lineOffset != tc.wantLineOffset {
+			t.Errorf("Got line offset %v centering line %v, wanted %v", e.lineOffset, tc.line, tc.wantLineOffset)
+		}
+		if line, _ := e.CursorPosition(); line != tc.line {
+			t.Errorf("Got cursor on line %v after centering, wanted %v", line, tc.line)
+		}
+	}
+
+	e := newTestEditor(t, 10, 5, numberedLines(20))
+	e.SetCursorPosition(17, 0)
+	e.rawBuffer = stringToRunes("a\nb\nc")
+	e.redraw()
+	e.EnsureVisible()
+	if got, want := e.RenderToString(), "a\nb\nc\n\n"; got != want {
+		t.Errorf("Got %q after shrinking the content, wanted %q", got, want)
+	}
+	if line, _ := e.CursorPosition(); line != 2 {
+		t.Errorf("Got cursor on line %v after shrinking the content, wanted 2", line)
+	}
+	e.EnsureVisible()
+	if e.lineOffset != 0 {
+		t.Errorf("Got line offset %v when the cursor was visible, wanted 0", e.lineOffset)
+	}
+}
+
+func TestBlockSelectionClearedByReplacedContent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		replace func(e *Editor)
+	}{
+		{name: "SetContent", replace: func(e *Editor) { e.SetContent("a") }},
+		{name: "ApplyRemotePatch", replace: func(e *Editor) {
+			dmp := diffmatchpatch.New()
+			e.ApplyRemotePatch(dmp.PatchMake("a\nb\nc", "a"))
+		}},
+		{name: "ReplaceAll", replace: func(e *Editor) { e.ReplaceAll(regexp.MustCompile("\n[bc]"), "") }},
+		{name: "undo", replace: func(e *Editor) {
+			e.SetCursorPosition(0, 0)
+			e.press(tcell.KeyCtrlB, 0, tcell.ModNone)
+			e.press(tcell.KeyDown, 0, tcell.ModNone)
+			e.press(tcell.KeyDown, 0, tcell.ModNone)
+			e.Undo()
+		}},
+		{name: "stale layout", replace: func(e *Editor) {
+			// Drawing with the cursor past the content must not panic even with a block selection.
+			e.rawBuffer = stringToRunes("a")
+			e.redraw()
+			e.setCursor()
+			e.block = nil
+		}},
+	} {
+		e := newTestEditor(t, 20, 5, "a\nb\nc")
+		e.typeString("x")
+		e.press(tcell.KeyDown, 0, tcell.ModNone)
+		e.press(tcell.KeyDown, 0, tcell.ModNone)
+		e.press(tcell.KeyCtrlB, 0, tcell.ModNone)
+		tc.replace(e)
+		if e.block != nil {
+			t.Errorf("%s: Got a block selection after replacing the content, wanted none", tc.name)
+		}
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+	}
+}
+
+func TestBlockSelectionColumns(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		content    string
+		wantCopied string
+		wantCut    string
+	}{
+		{name: "tab", content: "\tab\nxyzwv", wantCopied: "a\nv", wantCut: "\tb\nxyzw"},
+		{name: "wide runes", content: "日本\nabcd", wantCopied: "本\nc", wantCut: "日\nabd"},
+	} {
+		e := newTestEditor(t, 20, 5, tc.content)
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+		e.press(tcell.KeyCtrlB, 0, tcell.ModNone)
+		e.press(tcell.KeyDown, 0, tcell.ModNone)
+		e.press(tcell.KeyRight, 0, tcell.ModNone)
+		e.Copy()
+		if got := runesToString(e.pasteBuffer); got != tc.wantCopied {
+			t.Errorf("%s: Got %q copied, wanted %q", tc.name, got, tc.wantCopied)
+		}
+		e.Cut()
+		if got := e.Content(); got != tc.wantCut {
+			t.Errorf("%s: Got %q after cutting, wanted %q", tc.name, got, tc.wantCut)
+		}
+		e.Paste()
+		if got := e.Content(); got != tc.content {
+			t.Errorf("%s: Got %q after pasting back, wanted %q", tc.name, got, tc.content)
+		}
+	}
+}